@@ -1,17 +1,22 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net/http"
+	"os"
 
 	_ "dm-backend/docs"
 	"dm-backend/internal/activities"
 	"dm-backend/internal/api"
+	"dm-backend/internal/codec"
 	"dm-backend/internal/config"
 	"dm-backend/internal/workflow"
 
 	"go.temporal.io/sdk/activity"
 	"go.temporal.io/sdk/client"
 	"go.temporal.io/sdk/worker"
+	sdkworkflow "go.temporal.io/sdk/workflow"
 )
 
 func main() {
@@ -19,35 +24,112 @@ func main() {
 
 	log.Printf("Using TEMPORAL_HOSTPORT from config: %s", cfg.TemporalHost)
 
-	c, err := client.NewClient(client.Options{
-		HostPort: cfg.TemporalHost,
-	})
+	clientOptions := client.Options{
+		HostPort:           cfg.TemporalHost,
+		ContextPropagators: []sdkworkflow.ContextPropagator{activities.DittoTargetPropagator()},
+	}
+	if cfg.PayloadKey != "" {
+		dataConverter, err := codec.NewDataConverter(cfg.PayloadKeyID, cfg.PayloadKey)
+		if err != nil {
+			log.Fatalln("unable to create payload codec", err)
+		}
+		clientOptions.DataConverter = dataConverter
+	} else {
+		log.Println("PAYLOAD_ENCRYPTION_KEY not set, workflow payloads are stored unencrypted")
+	}
+
+	c, err := client.NewClient(clientOptions)
 	if err != nil {
 		log.Fatalln("unable to create Temporal client", err)
 	}
 	defer c.Close()
 
-	dittoClient := &activities.DittoClient{
-		Host:           cfg.DittoHost,
-		Username:       cfg.DittoUsername,
-		Password:       cfg.DittoPassword,
-		DevopsUsername: cfg.DittoDevopsUsername,
-		DevopsPassword: cfg.DittoDevopsPassword,
+	templates, err := activities.NewTemplateRegistry(cfg.TemplateDir)
+	if err != nil {
+		log.Fatalln("unable to load connection templates", err)
+	}
+
+	var policyTemplate string
+	if cfg.SitePolicyTemplateFile != "" {
+		content, err := os.ReadFile(cfg.SitePolicyTemplateFile)
+		if err != nil {
+			log.Fatalln("unable to read site policy template", err)
+		}
+		if err := activities.ValidatePolicyTemplate(string(content)); err != nil {
+			log.Fatalln("invalid site policy template", err)
+		}
+		policyTemplate = string(content)
+	}
+	var secrets activities.SecretStore
+	if cfg.SecretDir != "" {
+		secrets = activities.FileSecretStore{Dir: cfg.SecretDir}
+	}
+
+	clients := make(map[string]*activities.DittoClient, len(cfg.DittoTargets))
+	for name, target := range cfg.DittoTargets {
+		dittoClient, err := newDittoClient(target)
+		if err != nil {
+			log.Fatalf("unable to configure Ditto target %s: %v", name, err)
+		}
+		dittoClient.Templates = templates
+		dittoClient.PolicyTemplate = policyTemplate
+		dittoClient.Secrets = secrets
+		clients[name] = dittoClient
+		log.Printf("Using Ditto target %s at %s", name, target.Host)
+	}
+	dittoClients, err := activities.NewDittoClients(cfg.DefaultDittoTarget, clients)
+	if err != nil {
+		log.Fatalln("invalid DITTO_DEFAULT_TARGET", err)
+	}
+	defer dittoClients.Close()
+	if cfg.SnapshotDir == "" {
+		log.Fatalln("SNAPSHOT_DIR is required, compensations restore values from it and it must be shared by all workers")
+	}
+	if err := os.MkdirAll(cfg.SnapshotDir, 0o700); err != nil {
+		log.Fatalln("unable to create SNAPSHOT_DIR", err)
+	}
+	activitiesImpl := &activities.Activities{
+		DittoClients: dittoClients,
+		Snapshots:    activities.DirSnapshotStore{Dir: cfg.SnapshotDir},
 	}
-	activitiesImpl := &activities.Activities{DittoClient: dittoClient}
 
 	w := worker.New(c, config.TaskQueue, worker.Options{})
 	w.RegisterWorkflow(workflow.MassDeviceConfigWorkflow)
 	w.RegisterWorkflow(workflow.CreateSiteWorkflow)
 	w.RegisterWorkflow(workflow.CreateSiteBatchWorkflow)
+	w.RegisterWorkflow(workflow.UpdateSiteWorkflow)
+	w.RegisterWorkflow(workflow.DeleteSiteWorkflow)
+	w.RegisterWorkflow(workflow.DevicePatchWorkflow)
+	w.RegisterWorkflow(workflow.ReconcileWorkflow)
+	w.RegisterActivity(activitiesImpl.DittoTarget)
 	w.RegisterActivity(activitiesImpl.FetchDevicesFromDitto)
+	w.RegisterActivity(activitiesImpl.FetchDevicePage)
+	w.RegisterActivity(activitiesImpl.CountDevicesInDitto)
 	w.RegisterActivity(activitiesImpl.ConfigureDevice)
+	w.RegisterActivity(activitiesImpl.SnapshotDevice)
+	w.RegisterActivity(activitiesImpl.ListPatchedDevices)
+	w.RegisterActivity(activitiesImpl.RestoreDevice)
+	w.RegisterActivity(activitiesImpl.DeleteSnapshot)
 	w.RegisterActivity(activitiesImpl.CreateConnection)
 	w.RegisterActivity(activitiesImpl.GetConnectionStatus)
+	w.RegisterActivity(activitiesImpl.FindConnection)
+	w.RegisterActivity(activitiesImpl.GetConnection)
+	w.RegisterActivity(activitiesImpl.ModifyConnection)
+	w.RegisterActivity(activitiesImpl.PutConnection)
+	w.RegisterActivity(activitiesImpl.SnapshotConnection)
+	w.RegisterActivity(activitiesImpl.RestoreConnection)
+	w.RegisterActivity(activitiesImpl.SendConnectionCommand)
+	w.RegisterActivity(activitiesImpl.DeleteConnection)
+	w.RegisterActivity(activitiesImpl.GetConnectionTemplateVersion)
 	w.RegisterActivity(activitiesImpl.CreateThing)
 	w.RegisterActivity(activitiesImpl.DeleteThing)
 	w.RegisterActivityWithOptions(activitiesImpl.SendDittoProtocolMessage, activity.RegisterOptions{Name: "SendDittoProtocolMessage"})
-	w.RegisterActivityWithOptions(activitiesImpl.SendDittoProtocolMessage, activity.RegisterOptions{Name: "UpdateGatewayPolicy"})
+	w.RegisterActivity(activitiesImpl.CreatePolicy)
+	w.RegisterActivity(activitiesImpl.CreateSitePolicy)
+	w.RegisterActivity(activitiesImpl.GetPolicy)
+	w.RegisterActivity(activitiesImpl.ModifyPolicyEntry)
+	w.RegisterActivity(activitiesImpl.DeletePolicyEntry)
+	w.RegisterActivity(activitiesImpl.DeletePolicy)
 
 	go func() {
 		if err := w.Run(worker.InterruptCh()); err != nil {
@@ -56,5 +138,70 @@ func main() {
 	}()
 
 	// Start API server
-	api.RunServer(c)
+	api.RunServer(c, dittoClients, templates)
+}
+
+// newDittoClient creates the client of a Ditto target with its transport and authentication
+func newDittoClient(target config.DittoTargetConfig) (*activities.DittoClient, error) {
+	dittoClient := &activities.DittoClient{
+		Host:           target.Host,
+		Username:       target.Username,
+		Password:       target.Password,
+		DevopsUsername: target.DevopsUsername,
+		DevopsPassword: target.DevopsPassword,
+		PolicySubject:  target.PolicySubject,
+	}
+	if target.Auth.Method != config.DittoAuthBasic && target.PolicySubject == "" {
+		return nil, fmt.Errorf("a policy subject is required with %s authentication", target.Auth.Method)
+	}
+	transport := target.Transport
+	err := dittoClient.ConfigureTransport(activities.TransportConfig{
+		TLS:                 transport.TLS,
+		CAFile:              transport.CAFile,
+		CertFile:            transport.CertFile,
+		KeyFile:             transport.KeyFile,
+		InsecureSkipVerify:  transport.InsecureSkipVerify,
+		ProxyURL:            transport.ProxyURL,
+		RequestTimeout:      transport.RequestTimeout,
+		DialTimeout:         transport.DialTimeout,
+		MaxIdleConns:        transport.MaxIdleConns,
+		MaxIdleConnsPerHost: transport.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     transport.MaxConnsPerHost,
+		IdleConnTimeout:     transport.IdleConnTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid transport: %w", err)
+	}
+	dittoClient.Auth, err = dittoAuthenticator(target.Auth, dittoClient.HTTPClient)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authentication: %w", err)
+	}
+	return dittoClient, nil
+}
+
+// dittoAuthenticator returns the authenticator of the configured method, nil for basic auth with the Ditto user.
+// Tokens are requested with the HTTP client of the Ditto target, so its CAs, client certificate and proxy apply.
+func dittoAuthenticator(cfg config.DittoAuthConfig, httpClient *http.Client) (activities.Authenticator, error) {
+	switch cfg.Method {
+	case config.DittoAuthBasic:
+		return nil, nil
+	case config.DittoAuthBearer:
+		if cfg.BearerToken == "" {
+			return nil, fmt.Errorf("bearer token is required")
+		}
+		return activities.BearerToken{Token: cfg.BearerToken}, nil
+	case config.DittoAuthClientCredentials:
+		if cfg.TokenURL == "" || cfg.ClientID == "" {
+			return nil, fmt.Errorf("OAuth2 token URL and client ID are required")
+		}
+		return &activities.ClientCredentials{
+			TokenURL:     cfg.TokenURL,
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Scopes:       cfg.Scopes,
+			HTTPClient:   httpClient,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown authentication method %q, expected basic, bearer or client_credentials", cfg.Method)
+	}
 }
@@ -1,42 +1,58 @@
 package activities
 
 import (
+	"context"
 	"encoding/base64"
+	"fmt"
 	"net/http"
 	"sync"
 
 	"github.com/gorilla/websocket"
+	"go.temporal.io/sdk/temporal"
 )
 
 type DittoClient struct {
 	Host           string
 	Username       string
 	Password       string
-	DevopsUsername string // Optional, if needed for devops operations
-	DevopsPassword string // Optional, if needed for devops operations
+	DevopsUsername string            // Optional, if needed for devops operations
+	DevopsPassword string            // Optional, if needed for devops operations
+	Templates      *TemplateRegistry // Optional, defaults to the built-in connection templates
+	Secrets        SecretStore       // Optional, resolves secret placeholders of connection templates
+	PolicyTemplate string            // Optional, Go text/template of site policies, defaults to the built-in one
+	PolicySubject  string            // Optional, subject granted access in site policies, defaults to nginx:<Username> with basic auth
+	TLS            bool              // Optional, use https and wss, see ConfigureTransport
+	HTTPClient     *http.Client      // Optional, defaults to http.DefaultClient
+	Dialer         *websocket.Dialer // Optional, defaults to websocket.DefaultDialer
+	Auth           Authenticator     // Optional, defaults to basic auth with Username and Password
+	DevopsAuth     Authenticator     // Optional, defaults to basic auth with DevopsUsername and DevopsPassword
 
-	wsConn  *websocket.Conn
-	wsMutex sync.Mutex
+	wsOnce    sync.Once
+	wsSession *wsSession
 }
 
-// ConnectWebSocket establishes a websocket connection to Ditto
-func (c *DittoClient) ConnectWebSocket(wsURL string) error {
-	c.wsMutex.Lock()
-	defer c.wsMutex.Unlock()
-	if c.wsConn != nil {
-		return nil // already connected
-	}
-	dialer := websocket.DefaultDialer
+// webSocket returns the client's long-lived Ditto WebSocket session, creating it on first use
+func (c *DittoClient) webSocket() *wsSession {
+	c.wsOnce.Do(func() {
+		c.wsSession = newWSSession(c.webSocketURL(), c.Dialer, func(ctx context.Context) (http.Header, error) {
+			authorization, err := c.authenticator().Authorization(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to authenticate with Ditto: %w", err)
+			}
+			return http.Header{"Authorization": {authorization}}, nil
+		})
+	})
+	return c.wsSession
+}
 
-	header := http.Header{}
+var defaultTemplates, _ = NewTemplateRegistry("")
 
-	header.Set("Authorization", "Basic "+basicAuth(c.Username, c.Password))
-	conn, _, err := dialer.Dial(wsURL, header)
-	if err != nil {
-		return err
+// templateRegistry returns the client's connection templates
+func (c *DittoClient) templateRegistry() *TemplateRegistry {
+	if c.Templates != nil {
+		return c.Templates
 	}
-	c.wsConn = conn
-	return nil
+	return defaultTemplates
 }
 
 // basicAuth returns the base64 encoded basic auth string for username and password
@@ -50,18 +66,33 @@ func encodeBase64(s string) string {
 	return base64.StdEncoding.EncodeToString([]byte(s))
 }
 
-// CloseWebSocket closes the websocket connection
+// CloseWebSocket closes the websocket session; in-flight commands fail
 func (c *DittoClient) CloseWebSocket() error {
-	c.wsMutex.Lock()
-	defer c.wsMutex.Unlock()
-	if c.wsConn != nil {
-		err := c.wsConn.Close()
-		c.wsConn = nil
-		return err
-	}
-	return nil
+	return c.webSocket().close()
 }
 
 type Activities struct {
-	DittoClient *DittoClient
+	DittoClients *DittoClients
+	Snapshots    SnapshotStore // Required by compensations, must be shared by all workers
+}
+
+// snapshotStore returns the store of values restored by compensations
+func (a *Activities) snapshotStore() SnapshotStore {
+	if a.Snapshots != nil {
+		return a.Snapshots
+	}
+	return noSnapshotStore{}
 }
+
+// noSnapshotStore fails every call, so a worker without a store cannot take snapshots it would lose
+type noSnapshotStore struct{}
+
+func (noSnapshotStore) err() error {
+	return temporal.NewNonRetryableApplicationError("no snapshot store configured", "NoSnapshotStore", nil)
+}
+
+func (s noSnapshotStore) Put(string, string, []byte) error           { return s.err() }
+func (s noSnapshotStore) Get(string, string) ([]byte, error)         { return nil, s.err() }
+func (s noSnapshotStore) Keys(string, string, int) ([]string, error) { return nil, s.err() }
+func (s noSnapshotStore) Delete(string, string) error                { return s.err() }
+func (s noSnapshotStore) DeleteAll(string) error                     { return s.err() }
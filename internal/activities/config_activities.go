@@ -1,34 +1,160 @@
 package activities
 
 import (
-	"bytes"
 	"context"
-	"dm-backend/internal/models"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"regexp"
 )
 
-func (c *DittoClient) ConfigureDevice(ctx context.Context, device models.Device, configParams map[string]string) error {
-	url := fmt.Sprintf("http://%s/api/2/things/%s/attributes", c.Host, device.ThingId)
-	payload, _ := json.Marshal(configParams)
-	req, _ := http.NewRequest("PATCH", url, bytes.NewBuffer(payload))
-	req.Header.Set("Content-Type", "application/merge-patch+json")
+// DefaultDevicePatchPath is the thing resource patched when no path is given
+const DefaultDevicePatchPath = "/attributes"
 
-	req.SetBasicAuth(c.Username, c.Password)
+var devicePatchPathRegex = regexp.MustCompile(`^/(attributes|features/[^/]+/(properties|desiredProperties))(/[^/]+)*$`)
 
-	resp, err := http.DefaultClient.Do(req)
+// ValidateDevicePatchPath checks that path points into the attributes or the (desired) properties of a feature
+func ValidateDevicePatchPath(path string) error {
+	if !devicePatchPathRegex.MatchString(path) {
+		return fmt.Errorf("path '%s' must be /attributes[/...] or /features/<featureId>/properties[/...] or /features/<featureId>/desiredProperties[/...]", path)
+	}
+	return nil
+}
+
+type ConfigureDeviceParams struct {
+	ThingId       string
+	Path          string                 // Thing resource to patch, defaults to /attributes
+	Patch         map[string]interface{} // JSON merge patch applied to the resource
+	Condition     string                 // Optional RQL condition the thing must fulfil, e.g. eq(attributes/firmware,"1.2")
+	IfMatch       string                 // Optional ETag the resource must still have
+	IfNoneMatch   string                 // Optional, "*" to only patch if the resource does not exist yet
+	CorrelationID string                 // Optional, passed to Ditto for tracing
+	SnapshotID    string                 // Optional, records the patch in the snapshot SnapshotDevice took under this ID
+}
+
+// ConfigureDeviceResult is the state of the resource after the patch
+type ConfigureDeviceResult struct {
+	ETag string // ETag of the patched resource, used to condition a later restore
+}
+
+// ConfigureDevice merge-patches a resource of a thing, by default its attributes
+func (c *DittoClient) ConfigureDevice(ctx context.Context, params ConfigureDeviceParams) (ConfigureDeviceResult, error) {
+	path := params.Path
+	if path == "" {
+		path = DefaultDevicePatchPath
+	}
+	if err := ValidateDevicePatchPath(path); err != nil {
+		return ConfigureDeviceResult{}, err
+	}
+	url := fmt.Sprintf("%s/api/2/things/%s%s", c.baseURL(), params.ThingId, path)
+	payload, err := json.Marshal(params.Patch)
 	if err != nil {
-		return err
+		return ConfigureDeviceResult{}, fmt.Errorf("failed to marshal patch: %w", err)
+	}
+
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/merge-patch+json")
+	if params.Condition != "" {
+		headers.Set("condition", params.Condition)
+	}
+	if params.IfMatch != "" {
+		headers.Set("If-Match", params.IfMatch)
+	}
+	if params.IfNoneMatch != "" {
+		headers.Set("If-None-Match", params.IfNoneMatch)
+	}
+	if params.CorrelationID != "" {
+		headers.Set("correlation-id", params.CorrelationID)
+	}
+
+	resp, respBody, err := c.doDittoRequestWithHeaders(ctx, "PATCH", url, payload, headers)
+	if err != nil {
+		return ConfigureDeviceResult{}, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("ditto HTTP call failed: %s", resp.Status)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusCreated {
+		return ConfigureDeviceResult{}, newDittoError(resp.StatusCode, respBody)
 	}
-	return nil
+	return ConfigureDeviceResult{ETag: resp.Header.Get("ETag")}, nil
+}
+
+// Wrap Activities.ConfigureDevice to use DittoClient. With a SnapshotID the post-patch ETag is recorded
+// in the device's snapshot, so the patch can be rolled back with RestoreDevice.
+func (a *Activities) ConfigureDevice(ctx context.Context, params ConfigureDeviceParams) (ConfigureDeviceResult, error) {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return ConfigureDeviceResult{}, err
+	}
+	result, err := client.ConfigureDevice(ctx, params)
+	if err != nil || params.SnapshotID == "" {
+		return result, err
+	}
+	snapshot, err := a.deviceSnapshot(params.SnapshotID, params.ThingId)
+	if err != nil {
+		return result, err
+	}
+	snapshot.Patched, snapshot.ETag = true, result.ETag
+	return result, a.putDeviceSnapshot(params.SnapshotID, params.ThingId, snapshot)
 }
 
-// Wrap Activities.ConfigureDevice to use DittoClient
-func (a *Activities) ConfigureDevice(ctx context.Context, device models.Device, configParams map[string]string) error {
-	return a.DittoClient.ConfigureDevice(ctx, device, configParams)
+type SnapshotDeviceParams struct {
+	ThingId    string
+	Path       string                 // Thing resource about to be patched, defaults to /attributes
+	Patch      map[string]interface{} // The merge patch about to be applied
+	SnapshotID string                 // Optional, keeps the restore patch in the snapshot store instead of returning it
+}
+
+// DeviceSnapshot captures a thing resource before it is patched
+type DeviceSnapshot struct {
+	Restore map[string]interface{} // Merge patch restoring the previous values once the patch has been applied
+	ETag    string                 // ETag of the resource, empty if it did not exist
+}
+
+// SnapshotDevice reads the resource affected by the patch and returns the merge patch
+// that restores its current values once the patch has been applied
+func (c *DittoClient) SnapshotDevice(ctx context.Context, params SnapshotDeviceParams) (DeviceSnapshot, error) {
+	path := params.Path
+	if path == "" {
+		path = DefaultDevicePatchPath
+	}
+	if err := ValidateDevicePatchPath(path); err != nil {
+		return DeviceSnapshot{}, err
+	}
+	url := fmt.Sprintf("%s/api/2/things/%s%s", c.baseURL(), params.ThingId, path)
+	resp, respBody, err := c.doDittoRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return DeviceSnapshot{}, err
+	}
+	defer resp.Body.Close()
+	current := map[string]interface{}{}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		// The resource does not exist yet
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return DeviceSnapshot{}, newDittoError(resp.StatusCode, respBody)
+	default:
+		if err := json.Unmarshal(respBody, &current); err != nil {
+			return DeviceSnapshot{}, fmt.Errorf("failed to parse %s JSON: %w", path, err)
+		}
+	}
+	return DeviceSnapshot{
+		Restore: inverseMergePatch(current, params.Patch),
+		ETag:    resp.Header.Get("ETag"),
+	}, nil
+}
+
+func (a *Activities) SnapshotDevice(ctx context.Context, params SnapshotDeviceParams) (DeviceSnapshot, error) {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return DeviceSnapshot{}, err
+	}
+	snapshot, err := client.SnapshotDevice(ctx, params)
+	if err != nil || params.SnapshotID == "" {
+		return snapshot, err
+	}
+	stored := storedDeviceSnapshot{Restore: snapshot.Restore}
+	if err := a.putDeviceSnapshot(params.SnapshotID, params.ThingId, stored); err != nil {
+		return DeviceSnapshot{}, err
+	}
+	return DeviceSnapshot{ETag: snapshot.ETag}, nil
 }
@@ -3,59 +3,88 @@ package activities
 import (
 	"bytes"
 	"context"
-	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"text/template"
+
+	"go.temporal.io/sdk/temporal"
 )
 
-//go:embed connection_template_mqtt5.json
-var connectionTemplateMQTT5 string
+// Application error types of connections that cannot be rendered, retrying does not help
+const (
+	TemplateNotFoundErrorType  = "TemplateNotFound"
+	InvalidConnectionErrorType = "InvalidConnection"
+	MissingSecretErrorType     = "MissingSecret"
+)
 
-var connectionTemplates = map[string]string{
-	"mqtt5": connectionTemplateMQTT5,
-	// "another": connectionTemplateAnother,
+type CreateConnectionParams struct {
+	ConnectionName  string
+	TemplateName    string            // e.g. "mqtt5", "amqp10"
+	TemplateVersion int               // 0 uses the latest version
+	Placeholders    map[string]string // key: placeholder, value: replacement
+	Secrets         map[string]string // key: placeholder, value: secret name resolved when rendering
 }
 
-type CreateConnectionParams struct {
-	ConnectionName string
-	TemplateName   string            // e.g. "mqtt5"
-	Placeholders   map[string]string // key: placeholder, value: replacement
+// renderConnection executes a version of the named connection template with the placeholders
+// and the resolved secret placeholders
+func (c *DittoClient) renderConnection(templateName string, version int, placeholders, secrets map[string]string) (*bytes.Buffer, error) {
+	resolved, err := c.resolveSecrets(placeholders, secrets)
+	if err != nil {
+		return nil, err
+	}
+	return c.templateRegistry().Render(templateName, version, resolved)
 }
 
-func (c *DittoClient) CreateConnection(ctx context.Context, params CreateConnectionParams) (string, error) {
-	tmplStr, ok := connectionTemplates[params.TemplateName]
-	if !ok {
-		return "", fmt.Errorf("unknown template: %s", params.TemplateName)
+// renderError returns render failures retrying cannot fix as top-level non-retryable errors of their type,
+// other errors, e.g. failing to read the template directory, are retried
+func renderError(err error) error {
+	var errType string
+	switch {
+	case errors.Is(err, ErrTemplateNotFound):
+		errType = TemplateNotFoundErrorType
+	case errors.Is(err, ErrSecretNotFound), errors.Is(err, ErrInvalidSecretName), errors.Is(err, ErrNoSecretStore):
+		errType = MissingSecretErrorType
+	case errors.Is(err, ErrInvalidConnection):
+		errType = InvalidConnectionErrorType
+	default:
+		return err
 	}
-	tmpl, err := template.New("connection").Parse(tmplStr)
+	return temporal.NewNonRetryableApplicationError("failed to render connection", errType, err)
+}
+
+// ValidateConnection renders a connection template including its secrets without creating anything
+func (c *DittoClient) ValidateConnection(templateName string, placeholders, secrets map[string]string) error {
+	_, err := c.renderConnection(templateName, 0, placeholders, secrets)
+	return err
+}
+
+func (c *DittoClient) CreateConnection(ctx context.Context, params CreateConnectionParams) (string, error) {
+	buf, err := c.renderConnection(params.TemplateName, params.TemplateVersion, params.Placeholders, params.Secrets)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse template: %w", err)
-	}
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, params.Placeholders); err != nil {
-		return "", fmt.Errorf("failed to execute template: %w", err)
+		return "", renderError(err)
 	}
 
 	// Create Ditto connection via HTTP API
-	url := fmt.Sprintf("http://%s/api/2/connections", c.Host)
-	req, err := http.NewRequest("POST", url, &buf)
+	url := fmt.Sprintf("%s/api/2/connections", c.baseURL())
+	req, err := http.NewRequestWithContext(ctx, "POST", url, buf)
 	if err != nil {
 		return "", fmt.Errorf("failed to create HTTP request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(c.DevopsUsername, c.DevopsPassword)
+	if err := authorize(ctx, req, c.devopsAuthenticator()); err != nil {
+		return "", err
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
 		return "", fmt.Errorf("HTTP request failed: %w", err)
 	}
 	defer resp.Body.Close()
 	body, _ := io.ReadAll(resp.Body)
 	if resp.StatusCode != 201 {
-		return "", fmt.Errorf("ditto API returned status %d: %s", resp.StatusCode, string(body))
+		return "", newDittoError(resp.StatusCode, body)
 	}
 
 	var newConnection struct {
@@ -69,7 +98,11 @@ func (c *DittoClient) CreateConnection(ctx context.Context, params CreateConnect
 
 // Register this activity with your Activities struct:
 func (a *Activities) CreateConnection(ctx context.Context, params CreateConnectionParams) (string, error) {
-	return a.DittoClient.CreateConnection(ctx, params)
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	return client.CreateConnection(ctx, params)
 }
 
 type GetConnectionStatusParams struct {
@@ -81,21 +114,23 @@ type GetConnectionStatusResult struct {
 }
 
 func (c *DittoClient) GetConnectionStatus(ctx context.Context, params GetConnectionStatusParams) (string, error) {
-	url := fmt.Sprintf("http://%s/api/2/connections/%s/status", c.Host, params.ConnectionID)
+	url := fmt.Sprintf("%s/api/2/connections/%s/status", c.baseURL(), params.ConnectionID)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to create HTTP request: %w", err)
 	}
-	req.SetBasicAuth(c.DevopsUsername, c.DevopsPassword)
+	if err := authorize(ctx, req, c.devopsAuthenticator()); err != nil {
+		return "", err
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
 		return "", fmt.Errorf("HTTP request failed: %w", err)
 	}
 	defer resp.Body.Close()
 	body, _ := io.ReadAll(resp.Body)
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("ditto API returned status %d: %s", resp.StatusCode, string(body))
+		return "", newDittoError(resp.StatusCode, body)
 	}
 
 	var result GetConnectionStatusResult
@@ -107,5 +142,241 @@ func (c *DittoClient) GetConnectionStatus(ctx context.Context, params GetConnect
 
 // Register this activity with your Activities struct:
 func (a *Activities) GetConnectionStatus(ctx context.Context, params GetConnectionStatusParams) (string, error) {
-	return a.DittoClient.GetConnectionStatus(ctx, params)
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	return client.GetConnectionStatus(ctx, params)
+}
+
+// ConnectionSummary is the overview of a connection returned by ListConnections
+type ConnectionSummary struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	ConnectionType   string `json:"connectionType,omitempty"`
+	ConnectionStatus string `json:"connectionStatus,omitempty"`
+	URI              string `json:"uri,omitempty"`
+}
+
+// ListConnections returns all connections, credentials in the URI are masked by Ditto
+func (c *DittoClient) ListConnections(ctx context.Context) ([]ConnectionSummary, error) {
+	url := fmt.Sprintf("%s/api/2/connections?fields=id,name,connectionType,connectionStatus,uri", c.baseURL())
+	resp, body, err := c.doDevopsRequest(ctx, "GET", url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, newDittoError(resp.StatusCode, body)
+	}
+
+	var connections []ConnectionSummary
+	if err := json.Unmarshal(body, &connections); err != nil {
+		return nil, fmt.Errorf("failed to parse response JSON: %w", err)
+	}
+	return connections, nil
+}
+
+type FindConnectionParams struct {
+	ConnectionName string
+}
+
+// FindConnection returns the ID of the connection with the given name, or "" if there is none
+func (c *DittoClient) FindConnection(ctx context.Context, params FindConnectionParams) (string, error) {
+	connections, err := c.ListConnections(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, connection := range connections {
+		if connection.Name == params.ConnectionName {
+			return connection.ID, nil
+		}
+	}
+	return "", nil
+}
+
+func (a *Activities) FindConnection(ctx context.Context, params FindConnectionParams) (string, error) {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	return client.FindConnection(ctx, params)
+}
+
+type GetConnectionParams struct {
+	ConnectionID string
+}
+
+// GetConnection returns the full connection definition, e.g. to restore it later
+func (c *DittoClient) GetConnection(ctx context.Context, params GetConnectionParams) (map[string]interface{}, error) {
+	url := fmt.Sprintf("%s/api/2/connections/%s", c.baseURL(), params.ConnectionID)
+	resp, body, err := c.doDevopsRequest(ctx, "GET", url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, newDittoError(resp.StatusCode, body)
+	}
+
+	var connection map[string]interface{}
+	if err := json.Unmarshal(body, &connection); err != nil {
+		return nil, fmt.Errorf("failed to parse response JSON: %w", err)
+	}
+	return connection, nil
+}
+
+func (a *Activities) GetConnection(ctx context.Context, params GetConnectionParams) (map[string]interface{}, error) {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetConnection(ctx, params)
+}
+
+type ModifyConnectionParams struct {
+	ConnectionID    string
+	TemplateName    string            // e.g. "mqtt5", "amqp10"
+	TemplateVersion int               // 0 uses the latest version
+	Placeholders    map[string]string // key: placeholder, value: replacement
+	Secrets         map[string]string // key: placeholder, value: secret name resolved when rendering
+}
+
+// ModifyConnection replaces an existing connection with the rendered template
+func (c *DittoClient) ModifyConnection(ctx context.Context, params ModifyConnectionParams) error {
+	buf, err := c.renderConnection(params.TemplateName, params.TemplateVersion, params.Placeholders, params.Secrets)
+	if err != nil {
+		return renderError(err)
+	}
+	var connection map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &connection); err != nil {
+		return renderError(fmt.Errorf("%w: rendered template is not valid JSON: %w", ErrInvalidConnection, err))
+	}
+	return c.PutConnection(ctx, PutConnectionParams{ConnectionID: params.ConnectionID, Connection: connection})
+}
+
+func (a *Activities) ModifyConnection(ctx context.Context, params ModifyConnectionParams) error {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.ModifyConnection(ctx, params)
+}
+
+type PutConnectionParams struct {
+	ConnectionID string
+	Connection   map[string]interface{} // full connection definition, e.g. from GetConnection
+}
+
+// PutConnection creates or replaces the connection with the given ID
+func (c *DittoClient) PutConnection(ctx context.Context, params PutConnectionParams) error {
+	connection := make(map[string]interface{}, len(params.Connection)+1)
+	for key, value := range params.Connection {
+		connection[key] = value
+	}
+	connection["id"] = params.ConnectionID
+	bodyBytes, err := json.Marshal(connection)
+	if err != nil {
+		return fmt.Errorf("failed to marshal connection: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/api/2/connections/%s", c.baseURL(), params.ConnectionID)
+	resp, body, err := c.doDevopsRequest(ctx, "PUT", url, bodyBytes, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return newDittoError(resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (a *Activities) PutConnection(ctx context.Context, params PutConnectionParams) error {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.PutConnection(ctx, params)
+}
+
+const (
+	OpenConnectionCommand  = "connectivity.commands:openConnection"
+	CloseConnectionCommand = "connectivity.commands:closeConnection"
+)
+
+type ConnectionCommandParams struct {
+	ConnectionID string
+	Command      string // OpenConnectionCommand or CloseConnectionCommand
+}
+
+// SendConnectionCommand opens or closes a connection
+func (c *DittoClient) SendConnectionCommand(ctx context.Context, params ConnectionCommandParams) error {
+	url := fmt.Sprintf("%s/api/2/connections/%s/command", c.baseURL(), params.ConnectionID)
+	headers := http.Header{"Content-Type": {"text/plain"}}
+	resp, body, err := c.doDevopsRequest(ctx, "POST", url, []byte(params.Command), headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return newDittoError(resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (a *Activities) SendConnectionCommand(ctx context.Context, params ConnectionCommandParams) error {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.SendConnectionCommand(ctx, params)
+}
+
+type DeleteConnectionParams struct {
+	ConnectionID string
+}
+
+// DeleteConnection removes a connection, a missing connection counts as deleted
+func (c *DittoClient) DeleteConnection(ctx context.Context, params DeleteConnectionParams) error {
+	url := fmt.Sprintf("%s/api/2/connections/%s", c.baseURL(), params.ConnectionID)
+	resp, body, err := c.doDevopsRequest(ctx, "DELETE", url, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 || resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return newDittoError(resp.StatusCode, body)
+}
+
+func (a *Activities) DeleteConnection(ctx context.Context, params DeleteConnectionParams) error {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.DeleteConnection(ctx, params)
+}
+
+type GetConnectionTemplateParams struct {
+	TemplateName string
+}
+
+// GetConnectionTemplateVersion returns the latest version of a connection template,
+// so a workflow can pin the version it renders and record it
+func (c *DittoClient) GetConnectionTemplateVersion(ctx context.Context, params GetConnectionTemplateParams) (int, error) {
+	tmpl, err := c.templateRegistry().Get(params.TemplateName, 0)
+	if err != nil {
+		return 0, renderError(err)
+	}
+	return tmpl.Version, nil
+}
+
+func (a *Activities) GetConnectionTemplateVersion(ctx context.Context, params GetConnectionTemplateParams) (int, error) {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return client.GetConnectionTemplateVersion(ctx, params)
 }
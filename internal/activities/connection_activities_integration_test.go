@@ -2,7 +2,6 @@ package activities
 
 import (
 	"context"
-	"dm-backend/internal/config"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -79,12 +78,7 @@ func TestCreateConnection_Integration(t *testing.T) {
 		t.Skip("set DITTO_INTEGRATION=1 to run integration tests")
 	}
 
-	var (
-		appConfig = config.LoadConfig()
-		dittoHost = appConfig.DittoHost
-		username  = appConfig.DittoDevopsUsername
-		password  = appConfig.DittoDevopsPassword
-	)
+	username, password := dittoTarget.DevopsUsername, dittoTarget.DevopsPassword
 
 	// Clean up before and after test
 	cleanupDittoConnection(t, dittoHost, username, password, testConnectionName)
@@ -101,8 +95,8 @@ func TestCreateConnection_Integration(t *testing.T) {
 		TemplateName:   testTemplateName,
 		Placeholders: map[string]string{
 			"ConnectionName": testConnectionName,
-			"MQTTHost":       testMQTTHost,
-			"MQTTPort":       testMQTTPort,
+			"Host":           testMQTTHost,
+			"Port":           testMQTTPort,
 		},
 	}
 
@@ -134,12 +128,7 @@ func TestGetConnectionStatus_Integration(t *testing.T) {
 		t.Skip("set DITTO_INTEGRATION=1 to run integration tests")
 	}
 
-	var (
-		appConfig = config.LoadConfig()
-		dittoHost = appConfig.DittoHost
-		username  = appConfig.DittoDevopsUsername
-		password  = appConfig.DittoDevopsPassword
-	)
+	username, password := dittoTarget.DevopsUsername, dittoTarget.DevopsPassword
 
 	// Ensure the connection exists
 	client := &DittoClient{
@@ -153,8 +142,8 @@ func TestGetConnectionStatus_Integration(t *testing.T) {
 		TemplateName:   testTemplateName,
 		Placeholders: map[string]string{
 			"ConnectionName": testConnectionName,
-			"MQTTHost":       testMQTTHost,
-			"MQTTPort":       testMQTTPort,
+			"Host":           testMQTTHost,
+			"Port":           testMQTTPort,
 		},
 	}
 
@@ -0,0 +1,67 @@
+package activities
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+type SnapshotConnectionParams struct {
+	SnapshotID   string
+	ConnectionID string
+}
+
+// ConnectionSnapshot describes a connection kept in the snapshot store, its definition and credentials stay in the store
+type ConnectionSnapshot struct {
+	ConnectionStatus string // Desired status of the connection, "open" or "closed"
+}
+
+// SnapshotConnection keeps the full connection definition in the snapshot store, so it can be restored with
+// RestoreConnection without its broker credentials passing through the workflow history
+func (a *Activities) SnapshotConnection(ctx context.Context, params SnapshotConnectionParams) (ConnectionSnapshot, error) {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return ConnectionSnapshot{}, err
+	}
+	connection, err := client.GetConnection(ctx, GetConnectionParams{ConnectionID: params.ConnectionID})
+	if err != nil {
+		return ConnectionSnapshot{}, err
+	}
+	content, err := json.Marshal(connection)
+	if err != nil {
+		return ConnectionSnapshot{}, fmt.Errorf("failed to marshal connection: %w", err)
+	}
+	if err := a.snapshotStore().Put(params.SnapshotID, params.ConnectionID, content); err != nil {
+		return ConnectionSnapshot{}, err
+	}
+	status, _ := connection["connectionStatus"].(string)
+	return ConnectionSnapshot{ConnectionStatus: status}, nil
+}
+
+type RestoreConnectionParams struct {
+	SnapshotID   string
+	ConnectionID string
+}
+
+// RestoreConnection creates or replaces a connection with the definition taken by SnapshotConnection
+func (a *Activities) RestoreConnection(ctx context.Context, params RestoreConnectionParams) error {
+	content, err := a.snapshotStore().Get(params.SnapshotID, params.ConnectionID)
+	if errors.Is(err, ErrSnapshotNotFound) {
+		return temporal.NewNonRetryableApplicationError(err.Error(), "SnapshotNotFound", err)
+	}
+	if err != nil {
+		return err
+	}
+	var connection map[string]interface{}
+	if err := json.Unmarshal(content, &connection); err != nil {
+		return fmt.Errorf("failed to parse snapshot of connection %s: %w", params.ConnectionID, err)
+	}
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.PutConnection(ctx, PutConnectionParams{ConnectionID: params.ConnectionID, Connection: connection})
+}
@@ -0,0 +1,237 @@
+package activities
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// PlaceholderSpec declares a placeholder a connection template uses
+type PlaceholderSpec struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+	Default     string `json:"default,omitempty"` // used when no or an empty value is given
+	Pattern     string `json:"pattern,omitempty"` // regular expression non-empty values must match
+}
+
+var (
+	placeholderNameRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+	portPattern          = `^[0-9]{1,5}$`
+)
+
+// commonPlaceholders are declared by all built-in templates
+var commonPlaceholders = []PlaceholderSpec{
+	{Name: "ConnectionName", Required: true, Description: "name of the Ditto connection"},
+	{Name: "ThingID", Description: "gateway thing of the site"},
+	{Name: "Host", Required: true, Description: "broker or endpoint host"},
+	{Name: "Port", Required: true, Pattern: portPattern},
+	{Name: "Username"},
+	{Name: "Password"},
+}
+
+// builtinPlaceholders declares the placeholders of the built-in templates in addition to commonPlaceholders
+var builtinPlaceholders = map[string][]PlaceholderSpec{
+	"mqtt5": {
+		{Name: "Scheme", Default: "tcp", Pattern: `^(tcp|ssl)$`},
+		{Name: "SourceAddress", Default: "eclipse-ditto-sandbox/#", Description: "MQTT topic filter to subscribe to"},
+		{Name: "TargetAddress", Default: "eclipse-ditto-sandbox/test", Description: "MQTT topic to publish to"},
+	},
+	"mqtt3": {
+		{Name: "Scheme", Default: "tcp", Pattern: `^(tcp|ssl)$`},
+		{Name: "SourceAddress", Default: "eclipse-ditto-sandbox/#", Description: "MQTT topic filter to subscribe to"},
+		{Name: "TargetAddress", Default: "eclipse-ditto-sandbox/test", Description: "MQTT topic to publish to"},
+	},
+	"amqp10": {
+		{Name: "Scheme", Default: "amqp", Pattern: `^amqps?$`},
+		{Name: "SourceAddress", Required: true, Description: "AMQP address to consume from"},
+		{Name: "TargetAddress", Required: true, Description: "AMQP address to publish to"},
+	},
+	"kafka": {
+		{Name: "Scheme", Default: "tcp", Pattern: `^(tcp|ssl)$`},
+		{Name: "SourceAddress", Description: "Kafka topic to consume from, none if empty"},
+		{Name: "TargetAddress", Required: true, Description: "Kafka topic to publish to"},
+	},
+	"http-push": {
+		{Name: "Scheme", Default: "http", Pattern: `^https?$`},
+		{Name: "TargetAddress", Required: true, Pattern: `^(GET|POST|PUT|PATCH|DELETE):/`, Description: "<METHOD>:/<path> to push to"},
+	},
+}
+
+// templateFuncs are available in connection templates, jsonEscape is applied to every action automatically
+var templateFuncs = template.FuncMap{
+	"jsonEscape": jsonEscape,
+	"userinfo":   userinfo,
+}
+
+// jsonEscape escapes a value for use inside a JSON string
+func jsonEscape(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(fmt.Sprint(v))
+	quoted := strings.TrimSuffix(buf.String(), "\n")
+	return quoted[1 : len(quoted)-1]
+}
+
+// userinfo returns the URL-escaped "username:password@" part of a URI, or "" without username
+func userinfo(username, password string) string {
+	if username == "" {
+		return ""
+	}
+	if password == "" {
+		return url.User(username).String() + "@"
+	}
+	return url.UserPassword(username, password).String() + "@"
+}
+
+// parseConnectionTemplate parses a template that fails on undeclared placeholders and JSON-escapes every output
+func parseConnectionTemplate(tmplStr string) (*template.Template, error) {
+	tmpl, err := template.New("connection").Funcs(templateFuncs).Option("missingkey=error").Parse(tmplStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			addJSONEscaping(t.Tree.Root)
+		}
+	}
+	return tmpl, nil
+}
+
+// addJSONEscaping appends jsonEscape to the pipeline of every action that prints a value,
+// the same way html/template adds its escapers
+func addJSONEscaping(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			addJSONEscaping(child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			return
+		}
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Args:     []parse.Node{parse.NewIdentifier("jsonEscape").SetTree(nil).SetPos(n.Pos)},
+		})
+	case *parse.IfNode:
+		addJSONEscaping(n.List)
+		addJSONEscaping(n.ElseList)
+	case *parse.RangeNode:
+		addJSONEscaping(n.List)
+		addJSONEscaping(n.ElseList)
+	case *parse.WithNode:
+		addJSONEscaping(n.List)
+		addJSONEscaping(n.ElseList)
+	}
+}
+
+// resolvePlaceholders returns the values of the declared placeholders, applying defaults and
+// checking required placeholders and patterns. Undeclared values are ignored.
+func resolvePlaceholders(specs []PlaceholderSpec, values map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(specs))
+	var problems []string
+	for _, spec := range specs {
+		value := values[spec.Name]
+		if value == "" {
+			value = spec.Default
+		}
+		if value == "" && spec.Required {
+			problems = append(problems, fmt.Sprintf("%s is required", spec.Name))
+		}
+		if value != "" && spec.Pattern != "" {
+			if matched, _ := regexp.MatchString(spec.Pattern, value); !matched {
+				problems = append(problems, fmt.Sprintf("%s must match %s", spec.Name, spec.Pattern))
+			}
+		}
+		resolved[spec.Name] = value
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid placeholders: %s", strings.Join(problems, "; "))
+	}
+	return resolved, nil
+}
+
+// validatePlaceholderSpecs checks names, patterns and that required placeholders have no default
+func validatePlaceholderSpecs(specs []PlaceholderSpec) error {
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		if !placeholderNameRegex.MatchString(spec.Name) {
+			return fmt.Errorf("invalid placeholder name %q", spec.Name)
+		}
+		if seen[spec.Name] {
+			return fmt.Errorf("placeholder %s is declared twice", spec.Name)
+		}
+		seen[spec.Name] = true
+		if spec.Pattern != "" {
+			if _, err := regexp.Compile(spec.Pattern); err != nil {
+				return fmt.Errorf("invalid pattern of placeholder %s: %w", spec.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// renderConnectionTemplate renders a template with the resolved placeholders and checks
+// that the result is a JSON connection definition
+func renderConnectionTemplate(tmplStr string, specs []PlaceholderSpec, values map[string]string) (*bytes.Buffer, error) {
+	placeholders, err := resolvePlaceholders(specs, values)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := parseConnectionTemplate(tmplStr)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, placeholders); err != nil {
+		return nil, fmt.Errorf("failed to execute template: %w", err)
+	}
+
+	var connection map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &connection); err != nil {
+		return nil, fmt.Errorf("rendered template is not a JSON object: %w", err)
+	}
+	var missing []string
+	for _, field := range []string{"name", "connectionType", "uri"} {
+		if value, _ := connection[field].(string); value == "" {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("rendered template is missing %s", strings.Join(missing, ", "))
+	}
+	return &buf, nil
+}
+
+// samplePlaceholders returns a value for every declared placeholder to validate a template,
+// the values contain characters that need escaping in JSON
+func samplePlaceholders(specs []PlaceholderSpec) map[string]string {
+	samples := map[string]string{
+		"Port":          "1883",
+		"TargetAddress": "POST:/sample/target",
+	}
+	values := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		switch {
+		case spec.Default != "":
+			values[spec.Name] = spec.Default
+		case samples[spec.Name] != "":
+			values[spec.Name] = samples[spec.Name]
+		case spec.Pattern == "":
+			values[spec.Name] = `sample "` + spec.Name + `" \ value`
+		default:
+			values[spec.Name] = "sample-" + strings.ToLower(spec.Name)
+		}
+	}
+	return values
+}
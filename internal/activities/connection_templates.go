@@ -0,0 +1,355 @@
+package activities
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//go:embed connection_template_mqtt5.json
+var connectionTemplateMQTT5 string
+
+//go:embed connection_template_mqtt3.json
+var connectionTemplateMQTT3 string
+
+//go:embed connection_template_amqp10.json
+var connectionTemplateAMQP10 string
+
+//go:embed connection_template_kafka.json
+var connectionTemplateKafka string
+
+//go:embed connection_template_http_push.json
+var connectionTemplateHTTPPush string
+
+// builtinConnectionTemplates are keyed by the site protocol, see models.SiteProtocols.
+// They are version 1 of their template unless the template directory provides that version.
+var builtinConnectionTemplates = map[string]string{
+	"mqtt5":     connectionTemplateMQTT5,
+	"mqtt3":     connectionTemplateMQTT3,
+	"amqp10":    connectionTemplateAMQP10,
+	"kafka":     connectionTemplateKafka,
+	"http-push": connectionTemplateHTTPPush,
+}
+
+var (
+	ErrTemplateNotFound  = errors.New("connection template not found")
+	ErrTemplateExists    = errors.New("connection template already exists")
+	ErrBuiltinTemplate   = errors.New("built-in connection templates cannot be deleted")
+	ErrTemplateInUse     = errors.New("connection template is used by sites")
+	ErrInvalidConnection = errors.New("invalid connection")
+)
+
+var (
+	templateNameRegex    = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	templateVersionRegex = regexp.MustCompile(`^v([1-9][0-9]*)\.json$`)
+)
+
+// ConnectionTemplate is one version of a Ditto connection definition written as Go text/template
+type ConnectionTemplate struct {
+	Name         string            `json:"name"`
+	Version      int               `json:"version"`
+	Template     string            `json:"template"`
+	Placeholders []PlaceholderSpec `json:"placeholders"` // every placeholder the template uses must be declared
+	Builtin      bool              `json:"builtin,omitempty"`
+	UpdatedAt    time.Time         `json:"updatedAt,omitempty"`
+}
+
+// TemplateRegistry keeps all versions of the connection templates. Templates added at runtime
+// are stored as JSON ConnectionTemplate documents <dir>/<name>/v<version>.json and loaded again on startup.
+// Processes sharing the directory see each other's templates: a template or version that is not
+// in memory is reloaded from the directory before it is reported as not found.
+type TemplateRegistry struct {
+	dir string // "" keeps added templates in memory only
+
+	mu        sync.RWMutex
+	templates map[string][]ConnectionTemplate // versions in ascending order
+}
+
+// NewTemplateRegistry loads the built-in templates and all templates found in dir
+func NewTemplateRegistry(dir string) (*TemplateRegistry, error) {
+	r := &TemplateRegistry{dir: dir, templates: map[string][]ConnectionTemplate{}}
+	for name, tmpl := range builtinConnectionTemplates {
+		placeholders := append(append([]PlaceholderSpec{}, commonPlaceholders...), builtinPlaceholders[name]...)
+		r.templates[name] = []ConnectionTemplate{{Name: name, Version: 1, Template: tmpl, Placeholders: placeholders, Builtin: true}}
+	}
+	if dir == "" {
+		return r, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !templateNameRegex.MatchString(entry.Name()) {
+			continue
+		}
+		if err := r.loadVersions(entry.Name()); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// loadVersions reads all version files of a template, replacing built-in versions with the same number
+func (r *TemplateRegistry) loadVersions(name string) error {
+	files, err := os.ReadDir(filepath.Join(r.dir, name))
+	if err != nil {
+		return fmt.Errorf("failed to read template %s: %w", name, err)
+	}
+	versions := map[int]ConnectionTemplate{}
+	for _, existing := range r.templates[name] {
+		versions[existing.Version] = existing
+	}
+	for _, file := range files {
+		match := templateVersionRegex.FindStringSubmatch(file.Name())
+		if match == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		path := filepath.Join(r.dir, name, file.Name())
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read template %s: %w", path, err)
+		}
+		var tmpl ConnectionTemplate
+		if err := json.Unmarshal(content, &tmpl); err != nil {
+			return fmt.Errorf("failed to parse template %s: %w", path, err)
+		}
+		if err := ValidateConnectionTemplate(tmpl.Template, tmpl.Placeholders); err != nil {
+			return fmt.Errorf("invalid template %s: %w", path, err)
+		}
+		tmpl.Name, tmpl.Version = name, version
+		_, tmpl.Builtin = builtinConnectionTemplates[name]
+		versions[version] = tmpl
+	}
+
+	list := make([]ConnectionTemplate, 0, len(versions))
+	for _, tmpl := range versions {
+		list = append(list, tmpl)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	r.templates[name] = list
+	return nil
+}
+
+// List returns the latest version of every template, sorted by name.
+// Templates other processes added to the directory are loaded first.
+func (r *TemplateRegistry) List() []ConnectionTemplate {
+	if r.dir != "" {
+		if entries, err := os.ReadDir(r.dir); err == nil {
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					continue
+				}
+				if err := r.reload(entry.Name()); err != nil {
+					log.Printf("Failed to reload connection template %s: %v", entry.Name(), err)
+				}
+			}
+		}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]ConnectionTemplate, 0, len(r.templates))
+	for _, versions := range r.templates {
+		list = append(list, versions[len(versions)-1])
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Versions returns all versions of a template in ascending order
+func (r *TemplateRegistry) Versions(name string) ([]ConnectionTemplate, error) {
+	r.mu.RLock()
+	versions, ok := r.templates[name]
+	r.mu.RUnlock()
+	if !ok {
+		if err := r.reload(name); err != nil {
+			return nil, err
+		}
+		r.mu.RLock()
+		versions, ok = r.templates[name]
+		r.mu.RUnlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+	return append([]ConnectionTemplate{}, versions...), nil
+}
+
+// Get returns a version of a template, version 0 returns the latest one
+func (r *TemplateRegistry) Get(name string, version int) (ConnectionTemplate, error) {
+	tmpl, err := r.get(name, version)
+	if errors.Is(err, ErrTemplateNotFound) {
+		if err := r.reload(name); err != nil {
+			return ConnectionTemplate{}, err
+		}
+		return r.get(name, version)
+	}
+	return tmpl, err
+}
+
+// reload reads the versions of a template from the directory again, e.g. after another process added them
+func (r *TemplateRegistry) reload(name string) error {
+	if r.dir == "" || !templateNameRegex.MatchString(name) {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reloadLocked(name)
+}
+
+func (r *TemplateRegistry) reloadLocked(name string) error {
+	if _, err := os.Stat(filepath.Join(r.dir, name)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return r.loadVersions(name)
+}
+
+func (r *TemplateRegistry) get(name string, version int) (ConnectionTemplate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	versions, ok := r.templates[name]
+	if !ok {
+		return ConnectionTemplate{}, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+	if version == 0 {
+		return versions[len(versions)-1], nil
+	}
+	for _, tmpl := range versions {
+		if tmpl.Version == version {
+			return tmpl, nil
+		}
+	}
+	return ConnectionTemplate{}, fmt.Errorf("%w: %s version %d", ErrTemplateNotFound, name, version)
+}
+
+// Create adds a new template as version 1
+func (r *TemplateRegistry) Create(name, tmpl string, placeholders []PlaceholderSpec) (ConnectionTemplate, error) {
+	return r.save(name, tmpl, placeholders, true)
+}
+
+// Update adds a new version of an existing template, previous versions stay available
+func (r *TemplateRegistry) Update(name, tmpl string, placeholders []PlaceholderSpec) (ConnectionTemplate, error) {
+	return r.save(name, tmpl, placeholders, false)
+}
+
+func (r *TemplateRegistry) save(name, tmpl string, placeholders []PlaceholderSpec, create bool) (ConnectionTemplate, error) {
+	if !templateNameRegex.MatchString(name) {
+		return ConnectionTemplate{}, fmt.Errorf("invalid template name %q: use lowercase letters, digits, '-' and '_'", name)
+	}
+	if err := ValidateConnectionTemplate(tmpl, placeholders); err != nil {
+		return ConnectionTemplate{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dir != "" {
+		if err := r.reloadLocked(name); err != nil {
+			return ConnectionTemplate{}, err
+		}
+	}
+	versions, exists := r.templates[name]
+	if create && exists {
+		return ConnectionTemplate{}, fmt.Errorf("%w: %s", ErrTemplateExists, name)
+	}
+	if !create && !exists {
+		return ConnectionTemplate{}, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+	saved := ConnectionTemplate{Name: name, Version: 1, Template: tmpl, Placeholders: placeholders, UpdatedAt: time.Now().UTC()}
+	if exists {
+		saved.Version = versions[len(versions)-1].Version + 1
+		saved.Builtin = versions[0].Builtin
+	}
+
+	if r.dir != "" {
+		dir := filepath.Join(r.dir, name)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return ConnectionTemplate{}, fmt.Errorf("failed to create template directory: %w", err)
+		}
+		content, err := json.MarshalIndent(saved, "", "  ")
+		if err != nil {
+			return ConnectionTemplate{}, fmt.Errorf("failed to marshal template: %w", err)
+		}
+		// Never overwrite a version another process saved in the meantime
+		path := filepath.Join(dir, fmt.Sprintf("v%d.json", saved.Version))
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			return ConnectionTemplate{}, fmt.Errorf("%w: %s version %d was saved concurrently, retry", ErrTemplateExists, name, saved.Version)
+		}
+		if err != nil {
+			return ConnectionTemplate{}, fmt.Errorf("failed to write template: %w", err)
+		}
+		_, err = file.Write(content)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+			return ConnectionTemplate{}, fmt.Errorf("failed to write template: %w", err)
+		}
+	}
+	r.templates[name] = append(versions, saved)
+	return saved, nil
+}
+
+// Delete removes all versions of a user-managed template
+func (r *TemplateRegistry) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions, ok := r.templates[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+	if versions[0].Builtin {
+		return fmt.Errorf("%w: %s", ErrBuiltinTemplate, name)
+	}
+	if r.dir != "" {
+		if err := os.RemoveAll(filepath.Join(r.dir, name)); err != nil {
+			return fmt.Errorf("failed to delete template: %w", err)
+		}
+	}
+	delete(r.templates, name)
+	return nil
+}
+
+// Render executes a version of a template with the placeholders, version 0 uses the latest one.
+// Values are JSON-escaped and checked against the template's placeholder declarations.
+func (r *TemplateRegistry) Render(name string, version int, placeholders map[string]string) (*bytes.Buffer, error) {
+	tmpl, err := r.Get(name, version)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := renderConnectionTemplate(tmpl.Template, tmpl.Placeholders, placeholders)
+	if err != nil {
+		return nil, fmt.Errorf("%w: template %s version %d: %w", ErrInvalidConnection, name, tmpl.Version, err)
+	}
+	return buf, nil
+}
+
+// ValidateConnectionTemplate checks the placeholder declarations and renders the template against
+// sample values. Placeholders used by the template but not declared fail the rendering.
+func ValidateConnectionTemplate(tmpl string, placeholders []PlaceholderSpec) error {
+	if err := validatePlaceholderSpecs(placeholders); err != nil {
+		return err
+	}
+	relaxed := make([]PlaceholderSpec, len(placeholders))
+	for i, spec := range placeholders {
+		relaxed[i] = PlaceholderSpec{Name: spec.Name, Default: spec.Default}
+	}
+	_, err := renderConnectionTemplate(tmpl, relaxed, samplePlaceholders(placeholders))
+	return err
+}
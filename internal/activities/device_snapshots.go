@@ -0,0 +1,131 @@
+package activities
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+// storedDeviceSnapshot is the snapshot store entry of a device, see SnapshotDevice
+type storedDeviceSnapshot struct {
+	Restore map[string]interface{} `json:"restore"`
+	Patched bool                   `json:"patched,omitempty"` // The patch was acknowledged
+	ETag    string                 `json:"etag,omitempty"`    // ETag the patch left, restores are conditioned on it
+}
+
+func (a *Activities) deviceSnapshot(snapshotID, thingID string) (storedDeviceSnapshot, error) {
+	var snapshot storedDeviceSnapshot
+	content, err := a.snapshotStore().Get(snapshotID, thingID)
+	if err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("failed to parse snapshot of %s: %w", thingID, err)
+	}
+	return snapshot, nil
+}
+
+func (a *Activities) putDeviceSnapshot(snapshotID, thingID string, snapshot storedDeviceSnapshot) error {
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot of %s: %w", thingID, err)
+	}
+	return a.snapshotStore().Put(snapshotID, thingID, content)
+}
+
+type ListPatchedDevicesParams struct {
+	SnapshotID string
+	Cursor     string // Thing ID the previous page ended with, empty for the first page
+	PageSize   int    // Defaults to 200
+}
+
+// PatchedDevicePage lists devices whose patch was acknowledged and not restored yet
+type PatchedDevicePage struct {
+	ThingIds []string
+	Cursor   string // Empty on the last page
+}
+
+// ListPatchedDevices pages through the devices of a snapshot whose patch was acknowledged
+func (a *Activities) ListPatchedDevices(_ context.Context, params ListPatchedDevicesParams) (PatchedDevicePage, error) {
+	pageSize := params.PageSize
+	if pageSize <= 0 {
+		pageSize = 200
+	}
+	var page PatchedDevicePage
+	after := params.Cursor
+	for len(page.ThingIds) < pageSize {
+		keys, err := a.snapshotStore().Keys(params.SnapshotID, after, pageSize)
+		if err != nil {
+			return PatchedDevicePage{}, err
+		}
+		if len(keys) == 0 {
+			return page, nil
+		}
+		for _, thingID := range keys {
+			after = thingID
+			snapshot, err := a.deviceSnapshot(params.SnapshotID, thingID)
+			if errors.Is(err, ErrSnapshotNotFound) {
+				continue
+			}
+			if err != nil {
+				return PatchedDevicePage{}, err
+			}
+			if snapshot.Patched {
+				page.ThingIds = append(page.ThingIds, thingID)
+				if len(page.ThingIds) == pageSize {
+					break
+				}
+			}
+		}
+	}
+	page.Cursor = after
+	return page, nil
+}
+
+type RestoreDeviceParams struct {
+	SnapshotID    string
+	ThingId       string
+	Path          string // Thing resource that was patched, defaults to /attributes
+	CorrelationID string // Optional, passed to Ditto for tracing
+}
+
+// RestoreDevice applies the restore patch of a device snapshot, conditioned on the ETag the patch left
+// so changes made since are not overwritten. Restored devices are removed from the snapshot.
+func (a *Activities) RestoreDevice(ctx context.Context, params RestoreDeviceParams) error {
+	snapshot, err := a.deviceSnapshot(params.SnapshotID, params.ThingId)
+	if errors.Is(err, ErrSnapshotNotFound) {
+		return nil // restored by a previous attempt
+	}
+	if err != nil {
+		return err
+	}
+	if !snapshot.Patched {
+		return temporal.NewNonRetryableApplicationError(fmt.Sprintf("patch of %s was not acknowledged", params.ThingId), "DeviceNotPatched", nil)
+	}
+	if snapshot.ETag == "" {
+		return temporal.NewNonRetryableApplicationError("Ditto returned no ETag to condition the restore on", "RestoreNotConditioned", nil)
+	}
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = client.ConfigureDevice(ctx, ConfigureDeviceParams{
+		ThingId:       params.ThingId,
+		Path:          params.Path,
+		Patch:         snapshot.Restore,
+		IfMatch:       snapshot.ETag,
+		CorrelationID: params.CorrelationID,
+	})
+	if err != nil {
+		return err
+	}
+	return a.snapshotStore().Delete(params.SnapshotID, params.ThingId)
+}
+
+// DeleteSnapshot removes all entries of a snapshot once they are no longer needed for compensation
+func (a *Activities) DeleteSnapshot(_ context.Context, snapshotID string) error {
+	return a.snapshotStore().DeleteAll(snapshotID)
+}
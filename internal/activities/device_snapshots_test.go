@@ -0,0 +1,76 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+func TestDeviceSnapshots_PatchAndRestore(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("If-Match")+" "+string(body))
+		switch {
+		case r.Method == "GET":
+			w.Header().Set("ETag", `"rev:1"`)
+			w.Write([]byte(`{"mode":"slow"}`))
+		case strings.Contains(r.URL.Path, "device-2"):
+			w.WriteHeader(http.StatusPreconditionFailed)
+			w.Write([]byte(`{"status":412,"error":"things:precondition.failed","message":"changed"}`))
+		default:
+			w.Header().Set("ETag", `"rev:2"`)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+	clients, _ := NewDittoClients("default", map[string]*DittoClient{"default": {Host: strings.TrimPrefix(srv.URL, "http://")}})
+	a := &Activities{DittoClients: clients, Snapshots: NewMemorySnapshotStore()}
+	ctx := context.Background()
+	patch := map[string]interface{}{"mode": "fast"}
+
+	for _, thingID := range []string{"org.example:device-1", "org.example:device-2"} {
+		snapshot, err := a.SnapshotDevice(ctx, SnapshotDeviceParams{ThingId: thingID, Patch: patch, SnapshotID: "s1"})
+		if err != nil {
+			t.Fatalf("SnapshotDevice failed: %v", err)
+		}
+		if snapshot.Restore != nil || snapshot.ETag != `"rev:1"` {
+			t.Errorf("expected only the ETag to be returned, got %+v", snapshot)
+		}
+		a.ConfigureDevice(ctx, ConfigureDeviceParams{ThingId: thingID, Patch: patch, IfMatch: snapshot.ETag, SnapshotID: "s1"})
+	}
+
+	page, err := a.ListPatchedDevices(ctx, ListPatchedDevicesParams{SnapshotID: "s1"})
+	if err != nil || !reflect.DeepEqual(page.ThingIds, []string{"org.example:device-1"}) || page.Cursor != "" {
+		t.Fatalf("expected only the acknowledged device, got %+v (%v)", page, err)
+	}
+
+	requests = nil
+	if err := a.RestoreDevice(ctx, RestoreDeviceParams{SnapshotID: "s1", ThingId: "org.example:device-1"}); err != nil {
+		t.Fatalf("RestoreDevice failed: %v", err)
+	}
+	expected := []string{`PATCH /api/2/things/org.example:device-1/attributes "rev:2" {"mode":"slow"}`}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("expected the restore conditioned on the post-patch ETag, got %v", requests)
+	}
+	if page, _ := a.ListPatchedDevices(ctx, ListPatchedDevicesParams{SnapshotID: "s1"}); len(page.ThingIds) != 0 {
+		t.Errorf("expected the restored device to be removed, got %v", page.ThingIds)
+	}
+
+	var appErr *temporal.ApplicationError
+	err = a.RestoreDevice(ctx, RestoreDeviceParams{SnapshotID: "s1", ThingId: "org.example:device-2"})
+	if !errors.As(err, &appErr) || !appErr.NonRetryable() {
+		t.Errorf("expected a non-retryable error restoring a failed patch, got %v", err)
+	}
+}
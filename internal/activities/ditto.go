@@ -9,14 +9,33 @@ import (
 )
 
 func (c *DittoClient) doDittoRequest(ctx context.Context, method, url string, body []byte) (*http.Response, []byte, error) {
+	return c.doDittoRequestWithHeaders(ctx, method, url, body, nil)
+}
+
+// doDittoRequestWithHeaders sends a JSON request, headers override the defaults (e.g. Content-Type)
+func (c *DittoClient) doDittoRequestWithHeaders(ctx context.Context, method, url string, body []byte, headers http.Header) (*http.Response, []byte, error) {
+	return c.doRequest(ctx, method, url, body, headers, c.authenticator())
+}
+
+// doDevopsRequest sends a request with the devops credentials required by the connections API
+func (c *DittoClient) doDevopsRequest(ctx context.Context, method, url string, body []byte, headers http.Header) (*http.Response, []byte, error) {
+	return c.doRequest(ctx, method, url, body, headers, c.devopsAuthenticator())
+}
+
+func (c *DittoClient) doRequest(ctx context.Context, method, url string, body []byte, headers http.Header, auth Authenticator) (*http.Response, []byte, error) {
 	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create %s request: %w", method, err)
 	}
-	req.SetBasicAuth(c.Username, c.Password)
+	if err := authorize(ctx, req, auth); err != nil {
+		return nil, nil, err
+	}
 	req.Header.Set("Content-Type", "application/json")
+	for key, values := range headers {
+		req.Header[key] = values
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
 		return nil, nil, fmt.Errorf("HTTP request failed: %w", err)
 	}
@@ -0,0 +1,146 @@
+package activities
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenRefreshMargin is how long before its expiry a cached token is replaced
+const tokenRefreshMargin = 30 * time.Second
+
+// Authenticator provides the Authorization header of requests to Ditto, for HTTP and WebSocket alike
+type Authenticator interface {
+	Authorization(ctx context.Context) (string, error)
+}
+
+// BasicAuth authenticates with username and password
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+func (a BasicAuth) Authorization(_ context.Context) (string, error) {
+	return "Basic " + basicAuth(a.Username, a.Password), nil
+}
+
+// BearerToken authenticates with a pre-issued token, e.g. a JWT of the OpenID Connect provider
+type BearerToken struct {
+	Token string
+}
+
+func (a BearerToken) Authorization(_ context.Context) (string, error) {
+	return "Bearer " + a.Token, nil
+}
+
+// ClientCredentials authenticates with access tokens of the OAuth2 client credentials flow.
+// The token is cached and fetched again shortly before it expires.
+type ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	HTTPClient   *http.Client // Optional, defaults to http.DefaultClient
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time // zero if the token does not expire
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func (a *ClientCredentials) Authorization(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token == "" || (!a.expiry.IsZero() && time.Now().After(a.expiry.Add(-tokenRefreshMargin))) {
+		if err := a.fetchToken(ctx); err != nil {
+			return "", err
+		}
+	}
+	return "Bearer " + a.token, nil
+}
+
+// fetchToken requests a new access token from the token endpoint
+func (a *ClientCredentials) fetchToken(ctx context.Context) error {
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {a.ClientID},
+		"client_secret": {a.ClientSecret},
+	}
+	if len(a.Scopes) > 0 {
+		form.Set("scope", strings.Join(a.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	httpClient := a.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return fmt.Errorf("failed to parse token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return fmt.Errorf("token response contains no access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return fmt.Errorf("unsupported token type %q", token.TokenType)
+	}
+	a.token = token.AccessToken
+	a.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		a.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return nil
+}
+
+// authenticator returns the authenticator of the things, policies and search APIs
+func (c *DittoClient) authenticator() Authenticator {
+	if c.Auth != nil {
+		return c.Auth
+	}
+	return BasicAuth{Username: c.Username, Password: c.Password}
+}
+
+// devopsAuthenticator returns the authenticator of the connections API
+func (c *DittoClient) devopsAuthenticator() Authenticator {
+	if c.DevopsAuth != nil {
+		return c.DevopsAuth
+	}
+	return BasicAuth{Username: c.DevopsUsername, Password: c.DevopsPassword}
+}
+
+// authorize sets the Authorization header of req
+func authorize(ctx context.Context, req *http.Request, auth Authenticator) error {
+	authorization, err := auth.Authorization(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate with Ditto: %w", err)
+	}
+	req.Header.Set("Authorization", authorization)
+	return nil
+}
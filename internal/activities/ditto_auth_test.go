@@ -0,0 +1,105 @@
+package activities
+
+import (
+	"context"
+	"dm-backend/internal/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newStubTokenEndpoint issues the tokens tok-1, tok-2, … valid for expiresIn seconds
+func newStubTokenEndpoint(t *testing.T, expiresIn int) (*httptest.Server, *atomic.Int32) {
+	var issued atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_id") != "dm-backend" ||
+			r.Form.Get("client_secret") != "s3cret" || r.Form.Get("scope") != "openid ditto" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+			return
+		}
+		n := issued.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("tok-%d", n),
+			"token_type":   "Bearer",
+			"expires_in":   expiresIn,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &issued
+}
+
+func TestClientCredentials_CachesAndRefreshesTokens(t *testing.T) {
+	tokenSrv, issued := newStubTokenEndpoint(t, 3600)
+	var authorizations []string
+	dittoSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		w.Write([]byte(`{"items":[]}`))
+	}))
+	defer dittoSrv.Close()
+
+	auth := &ClientCredentials{TokenURL: tokenSrv.URL, ClientID: "dm-backend", ClientSecret: "s3cret", Scopes: []string{"openid", "ditto"}}
+	client := &DittoClient{Host: strings.TrimPrefix(dittoSrv.URL, "http://"), Auth: auth}
+	for i := 0; i < 3; i++ {
+		if _, err := client.FetchDevicePage(context.Background(), SearchThingsParams{}); err != nil {
+			t.Fatalf("FetchDevicePage failed: %v", err)
+		}
+	}
+	if issued.Load() != 1 || authorizations[2] != "Bearer tok-1" {
+		t.Errorf("expected one cached token, got %d tokens and %v", issued.Load(), authorizations)
+	}
+
+	// Tokens expiring within the refresh margin are replaced before use
+	shortSrv, shortIssued := newStubTokenEndpoint(t, 10)
+	auth = &ClientCredentials{TokenURL: shortSrv.URL, ClientID: "dm-backend", ClientSecret: "s3cret", Scopes: []string{"openid", "ditto"}}
+	for i := 1; i <= 2; i++ {
+		if authorization, err := auth.Authorization(context.Background()); err != nil || authorization != fmt.Sprintf("Bearer tok-%d", i) {
+			t.Errorf("expected a new token, got %q (%v)", authorization, err)
+		}
+	}
+	if shortIssued.Load() != 2 {
+		t.Errorf("expected the token to be refreshed, got %d tokens", shortIssued.Load())
+	}
+
+	client.Auth = &ClientCredentials{TokenURL: tokenSrv.URL, ClientID: "dm-backend", ClientSecret: "wrong"}
+	if _, err := client.FetchDevicePage(context.Background(), SearchThingsParams{}); err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("expected token endpoint error, got %v", err)
+	}
+}
+
+func TestAuthenticator_AppliesToWebSocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer pre-issued" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var msg models.DittoProtocolMessage
+		if conn.ReadJSON(&msg) == nil {
+			conn.WriteJSON(models.DittoProtocolMessage{Topic: msg.Topic, Headers: msg.Headers, Status: 204})
+		}
+	}))
+	defer srv.Close()
+
+	client := &DittoClient{Host: strings.TrimPrefix(srv.URL, "http://"), Auth: BearerToken{Token: "pre-issued"}}
+	defer client.CloseWebSocket()
+	res, err := client.SendDittoProtocolMessage(context.Background(), SendDittoProtocolMessageParams{
+		ThingId: "org.example:thing",
+		Message: models.DittoProtocolMessage{Topic: "<namespace>/<name>/things/twin/commands/modify", Path: "/attributes/foo", Value: "bar"},
+	})
+	if err != nil || res.Status != 204 {
+		t.Errorf("expected bearer token in the WebSocket handshake, got %+v (%v)", res, err)
+	}
+}
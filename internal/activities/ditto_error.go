@@ -0,0 +1,82 @@
+package activities
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+// DittoErrorType is the application error type of failed Ditto API calls, its details hold the DittoError
+const DittoErrorType = "DittoError"
+
+// DittoError is an error response of the Ditto API
+type DittoError struct {
+	Status      int    `json:"status"`
+	Code        string `json:"error,omitempty"` // e.g. "things:thing.notfound"
+	Message     string `json:"message,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *DittoError) Error() string {
+	msg := fmt.Sprintf("ditto API returned status %d", e.Status)
+	if e.Code != "" {
+		msg += " " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Retryable reports whether repeating the request can succeed: server errors, timeouts and
+// rate limiting are retried, other client errors are not
+func (e *DittoError) Retryable() bool {
+	switch e.Status {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	}
+	return e.Status < 400 || e.Status >= 500
+}
+
+// newDittoError parses Ditto's error body into an ApplicationError of type DittoErrorType with the
+// DittoError as details, so workflows and the API can tell error codes apart. Client errors are non-retryable.
+func newDittoError(status int, body []byte) error {
+	dittoErr := parseDittoError(status, body)
+	return dittoApplicationError(dittoErr.Error(), dittoErr)
+}
+
+func parseDittoError(status int, body []byte) DittoError {
+	dittoErr := DittoError{}
+	if err := json.Unmarshal(body, &dittoErr); err != nil || dittoErr.Code == "" {
+		dittoErr = DittoError{Message: strings.TrimSpace(string(body))}
+	}
+	dittoErr.Status = status
+	return dittoErr
+}
+
+// dittoApplicationError must be returned unwrapped: Temporal only honors NonRetryable of a top-level ApplicationError
+func dittoApplicationError(msg string, dittoErr DittoError) error {
+	return temporal.NewApplicationErrorWithOptions(msg, DittoErrorType, temporal.ApplicationErrorOptions{
+		NonRetryable: !dittoErr.Retryable(),
+		Details:      []interface{}{dittoErr},
+	})
+}
+
+// AsDittoError returns the Ditto error of a failed DittoClient call, activity or workflow
+func AsDittoError(err error) (*DittoError, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		appErr, ok := err.(*temporal.ApplicationError)
+		if !ok || appErr.Type() != DittoErrorType || !appErr.HasDetails() {
+			continue
+		}
+		var dittoErr DittoError
+		if appErr.Details(&dittoErr) == nil {
+			return &dittoErr, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,49 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+func TestDittoError_ParsesBodyAndClassifiesRetries(t *testing.T) {
+	tests := []struct {
+		status    int
+		body      string
+		code      string
+		retryable bool
+	}{
+		{http.StatusConflict, `{"status":409,"error":"connectivity:connection.conflict","message":"The Connection already exists.","description":"Choose another ID."}`, "connectivity:connection.conflict", false},
+		{http.StatusForbidden, `{"status":403,"error":"things:thing.notmodifiable","message":"The Thing could not be modified."}`, "things:thing.notmodifiable", false},
+		{http.StatusTooManyRequests, `{"status":429,"error":"too.many.requests","message":"Too many requests."}`, "too.many.requests", true},
+		{http.StatusServiceUnavailable, `upstream unavailable`, "", true},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		}))
+		client := &DittoClient{Host: strings.TrimPrefix(srv.URL, "http://")}
+		_, err := client.GetConnectionStatus(context.Background(), GetConnectionStatusParams{ConnectionID: "conn-1"})
+		srv.Close()
+
+		var appErr *temporal.ApplicationError
+		if !errors.As(err, &appErr) || appErr.Type() != DittoErrorType || appErr.NonRetryable() == tt.retryable {
+			t.Errorf("status %d: expected %s error with retryable=%v, got %v", tt.status, DittoErrorType, tt.retryable, err)
+			continue
+		}
+		dittoErr, ok := AsDittoError(fmt.Errorf("activity failed: %w", err))
+		if !ok || dittoErr.Status != tt.status || dittoErr.Code != tt.code {
+			t.Errorf("status %d: expected Ditto error with code %q, got %+v", tt.status, tt.code, dittoErr)
+		}
+	}
+	if dittoErr, _ := AsDittoError(newDittoError(http.StatusServiceUnavailable, []byte("upstream unavailable"))); dittoErr.Message != "upstream unavailable" {
+		t.Errorf("expected the raw body as message, got %+v", dittoErr)
+	}
+}
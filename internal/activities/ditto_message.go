@@ -9,7 +9,6 @@ import (
 	"strings"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 )
 
 type SendDittoProtocolMessageParams struct {
@@ -33,54 +32,65 @@ func validateDittoTopicRegex(topic string) error {
 	return nil
 }
 
-// SendDittoProtocolMessageActivity connects to Ditto WS, sends the message, and closes the connection
-func (c *DittoClient) SendDittoProtocolMessage(ctx context.Context, params SendDittoProtocolMessageParams) error {
-	wsURL := fmt.Sprintf("ws://%s/ws/2", c.Host)
+// SendDittoProtocolMessageResult carries Ditto's response to a protocol command
+type SendDittoProtocolMessageResult struct {
+	Status int
+	Value  interface{}
+}
 
+// RenderDittoProtocolMessage substitutes <namespace> and <name> in the message topic for the given thing
+// and validates the resulting topic
+func RenderDittoProtocolMessage(thingId string, message models.DittoProtocolMessage) (models.DittoProtocolMessage, error) {
 	// Split thingId into namespace and name
-	parts := strings.SplitN(params.ThingId, ":", 2)
+	parts := strings.SplitN(thingId, ":", 2)
 	if len(parts) != 2 {
-		return fmt.Errorf("invalid thingId format, expected namespace:name")
+		return message, fmt.Errorf("invalid thingId format, expected namespace:name")
 	}
 	namespace, name := parts[0], parts[1]
 
-	params.Message.Topic = strings.ReplaceAll(params.Message.Topic, "<namespace>", namespace)
-	params.Message.Topic = strings.ReplaceAll(params.Message.Topic, "<name>", name)
+	message.Topic = strings.ReplaceAll(message.Topic, "<namespace>", namespace)
+	message.Topic = strings.ReplaceAll(message.Topic, "<name>", name)
 
 	// Validate topic
-	if err := validateDittoTopicRegex(params.Message.Topic); err != nil {
-		return err
-	}
-
-	// Add correlation-id header with a UUID
-	if params.Message.Headers == nil {
-		params.Message.Headers = make(map[string]interface{})
+	if err := validateDittoTopicRegex(message.Topic); err != nil {
+		return message, err
 	}
-	params.Message.Headers["correlation-id"] = uuid.NewString()
+	return message, nil
+}
 
-	if err := c.ConnectWebSocket(wsURL); err != nil {
-		return fmt.Errorf("failed to connect to Ditto WebSocket: %w", err)
+// SendDittoProtocolMessage sends the message over the client's Ditto WebSocket session and waits for Ditto's response
+func (c *DittoClient) SendDittoProtocolMessage(ctx context.Context, params SendDittoProtocolMessageParams) (SendDittoProtocolMessageResult, error) {
+	message, err := RenderDittoProtocolMessage(params.ThingId, params.Message)
+	if err != nil {
+		return SendDittoProtocolMessageResult{}, err
 	}
-	defer c.CloseWebSocket()
+	params.Message = message
 
-	c.wsMutex.Lock()
-	defer c.wsMutex.Unlock()
-	if c.wsConn == nil {
-		return fmt.Errorf("websocket not connected")
+	// Add a unique correlation-id header so the response can be matched on the shared session
+	headers := make(map[string]interface{}, len(params.Message.Headers)+2)
+	for k, v := range params.Message.Headers {
+		headers[k] = v
 	}
+	headers["correlation-id"] = uuid.NewString()
+	headers["response-required"] = true
+	params.Message.Headers = headers
 
-	jsonBytes, err := json.Marshal(params.Message)
+	resp, err := c.webSocket().send(ctx, params.Message)
 	if err != nil {
-		return fmt.Errorf("failed to marshal Ditto protocol message: %w", err)
+		return SendDittoProtocolMessageResult{}, err
 	}
-	fmt.Printf("Sending to websocket: %s\n", string(jsonBytes))
-
-	if err := c.wsConn.WriteMessage(websocket.TextMessage, jsonBytes); err != nil {
-		return fmt.Errorf("failed to send Ditto protocol message: %w", err)
+	if resp.Status < 200 || resp.Status >= 300 {
+		value, _ := json.Marshal(resp.Value)
+		dittoErr := parseDittoError(resp.Status, value)
+		return SendDittoProtocolMessageResult{}, dittoApplicationError(fmt.Sprintf("ditto rejected %s: %s", params.Message.Topic, dittoErr.Error()), dittoErr)
 	}
-	return nil
+	return SendDittoProtocolMessageResult{Status: resp.Status, Value: resp.Value}, nil
 }
 
-func (a *Activities) SendDittoProtocolMessage(ctx context.Context, params SendDittoProtocolMessageParams) error {
-	return a.DittoClient.SendDittoProtocolMessage(ctx, params)
+func (a *Activities) SendDittoProtocolMessage(ctx context.Context, params SendDittoProtocolMessageParams) (SendDittoProtocolMessageResult, error) {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return SendDittoProtocolMessageResult{}, err
+	}
+	return client.SendDittoProtocolMessage(ctx, params)
 }
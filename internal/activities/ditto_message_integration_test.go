@@ -14,13 +14,13 @@ func TestSendDittoProtocolMessage_Integration(t *testing.T) {
 		t.Skip("set DITTO_INTEGRATION=1 to run integration tests")
 	}
 
-	activitiesImpl := &Activities{
-		DittoClient: &DittoClient{
-			Host:     dittoHost,
-			Username: dittoUsername,
-			Password: dittoPassword,
-		},
-	}
+	clients, _ := NewDittoClients("default", map[string]*DittoClient{"default": {
+		Host:     dittoHost,
+		Username: dittoUsername,
+		Password: dittoPassword,
+	}})
+	activitiesImpl := &Activities{DittoClients: clients}
+	defer clients.Close()
 
 	// 1. Create Thing using the existing method
 	thingData := map[string]interface{}{
@@ -35,7 +35,7 @@ func TestSendDittoProtocolMessage_Integration(t *testing.T) {
 		ThingData:          thingData,
 	}
 	t.Logf("Creating thing with params: %+v", createParams)
-	thingID, err := activitiesImpl.DittoClient.CreateThing(createParams)
+	thingID, err := activitiesImpl.CreateThing(t.Context(), createParams)
 	if err != nil {
 		t.Fatalf("CreateThing failed: %v", err)
 	}
@@ -53,7 +53,7 @@ func TestSendDittoProtocolMessage_Integration(t *testing.T) {
 	}
 	featureParams := SendDittoProtocolMessageParams{Message: featureMsg, ThingId: thingID}
 	t.Logf("Sending create feature message: %+v, %s", featureMsg, thingID)
-	if err := activitiesImpl.SendDittoProtocolMessage(t.Context(), featureParams); err != nil {
+	if _, err := activitiesImpl.SendDittoProtocolMessage(t.Context(), featureParams); err != nil {
 		t.Fatalf("failed to send create feature message: %v", err)
 	}
 
@@ -65,7 +65,7 @@ func TestSendDittoProtocolMessage_Integration(t *testing.T) {
 	}
 	modifyParams := SendDittoProtocolMessageParams{Message: modifyMsg, ThingId: thingID}
 	t.Logf("Sending modify feature message: %+v, %s", modifyMsg, thingID)
-	if err := activitiesImpl.SendDittoProtocolMessage(t.Context(), modifyParams); err != nil {
+	if _, err := activitiesImpl.SendDittoProtocolMessage(t.Context(), modifyParams); err != nil {
 		t.Fatalf("failed to send modify feature message: %v", err)
 	}
 
@@ -76,7 +76,7 @@ func TestSendDittoProtocolMessage_Integration(t *testing.T) {
 	}
 	deleteParams := SendDittoProtocolMessageParams{Message: deleteMsg, ThingId: thingID}
 	t.Logf("Sending delete thing message: %+v, %s", deleteMsg, thingID)
-	if err := activitiesImpl.SendDittoProtocolMessage(t.Context(), deleteParams); err != nil {
+	if _, err := activitiesImpl.SendDittoProtocolMessage(t.Context(), deleteParams); err != nil {
 		t.Fatalf("failed to send delete thing message: %v", err)
 	}
 
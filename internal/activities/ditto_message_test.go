@@ -1,6 +1,9 @@
 package activities
 
-import "testing"
+import (
+	"dm-backend/internal/models"
+	"testing"
+)
 
 func TestValidateDittoTopic_Positive(t *testing.T) {
 	validTopics := []string{
@@ -51,3 +54,25 @@ func TestValidateDittoTopic_Negative(t *testing.T) {
 		}
 	}
 }
+
+func TestRenderDittoProtocolMessage(t *testing.T) {
+	msg := models.DittoProtocolMessage{
+		Topic: "<namespace>/<name>/things/twin/commands/modify",
+		Path:  "/attributes/mode",
+		Value: "fast",
+	}
+	rendered, err := RenderDittoProtocolMessage("org.example:device-1", msg)
+	if err != nil {
+		t.Fatalf("RenderDittoProtocolMessage failed: %v", err)
+	}
+	if rendered.Topic != "org.example/device-1/things/twin/commands/modify" {
+		t.Errorf("unexpected rendered topic %q", rendered.Topic)
+	}
+	if msg.Topic != "<namespace>/<name>/things/twin/commands/modify" {
+		t.Errorf("template message was modified: %q", msg.Topic)
+	}
+
+	if _, err := RenderDittoProtocolMessage("no-namespace", msg); err == nil {
+		t.Error("expected error for thingId without namespace, got nil")
+	}
+}
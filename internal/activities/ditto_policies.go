@@ -0,0 +1,357 @@
+package activities
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+// defaultSitePolicyTemplate grants the Ditto user of the backend full access, the gateway
+// policy entry of the site connection is added once the thing exists
+//
+//go:embed site_policy_template.json
+var defaultSitePolicyTemplate string
+
+// PolicyExistsErrorType is the application error type of CreatePolicy when the policy ID is taken
+const PolicyExistsErrorType = "PolicyExists"
+
+func (c *DittoClient) policyURL(policyID string, path string) string {
+	return fmt.Sprintf("%s/api/2/policies/%s%s", c.baseURL(), url.PathEscape(policyID), path)
+}
+
+type CreatePolicyParams struct {
+	PolicyID string
+	Policy   map[string]interface{} // policy JSON, at least its entries
+}
+
+// CreatePolicy creates a policy, it fails without retries if the policy already exists
+func (c *DittoClient) CreatePolicy(ctx context.Context, params CreatePolicyParams) error {
+	body, err := json.Marshal(params.Policy)
+	if err != nil {
+		return fmt.Errorf("failed to marshal policy: %w", err)
+	}
+	headers := http.Header{"If-None-Match": []string{"*"}}
+	resp, respBody, err := c.doDittoRequestWithHeaders(ctx, "PUT", c.policyURL(params.PolicyID, ""), body, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusPreconditionFailed:
+		return temporal.NewNonRetryableApplicationError(fmt.Sprintf("policy %s already exists", params.PolicyID), PolicyExistsErrorType, nil)
+	default:
+		return newDittoError(resp.StatusCode, respBody)
+	}
+}
+
+func (a *Activities) CreatePolicy(ctx context.Context, params CreatePolicyParams) error {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.CreatePolicy(ctx, params)
+}
+
+type CreateSitePolicyParams struct {
+	PolicyID string
+	SiteName string
+}
+
+// CreateSitePolicyResult tells whether the policy was created by the call or adopted
+type CreateSitePolicyResult struct {
+	Created bool // false if an existing policy was adopted, it must not be deleted when the site creation fails
+}
+
+// CreateSitePolicy creates the dedicated policy of a site from the client's site policy template.
+// An existing policy is adopted unchanged if it has exactly the entries of the template and no thing
+// uses it, e.g. one created by a previous attempt or left behind by a decommissioned site. Existing
+// policies are never overwritten, any other one fails with PolicyExistsErrorType.
+func (c *DittoClient) CreateSitePolicy(ctx context.Context, params CreateSitePolicyParams) (CreateSitePolicyResult, error) {
+	policy, err := c.renderSitePolicy(params.PolicyID, params.SiteName)
+	if errors.Is(err, ErrNoPolicySubject) {
+		return CreateSitePolicyResult{}, temporal.NewNonRetryableApplicationError(err.Error(), "MissingPolicySubject", err)
+	}
+	if err != nil {
+		return CreateSitePolicyResult{}, temporal.NewNonRetryableApplicationError(err.Error(), "InvalidPolicyTemplate", err)
+	}
+	err = c.CreatePolicy(ctx, CreatePolicyParams{PolicyID: params.PolicyID, Policy: policy})
+	var appErr *temporal.ApplicationError
+	if !errors.As(err, &appErr) || appErr.Type() != PolicyExistsErrorType {
+		return CreateSitePolicyResult{Created: err == nil}, err
+	}
+
+	existing, err := c.GetPolicy(ctx, GetPolicyParams{PolicyID: params.PolicyID})
+	if err != nil {
+		return CreateSitePolicyResult{}, err
+	}
+	if !policyHasEntries(existing, policy) {
+		return CreateSitePolicyResult{}, temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("policy %s already exists and differs from the site policy template", params.PolicyID), PolicyExistsErrorType, nil)
+	}
+	page, err := c.FetchDevicePage(ctx, SearchThingsParams{
+		Filter:   fmt.Sprintf("eq(policyId,%q)", params.PolicyID),
+		Fields:   []string{"thingId"},
+		PageSize: 1,
+	})
+	if err != nil {
+		return CreateSitePolicyResult{}, err
+	}
+	if len(page.Items) > 0 {
+		return CreateSitePolicyResult{}, temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("policy %s already exists and is used by %s", params.PolicyID, page.Items[0].ThingId), PolicyExistsErrorType, nil)
+	}
+	return CreateSitePolicyResult{}, nil
+}
+
+// policyHasEntries reports whether the policy has exactly the entries of the template policy with the same
+// subjects and the same granted and revoked permissions per resource. Other fields Ditto adds are ignored.
+func policyHasEntries(policy, template map[string]interface{}) bool {
+	entries, _ := policy["entries"].(map[string]interface{})
+	templateEntries, _ := template["entries"].(map[string]interface{})
+	if !sameKeys(entries, templateEntries) {
+		return false
+	}
+	for label, templateEntry := range templateEntries {
+		entry, ok := entries[label].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		want, _ := templateEntry.(map[string]interface{})
+		if !sameKeys(entry["subjects"], want["subjects"]) || !sameKeys(entry["resources"], want["resources"]) {
+			return false
+		}
+		resources, _ := entry["resources"].(map[string]interface{})
+		wantResources, _ := want["resources"].(map[string]interface{})
+		for path, wantResource := range wantResources {
+			resource, _ := resources[path].(map[string]interface{})
+			wantResource, _ := wantResource.(map[string]interface{})
+			if !samePermissions(resource["grant"], wantResource["grant"]) || !samePermissions(resource["revoke"], wantResource["revoke"]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sameKeys reports whether both values are JSON objects with the same keys
+func sameKeys(a, b interface{}) bool {
+	objA, _ := a.(map[string]interface{})
+	objB, _ := b.(map[string]interface{})
+	if len(objA) != len(objB) {
+		return false
+	}
+	for key := range objB {
+		if _, ok := objA[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// samePermissions reports whether both values are JSON arrays with the same permissions in any order
+func samePermissions(a, b interface{}) bool {
+	listA, _ := a.([]interface{})
+	listB, _ := b.([]interface{})
+	count := map[string]int{}
+	for _, permission := range listA {
+		count[fmt.Sprint(permission)]++
+	}
+	for _, permission := range listB {
+		count[fmt.Sprint(permission)]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Activities) CreateSitePolicy(ctx context.Context, params CreateSitePolicyParams) (CreateSitePolicyResult, error) {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return CreateSitePolicyResult{}, err
+	}
+	return client.CreateSitePolicy(ctx, params)
+}
+
+type GetPolicyParams struct {
+	PolicyID string
+}
+
+// GetPolicy returns the policy JSON
+func (c *DittoClient) GetPolicy(ctx context.Context, params GetPolicyParams) (map[string]interface{}, error) {
+	resp, body, err := c.doDittoRequest(ctx, "GET", c.policyURL(params.PolicyID, ""), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newDittoError(resp.StatusCode, body)
+	}
+	var policy map[string]interface{}
+	if err := json.Unmarshal(body, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse response JSON: %w", err)
+	}
+	return policy, nil
+}
+
+func (a *Activities) GetPolicy(ctx context.Context, params GetPolicyParams) (map[string]interface{}, error) {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetPolicy(ctx, params)
+}
+
+type ModifyPolicyEntryParams struct {
+	PolicyID string
+	Label    string
+	Entry    map[string]interface{} // subjects and resources of the entry
+}
+
+// ModifyPolicyEntry creates or replaces a policy entry
+func (c *DittoClient) ModifyPolicyEntry(ctx context.Context, params ModifyPolicyEntryParams) error {
+	body, err := json.Marshal(params.Entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal policy entry: %w", err)
+	}
+	resp, respBody, err := c.doDittoRequest(ctx, "PUT", c.policyURL(params.PolicyID, "/entries/"+url.PathEscape(params.Label)), body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return newDittoError(resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+func (a *Activities) ModifyPolicyEntry(ctx context.Context, params ModifyPolicyEntryParams) error {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.ModifyPolicyEntry(ctx, params)
+}
+
+type DeletePolicyEntryParams struct {
+	PolicyID string
+	Label    string
+}
+
+// DeletePolicyEntry removes a policy entry, an entry that does not exist counts as removed
+func (c *DittoClient) DeletePolicyEntry(ctx context.Context, params DeletePolicyEntryParams) error {
+	return c.deletePolicyResource(ctx, c.policyURL(params.PolicyID, "/entries/"+url.PathEscape(params.Label)))
+}
+
+func (a *Activities) DeletePolicyEntry(ctx context.Context, params DeletePolicyEntryParams) error {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.DeletePolicyEntry(ctx, params)
+}
+
+type DeletePolicyParams struct {
+	PolicyID string
+}
+
+// DeletePolicy deletes a policy, a policy that does not exist counts as deleted
+func (c *DittoClient) DeletePolicy(ctx context.Context, params DeletePolicyParams) error {
+	return c.deletePolicyResource(ctx, c.policyURL(params.PolicyID, ""))
+}
+
+func (a *Activities) DeletePolicy(ctx context.Context, params DeletePolicyParams) error {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.DeletePolicy(ctx, params)
+}
+
+func (c *DittoClient) deletePolicyResource(ctx context.Context, url string) error {
+	resp, body, err := c.doDittoRequest(ctx, "DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return newDittoError(resp.StatusCode, body)
+	}
+	return nil
+}
+
+// ErrNoPolicySubject is returned when a site policy would be rendered without the client's subject
+var ErrNoPolicySubject = errors.New("no policy subject for the Ditto client, set the policy subject of the target")
+
+// policySubject returns the subject the client authenticates as in Ditto policies, by default
+// nginx:<username> for basic auth. Token based authenticators need an explicit PolicySubject.
+func (c *DittoClient) policySubject() string {
+	if c.PolicySubject != "" {
+		return c.PolicySubject
+	}
+	if basic, ok := c.authenticator().(BasicAuth); ok && basic.Username != "" {
+		return "nginx:" + basic.Username
+	}
+	return ""
+}
+
+// renderSitePolicy renders the site policy template, by default defaultSitePolicyTemplate.
+// Placeholders: PolicyID, SiteName, Subject (see policySubject) and Username (the Ditto user of the client).
+func (c *DittoClient) renderSitePolicy(policyID, siteName string) (map[string]interface{}, error) {
+	subject := c.policySubject()
+	if subject == "" {
+		return nil, ErrNoPolicySubject
+	}
+	tmpl := c.PolicyTemplate
+	if tmpl == "" {
+		tmpl = defaultSitePolicyTemplate
+	}
+	return renderPolicyTemplate(tmpl, map[string]string{
+		"PolicyID": policyID,
+		"SiteName": siteName,
+		"Subject":  subject,
+		"Username": c.Username,
+	})
+}
+
+// ValidatePolicyTemplate renders a site policy template with sample values
+func ValidatePolicyTemplate(tmpl string) error {
+	_, err := renderPolicyTemplate(tmpl, map[string]string{
+		"PolicyID": "gateway:sample-policy",
+		"SiteName": `sample "site"`,
+		"Subject":  "nginx:sample-user",
+		"Username": "sample-user",
+	})
+	return err
+}
+
+// renderPolicyTemplate executes a policy template with JSON-escaped values and checks the result has entries
+func renderPolicyTemplate(tmplStr string, values map[string]string) (map[string]interface{}, error) {
+	tmpl, err := parseConnectionTemplate(tmplStr)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, values); err != nil {
+		return nil, fmt.Errorf("failed to execute policy template: %w", err)
+	}
+	var policy map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &policy); err != nil {
+		return nil, fmt.Errorf("rendered policy template is not a JSON object: %w", err)
+	}
+	if entries, _ := policy["entries"].(map[string]interface{}); len(entries) == 0 {
+		return nil, fmt.Errorf("rendered policy template has no entries")
+	}
+	return policy, nil
+}
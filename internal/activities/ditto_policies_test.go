@@ -0,0 +1,166 @@
+package activities
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+func TestCreateSitePolicy_RendersTemplateAndCreatesOnly(t *testing.T) {
+	var existing []byte // policy Ditto already has
+	var users string    // search result of things using the policy
+	var got map[string]interface{}
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/2/search/things" {
+			requests = append(requests, "SEARCH "+r.URL.Query().Get("filter"))
+			w.Write([]byte(`{"items":[` + users + `]}`))
+			return
+		}
+		requests = append(requests, r.Method+" If-None-Match="+r.Header.Get("If-None-Match")+" If-Match="+r.Header.Get("If-Match"))
+		if r.URL.Path != "/api/2/policies/gateway:site1-policy" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		switch {
+		case r.Method == "GET":
+			w.Write(existing)
+		case existing != nil && r.Header.Get("If-None-Match") == "*":
+			w.WriteHeader(http.StatusPreconditionFailed)
+		default:
+			json.NewDecoder(r.Body).Decode(&got)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer srv.Close()
+
+	client := &DittoClient{Host: strings.TrimPrefix(srv.URL, "http://"), Username: "ditto"}
+	params := CreateSitePolicyParams{PolicyID: "gateway:site1-policy", SiteName: "site1"}
+	result, err := client.CreateSitePolicy(context.Background(), params)
+	if err != nil || !result.Created {
+		t.Fatalf("expected the policy to be created, got %+v (%v)", result, err)
+	}
+	subjects := got["entries"].(map[string]interface{})["DEFAULT"].(map[string]interface{})["subjects"].(map[string]interface{})
+	if _, ok := subjects["nginx:ditto"]; !ok {
+		t.Errorf("expected the client user as subject, got %v", subjects)
+	}
+
+	// An unused policy with the entries of the template and fields added by Ditto is adopted unchanged
+	rendered := got
+	rendered["entries"].(map[string]interface{})["DEFAULT"].(map[string]interface{})["importable"] = "implicit"
+	existing, _ = json.Marshal(rendered)
+	requests = nil
+	result, err = client.CreateSitePolicy(context.Background(), params)
+	if err != nil || result.Created {
+		t.Fatalf("expected the existing site policy to be adopted, got %+v (%v)", result, err)
+	}
+	expected := []string{"PUT If-None-Match=* If-Match=", "GET If-None-Match= If-Match=", `SEARCH eq(policyId,"gateway:site1-policy")`}
+	if strings.Join(requests, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, requests)
+	}
+
+	var appErr *temporal.ApplicationError
+	expectPolicyKept := func(reason string) {
+		t.Helper()
+		requests = nil
+		_, err := client.CreateSitePolicy(context.Background(), params)
+		if !errors.As(err, &appErr) || appErr.Type() != PolicyExistsErrorType || !appErr.NonRetryable() {
+			t.Errorf("%s: expected non-retryable PolicyExists error, got %v", reason, err)
+		}
+		for _, request := range requests {
+			if strings.HasPrefix(request, "PUT") && !strings.Contains(request, "If-None-Match=*") || strings.HasPrefix(request, "DELETE") {
+				t.Errorf("%s: expected the existing policy to be kept, got %s", reason, request)
+			}
+		}
+	}
+
+	// A thing still uses the policy, e.g. a live site
+	users = `{"thingId":"gateway:site1"}`
+	expectPolicyKept("policy in use")
+	users = ""
+
+	// The DEVICE entry of a live site is not dropped
+	rendered["entries"].(map[string]interface{})["DEVICE"] = map[string]interface{}{"subjects": map[string]interface{}{"integration:site1": map[string]interface{}{}}}
+	existing, _ = json.Marshal(rendered)
+	expectPolicyKept("extra entry")
+
+	existing = []byte(`{"entries":{"DEFAULT":{"subjects":{"nginx:someone-else":{"type":"x"}},"resources":{}}}}`)
+	expectPolicyKept("foreign policy")
+}
+
+func TestPolicyEntries(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.Method {
+		case "PUT":
+			w.WriteHeader(http.StatusCreated)
+		case "DELETE":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client := &DittoClient{Host: strings.TrimPrefix(srv.URL, "http://")}
+	ctx := context.Background()
+	if err := client.ModifyPolicyEntry(ctx, ModifyPolicyEntryParams{PolicyID: "ns:p", Label: "DEVICE", Entry: map[string]interface{}{}}); err != nil {
+		t.Errorf("ModifyPolicyEntry failed: %v", err)
+	}
+	if err := client.DeletePolicyEntry(ctx, DeletePolicyEntryParams{PolicyID: "ns:p", Label: "DEVICE"}); err != nil {
+		t.Errorf("expected a missing entry to count as deleted, got %v", err)
+	}
+	if err := client.DeletePolicy(ctx, DeletePolicyParams{PolicyID: "ns:p"}); err != nil {
+		t.Errorf("expected a missing policy to count as deleted, got %v", err)
+	}
+	expected := []string{"PUT /api/2/policies/ns:p/entries/DEVICE", "DELETE /api/2/policies/ns:p/entries/DEVICE", "DELETE /api/2/policies/ns:p"}
+	if strings.Join(requests, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, requests)
+	}
+}
+
+func TestValidatePolicyTemplate(t *testing.T) {
+	if err := ValidatePolicyTemplate(defaultSitePolicyTemplate); err != nil {
+		t.Errorf("expected the default template to be valid, got %v", err)
+	}
+	if err := ValidatePolicyTemplate(`{"entries": {}}`); err == nil {
+		t.Error("expected a template without entries to be rejected")
+	}
+	if err := ValidatePolicyTemplate(`{"entries": {"{{.Unknown}}": {}}}`); err == nil {
+		t.Error("expected an unknown placeholder to be rejected")
+	}
+}
+
+func TestRenderSitePolicy_Subject(t *testing.T) {
+	subjectOf := func(client *DittoClient) (string, error) {
+		policy, err := client.renderSitePolicy("gateway:site1-policy", "site1")
+		if err != nil {
+			return "", err
+		}
+		subjects := policy["entries"].(map[string]interface{})["DEFAULT"].(map[string]interface{})["subjects"].(map[string]interface{})
+		for subject := range subjects {
+			return subject, nil
+		}
+		return "", nil
+	}
+
+	if subject, err := subjectOf(&DittoClient{Username: "ditto"}); err != nil || subject != "nginx:ditto" {
+		t.Errorf("expected the basic auth user as subject, got %q (%v)", subject, err)
+	}
+	if subject, err := subjectOf(&DittoClient{Auth: BearerToken{Token: "t"}, PolicySubject: "jwt:backend"}); err != nil || subject != "jwt:backend" {
+		t.Errorf("expected the configured subject, got %q (%v)", subject, err)
+	}
+	if _, err := subjectOf(&DittoClient{Username: "ditto", Auth: BearerToken{Token: "t"}}); !errors.Is(err, ErrNoPolicySubject) {
+		t.Errorf("expected ErrNoPolicySubject for a bearer token without subject, got %v", err)
+	}
+
+	var appErr *temporal.ApplicationError
+	_, err := (&DittoClient{Auth: BearerToken{Token: "t"}}).CreateSitePolicy(context.Background(), CreateSitePolicyParams{PolicyID: "gateway:site1-policy", SiteName: "site1"})
+	if !errors.As(err, &appErr) || !appErr.NonRetryable() {
+		t.Errorf("expected a non-retryable error without subject, got %v", err)
+	}
+}
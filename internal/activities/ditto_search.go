@@ -5,28 +5,138 @@ import (
 	"dm-backend/internal/models"
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 )
 
-// FetchDevicesFromDitto
-func (c *DittoClient) FetchDevicesFromDitto(rqlQuery string) ([]models.Device, error) {
-	url := fmt.Sprintf("http://%s/api/2/search/things?filter=%s", c.Host, rqlQuery)
-	resp, respBody, err := c.doDittoRequest(context.Background(), "GET", url, nil)
+// maxSearchPageSize is the largest page size Ditto's search API accepts
+const maxSearchPageSize = 200
+
+// SearchThingsParams selects one page of a Ditto thing search
+type SearchThingsParams struct {
+	Filter     string   // RQL filter, e.g. eq(attributes/type,"gateway")
+	Namespaces []string // Optional, restricts the search to these namespaces
+	Fields     []string // Optional, e.g. attributes/siteName; thingId is always included
+	PageSize   int      // 1..200, defaults to 200
+	Cursor     string   // Cursor returned with the previous page, empty for the first page
+}
+
+// DevicePage is one page of search results
+type DevicePage struct {
+	Items  []models.Device
+	Cursor string // Cursor of the next page, empty on the last page
+}
+
+// searchThingsURL builds the URL-encoded search URL for params
+func (c *DittoClient) searchThingsURL(params SearchThingsParams) string {
+	query := url.Values{}
+	if params.Filter != "" {
+		query.Set("filter", params.Filter)
+	}
+	if len(params.Namespaces) > 0 {
+		query.Set("namespaces", strings.Join(params.Namespaces, ","))
+	}
+	if len(params.Fields) > 0 {
+		fields := params.Fields
+		if !slices.Contains(fields, "thingId") {
+			fields = append([]string{"thingId"}, fields...)
+		}
+		query.Set("fields", strings.Join(fields, ","))
+	}
+	size := params.PageSize
+	if size <= 0 || size > maxSearchPageSize {
+		size = maxSearchPageSize
+	}
+	option := fmt.Sprintf("size(%d)", size)
+	if params.Cursor != "" {
+		option += fmt.Sprintf(",cursor(%s)", params.Cursor)
+	}
+	query.Set("option", option)
+	return fmt.Sprintf("%s/api/2/search/things?%s", c.baseURL(), query.Encode())
+}
+
+// FetchDevicePage fetches a single page of things matching the search
+func (c *DittoClient) FetchDevicePage(ctx context.Context, params SearchThingsParams) (DevicePage, error) {
+	resp, respBody, err := c.doDittoRequest(ctx, "GET", c.searchThingsURL(params), nil)
 	if err != nil {
-		return nil, err
+		return DevicePage{}, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("ditto API returned status %d: %s", resp.StatusCode, string(respBody))
+		return DevicePage{}, newDittoError(resp.StatusCode, respBody)
 	}
 	var res struct {
-		Items []models.Device `json:"items"`
+		Items  []models.Device `json:"items"`
+		Cursor string          `json:"cursor"`
 	}
 	if err := json.Unmarshal(respBody, &res); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal quoted JSON string: %w", err)
+		return DevicePage{}, fmt.Errorf("failed to unmarshal search response: %w", err)
+	}
+	return DevicePage{Items: res.Items, Cursor: res.Cursor}, nil
+}
+
+func (a *Activities) FetchDevicePage(ctx context.Context, params SearchThingsParams) (DevicePage, error) {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return DevicePage{}, err
+	}
+	return client.FetchDevicePage(ctx, params)
+}
+
+// FetchDevicesFromDitto fetches all things matching the RQL query, following the search cursor page by page.
+// Prefer FetchDevicePage for large result sets.
+func (c *DittoClient) FetchDevicesFromDitto(ctx context.Context, rqlQuery string) ([]models.Device, error) {
+	params := SearchThingsParams{Filter: rqlQuery}
+	var devices []models.Device
+	for {
+		page, err := c.FetchDevicePage(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, page.Items...)
+		if page.Cursor == "" {
+			return devices, nil
+		}
+		params.Cursor = page.Cursor
 	}
-	return res.Items, nil
 }
 
 func (a *Activities) FetchDevicesFromDitto(ctx context.Context, rqlQuery string) ([]models.Device, error) {
-	return a.DittoClient.FetchDevicesFromDitto(rqlQuery)
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.FetchDevicesFromDitto(ctx, rqlQuery)
+}
+
+// CountDevicesInDitto returns the number of things matching the RQL query
+func (c *DittoClient) CountDevicesInDitto(ctx context.Context, rqlQuery string) (int, error) {
+	query := url.Values{}
+	if rqlQuery != "" {
+		query.Set("filter", rqlQuery)
+	}
+	countURL := fmt.Sprintf("%s/api/2/search/things/count?%s", c.baseURL(), query.Encode())
+	resp, respBody, err := c.doDittoRequest(ctx, "GET", countURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return 0, newDittoError(resp.StatusCode, respBody)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(string(respBody)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse count response: %w", err)
+	}
+	return count, nil
+}
+
+func (a *Activities) CountDevicesInDitto(ctx context.Context, rqlQuery string) (int, error) {
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return client.CountDevicesInDitto(ctx, rqlQuery)
 }
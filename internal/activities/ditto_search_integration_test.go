@@ -19,7 +19,7 @@ func TestFetchDevicesFromDitto_Integration(t *testing.T) {
 	}
 
 	rql := `eq(thingId,"org.example:test-thing")`
-	devices, err := client.FetchDevicesFromDitto(rql)
+	devices, err := client.FetchDevicesFromDitto(t.Context(), rql)
 	if err != nil {
 		t.Fatalf("FetchDevicesFromDitto failed: %v", err)
 	}
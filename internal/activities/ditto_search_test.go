@@ -0,0 +1,72 @@
+package activities
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchDevicesFromDitto_FollowsCursor(t *testing.T) {
+	const filter = `and(eq(attributes/type,"gateway"),like(attributes/site,"a&b*"))`
+	pages := map[string]map[string]interface{}{
+		"size(200)": {
+			"items":  []map[string]string{{"thingId": "org.example:one"}, {"thingId": "org.example:two"}},
+			"cursor": "c1",
+		},
+		"size(200),cursor(c1)": {
+			"items": []map[string]string{{"thingId": "org.example:three"}},
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("filter"); got != filter {
+			t.Errorf("expected filter %q, got %q", filter, got)
+		}
+		page, ok := pages[r.URL.Query().Get("option")]
+		if !ok {
+			t.Errorf("unexpected option %q", r.URL.Query().Get("option"))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer srv.Close()
+
+	client := &DittoClient{Host: strings.TrimPrefix(srv.URL, "http://")}
+	devices, err := client.FetchDevicesFromDitto(context.Background(), filter)
+	if err != nil {
+		t.Fatalf("FetchDevicesFromDitto failed: %v", err)
+	}
+	if len(devices) != 3 || devices[2].ThingId != "org.example:three" {
+		t.Errorf("expected devices from both pages, got %+v", devices)
+	}
+}
+
+func TestSearchThingsURL(t *testing.T) {
+	client := &DittoClient{Host: "ditto:8080"}
+	raw := client.searchThingsURL(SearchThingsParams{
+		Filter:     `eq(attributes/siteName,"x y")`,
+		Namespaces: []string{"gateway", "org.example"},
+		Fields:     []string{"attributes/siteName"},
+		PageSize:   1000,
+		Cursor:     "abc",
+	})
+	req, err := http.NewRequest("GET", raw, nil)
+	if err != nil {
+		t.Fatalf("invalid URL %q: %v", raw, err)
+	}
+	query := req.URL.Query()
+	expected := map[string]string{
+		"filter":     `eq(attributes/siteName,"x y")`,
+		"namespaces": "gateway,org.example",
+		"fields":     "thingId,attributes/siteName",
+		"option":     "size(200),cursor(abc)",
+	}
+	for key, want := range expected {
+		if got := query.Get(key); got != want {
+			t.Errorf("expected %s=%q, got %q", key, want, got)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// UnknownDittoTargetErrorType is the application error type of activities run for a target that is not configured
+const UnknownDittoTargetErrorType = "UnknownDittoTarget"
+
+// dittoTargetHeader carries the Ditto target from workflows to their activities and child workflows
+const dittoTargetHeader = "ditto-target"
+
+var ErrUnknownDittoTarget = errors.New("unknown Ditto target")
+
+// DittoClients holds the DittoClient of each configured Ditto target, e.g. staging, production or a region
+type DittoClients struct {
+	defaultTarget string
+	clients       map[string]*DittoClient
+}
+
+// NewDittoClients creates the registry, requests without target use the client of defaultTarget
+func NewDittoClients(defaultTarget string, clients map[string]*DittoClient) (*DittoClients, error) {
+	if _, ok := clients[defaultTarget]; !ok {
+		return nil, fmt.Errorf("%w: default target %q is not configured", ErrUnknownDittoTarget, defaultTarget)
+	}
+	return &DittoClients{defaultTarget: defaultTarget, clients: clients}, nil
+}
+
+// Resolve returns the name and client of a target, an empty target is the default target
+func (r *DittoClients) Resolve(target string) (string, *DittoClient, error) {
+	if target == "" {
+		target = r.defaultTarget
+	}
+	client, ok := r.clients[target]
+	if !ok {
+		return "", nil, fmt.Errorf("%w %q, configured targets are %v", ErrUnknownDittoTarget, target, r.Targets())
+	}
+	return target, client, nil
+}
+
+// Client returns the client of a target, an empty target is the default target
+func (r *DittoClients) Client(target string) (*DittoClient, error) {
+	_, client, err := r.Resolve(target)
+	return client, err
+}
+
+// DefaultTarget returns the name of the target used when none is given
+func (r *DittoClients) DefaultTarget() string {
+	return r.defaultTarget
+}
+
+// Targets returns the names of all targets
+func (r *DittoClients) Targets() []string {
+	targets := make([]string, 0, len(r.clients))
+	for target := range r.clients {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// Close closes the WebSocket sessions of all clients
+func (r *DittoClients) Close() {
+	for _, client := range r.clients {
+		client.CloseWebSocket()
+	}
+}
+
+// dittoClient returns the client of the target the activity was scheduled for
+func (a *Activities) dittoClient(ctx context.Context) (*DittoClient, error) {
+	client, err := a.DittoClients.Client(DittoTargetFromContext(ctx))
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError(err.Error(), UnknownDittoTargetErrorType, err)
+	}
+	return client, nil
+}
+
+// DittoTarget returns the name of the target the activity was scheduled for, resolving the default target
+func (a *Activities) DittoTarget(ctx context.Context) (string, error) {
+	target, _, err := a.DittoClients.Resolve(DittoTargetFromContext(ctx))
+	if err != nil {
+		return "", temporal.NewNonRetryableApplicationError(err.Error(), UnknownDittoTargetErrorType, err)
+	}
+	return target, nil
+}
+
+type dittoTargetKey struct{}
+
+// WithDittoTarget sets the Ditto target of the activities and child workflows started with ctx.
+// An empty target keeps the target inherited from the parent workflow, if any.
+func WithDittoTarget(ctx workflow.Context, target string) workflow.Context {
+	if target == "" {
+		return ctx
+	}
+	return workflow.WithValue(ctx, dittoTargetKey{}, target)
+}
+
+// DittoTargetFromContext returns the Ditto target of an activity, empty for the default target
+func DittoTargetFromContext(ctx context.Context) string {
+	target, _ := ctx.Value(dittoTargetKey{}).(string)
+	return target
+}
+
+// DittoTargetPropagator passes the target set by WithDittoTarget to activities and child workflows.
+// It must be set in the ContextPropagators of the Temporal client.
+func DittoTargetPropagator() workflow.ContextPropagator {
+	return dittoTargetPropagator{}
+}
+
+type dittoTargetPropagator struct{}
+
+func (dittoTargetPropagator) Inject(ctx context.Context, writer workflow.HeaderWriter) error {
+	return injectDittoTarget(DittoTargetFromContext(ctx), writer)
+}
+
+func (dittoTargetPropagator) InjectFromWorkflow(ctx workflow.Context, writer workflow.HeaderWriter) error {
+	target, _ := ctx.Value(dittoTargetKey{}).(string)
+	return injectDittoTarget(target, writer)
+}
+
+func (dittoTargetPropagator) Extract(ctx context.Context, reader workflow.HeaderReader) (context.Context, error) {
+	target, err := extractDittoTarget(reader)
+	if err != nil || target == "" {
+		return ctx, err
+	}
+	return context.WithValue(ctx, dittoTargetKey{}, target), nil
+}
+
+func (dittoTargetPropagator) ExtractToWorkflow(ctx workflow.Context, reader workflow.HeaderReader) (workflow.Context, error) {
+	target, err := extractDittoTarget(reader)
+	if err != nil {
+		return ctx, err
+	}
+	return WithDittoTarget(ctx, target), nil
+}
+
+func injectDittoTarget(target string, writer workflow.HeaderWriter) error {
+	if target == "" {
+		return nil
+	}
+	payload, err := converter.GetDefaultDataConverter().ToPayload(target)
+	if err != nil {
+		return fmt.Errorf("failed to encode Ditto target: %w", err)
+	}
+	writer.Set(dittoTargetHeader, payload)
+	return nil
+}
+
+func extractDittoTarget(reader workflow.HeaderReader) (string, error) {
+	payload, ok := reader.Get(dittoTargetHeader)
+	if !ok {
+		return "", nil
+	}
+	var target string
+	if err := converter.GetDefaultDataConverter().FromPayload(payload, &target); err != nil {
+		return "", fmt.Errorf("failed to decode Ditto target: %w", err)
+	}
+	return target, nil
+}
@@ -0,0 +1,48 @@
+package activities
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+func TestActivities_ResolveClientOfTarget(t *testing.T) {
+	newStub := func(status string) *DittoClient {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"liveStatus":"` + status + `"}`))
+		}))
+		t.Cleanup(srv.Close)
+		return &DittoClient{Host: strings.TrimPrefix(srv.URL, "http://")}
+	}
+	if _, err := NewDittoClients("production", map[string]*DittoClient{"staging": newStub("open")}); !errors.Is(err, ErrUnknownDittoTarget) {
+		t.Errorf("expected error for unconfigured default target, got %v", err)
+	}
+	clients, err := NewDittoClients("production", map[string]*DittoClient{
+		"production": newStub("open"),
+		"staging":    newStub("closed"),
+	})
+	if err != nil {
+		t.Fatalf("NewDittoClients failed: %v", err)
+	}
+	a := &Activities{DittoClients: clients}
+	params := GetConnectionStatusParams{ConnectionID: "c1"}
+
+	if status, err := a.GetConnectionStatus(context.Background(), params); err != nil || status != "open" {
+		t.Errorf("expected the default target without target, got %q (%v)", status, err)
+	}
+	ctx := context.WithValue(context.Background(), dittoTargetKey{}, "staging")
+	if status, err := a.GetConnectionStatus(ctx, params); err != nil || status != "closed" {
+		t.Errorf("expected the staging target, got %q (%v)", status, err)
+	}
+
+	ctx = context.WithValue(context.Background(), dittoTargetKey{}, "eu-west")
+	var appErr *temporal.ApplicationError
+	if _, err := a.GetConnectionStatus(ctx, params); !errors.As(err, &appErr) || appErr.Type() != UnknownDittoTargetErrorType || !appErr.NonRetryable() {
+		t.Errorf("expected non-retryable %s error, got %v", UnknownDittoTargetErrorType, err)
+	}
+}
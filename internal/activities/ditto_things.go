@@ -5,8 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+
+	"go.temporal.io/sdk/temporal"
 )
 
+// ThingExistsErrorType is the application error type of CreateThing when the unique attribute is taken
+const ThingExistsErrorType = "ThingExists"
+
 type CreateThingParams struct {
 	Namespace          string
 	UniqueAttributeKey string
@@ -14,7 +19,7 @@ type CreateThingParams struct {
 }
 
 // CreateThing
-func (c *DittoClient) CreateThing(params CreateThingParams) (string, error) {
+func (c *DittoClient) CreateThing(ctx context.Context, params CreateThingParams) (string, error) {
 	// 1. Check that UniqueAttributeKey is present in ThingData["attributes"]
 	attrs, ok := params.ThingData["attributes"].(map[string]interface{})
 	if !ok {
@@ -27,14 +32,14 @@ func (c *DittoClient) CreateThing(params CreateThingParams) (string, error) {
 
 	// 2. Search for existing thing with the unique attribute value
 	rql := fmt.Sprintf(`eq(attributes/%s,"%v")`, params.UniqueAttributeKey, val)
-	searchURL := fmt.Sprintf("http://%s/api/2/search/things?filter=%s", c.Host, rql)
-	searchResp, searchBody, err := c.doDittoRequest(context.Background(), "GET", searchURL, nil)
+	searchURL := c.searchThingsURL(SearchThingsParams{Filter: rql, Fields: []string{"thingId"}, PageSize: 1})
+	searchResp, searchBody, err := c.doDittoRequest(ctx, "GET", searchURL, nil)
 	if err != nil {
 		return "", fmt.Errorf("search HTTP request failed: %w", err)
 	}
 	defer searchResp.Body.Close()
 	if searchResp.StatusCode < 200 || searchResp.StatusCode >= 300 {
-		return "", fmt.Errorf("ditto search API returned status %d: %s", searchResp.StatusCode, string(searchBody))
+		return "", newDittoError(searchResp.StatusCode, searchBody)
 	}
 	var searchResult struct {
 		Items []struct {
@@ -45,22 +50,24 @@ func (c *DittoClient) CreateThing(params CreateThingParams) (string, error) {
 		return "", fmt.Errorf("failed to decode search response: %w", err)
 	}
 	if len(searchResult.Items) > 0 {
-		return "", fmt.Errorf("thing with %s=%v already exists", params.UniqueAttributeKey, val)
+		// Retrying cannot help, the workflow reports the existing thing instead
+		return "", temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("thing with %s=%v already exists", params.UniqueAttributeKey, val), ThingExistsErrorType, nil)
 	}
 
 	// 3. Create the new thing with the provided data
-	url := fmt.Sprintf("http://%s/api/2/things?namespace=%s&requested-acks=twin-persisted,search-persisted&timeout=10", c.Host, params.Namespace)
+	url := fmt.Sprintf("%s/api/2/things?namespace=%s&requested-acks=twin-persisted,search-persisted&timeout=10", c.baseURL(), params.Namespace)
 	bodyBytes, err := json.Marshal(params.ThingData)
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal thing body: %w", err)
 	}
-	resp, respBody, err := c.doDittoRequest(context.Background(), "POST", url, bodyBytes)
+	resp, respBody, err := c.doDittoRequest(ctx, "POST", url, bodyBytes)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return "", fmt.Errorf("ditto API returned status %d: %s", resp.StatusCode, string(respBody))
+		return "", newDittoError(resp.StatusCode, respBody)
 	}
 	var result struct {
 		TwinPersisted struct {
@@ -76,7 +83,11 @@ func (c *DittoClient) CreateThing(params CreateThingParams) (string, error) {
 }
 
 func (a *Activities) CreateThing(ctx context.Context, params CreateThingParams) (string, error) {
-	return a.DittoClient.CreateThing(params)
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	return client.CreateThing(ctx, params)
 }
 
 type DeleteThingParams struct {
@@ -85,7 +96,7 @@ type DeleteThingParams struct {
 
 // DeleteThing
 func (c *DittoClient) DeleteThing(ctx context.Context, params DeleteThingParams) error {
-	url := fmt.Sprintf("http://%s/api/2/things/%s", c.Host, params.ThingID)
+	url := fmt.Sprintf("%s/api/2/things/%s", c.baseURL(), params.ThingID)
 	resp, respBody, err := c.doDittoRequest(ctx, "DELETE", url, nil)
 	if err != nil {
 		return err
@@ -99,9 +110,13 @@ func (c *DittoClient) DeleteThing(ctx context.Context, params DeleteThingParams)
 		// Thing already deleted, treat as success
 		return nil
 	}
-	return fmt.Errorf("ditto API returned status %d: %s", resp.StatusCode, string(respBody))
+	return newDittoError(resp.StatusCode, respBody)
 }
 
 func (a *Activities) DeleteThing(ctx context.Context, params DeleteThingParams) error {
-	return a.DittoClient.DeleteThing(ctx, params)
+	client, err := a.dittoClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.DeleteThing(ctx, params)
 }
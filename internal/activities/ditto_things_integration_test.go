@@ -11,12 +11,15 @@ import (
 	"time"
 )
 
+// dittoNamespace is the namespace integration tests create things in
+const dittoNamespace = "org.example"
+
 var (
-	appConfig      = config.LoadConfig()
-	dittoHost      = appConfig.DittoHost
-	dittoUsername  = appConfig.DittoUsername
-	dittoPassword  = appConfig.DittoPassword
-	dittoNamespace = appConfig.DittoNamespace
+	appConfig     = config.LoadConfig()
+	dittoTarget   = appConfig.DittoTargets[config.DefaultDittoTarget]
+	dittoHost     = dittoTarget.Host
+	dittoUsername = dittoTarget.Username
+	dittoPassword = dittoTarget.Password
 )
 
 func setupDittoTestData(t *testing.T) {
@@ -92,7 +95,7 @@ func TestCreateThing_Integration(t *testing.T) {
 
 	// Test successful creation
 	t.Logf("Creating thing with params: %+v", params)
-	thingID, err := client.CreateThing(params)
+	thingID, err := client.CreateThing(t.Context(), params)
 	if err != nil {
 		t.Fatalf("CreateThing failed: %v", err)
 	}
@@ -106,7 +109,7 @@ func TestCreateThing_Integration(t *testing.T) {
 
 	// Test duplicate creation is avoided
 	t.Logf("Try to create duplicate thing with params: %+v", params)
-	_, err = client.CreateThing(params)
+	_, err = client.CreateThing(t.Context(), params)
 	if err == nil {
 		t.Error("expected error when creating duplicate thing, got nil")
 	} else {
@@ -141,7 +144,7 @@ func TestDeleteThing_Integration(t *testing.T) {
 	}
 
 	t.Logf("Creating thing for deletion test with params: %+v", params)
-	thingID, err := client.CreateThing(params)
+	thingID, err := client.CreateThing(t.Context(), params)
 	if err != nil {
 		t.Fatalf("CreateThing failed: %v", err)
 	}
@@ -0,0 +1,129 @@
+package activities
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TransportConfig configures how a DittoClient connects to Ditto. Zero values keep the Go defaults.
+type TransportConfig struct {
+	TLS                bool   // Use https and wss instead of http and ws
+	CAFile             string // PEM bundle of additional CAs trusted for the Ditto server certificate
+	CertFile           string // PEM client certificate for mutual TLS, requires KeyFile
+	KeyFile            string
+	InsecureSkipVerify bool   // Skip server certificate verification, for test environments only
+	ProxyURL           string // Proxy for HTTP and WebSocket connections, defaults to HTTP_PROXY/HTTPS_PROXY
+
+	RequestTimeout      time.Duration // Timeout of a whole HTTP request including reading the response
+	DialTimeout         time.Duration // Timeout of establishing a TCP connection and the WebSocket handshake
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+}
+
+// ConfigureTransport sets up the HTTP client and WebSocket dialer of the client.
+// It must be called before the first request.
+func (c *DittoClient) ConfigureTransport(cfg TransportConfig) error {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return err
+	}
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid Ditto proxy URL: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = tlsConfig
+	if cfg.DialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if cfg.MaxIdleConns > 0 {
+		transport.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = cfg.MaxConnsPerHost
+	}
+	if cfg.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.Proxy = proxy
+	dialer.TLSClientConfig = tlsConfig
+	if cfg.DialTimeout > 0 {
+		dialer.HandshakeTimeout = cfg.DialTimeout
+	}
+
+	c.TLS = cfg.TLS
+	c.HTTPClient = &http.Client{Transport: transport, Timeout: cfg.RequestTimeout}
+	c.Dialer = &dialer
+	return nil
+}
+
+func (cfg TransportConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Ditto CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Ditto CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Ditto client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// baseURL returns the URL of the Ditto HTTP API host
+func (c *DittoClient) baseURL() string {
+	if c.TLS {
+		return "https://" + c.Host
+	}
+	return "http://" + c.Host
+}
+
+// webSocketURL returns the URL of the Ditto WebSocket API
+func (c *DittoClient) webSocketURL() string {
+	if c.TLS {
+		return "wss://" + c.Host + "/ws/2"
+	}
+	return "ws://" + c.Host + "/ws/2"
+}
+
+// httpClient returns the client's HTTP client
+func (c *DittoClient) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
@@ -0,0 +1,92 @@
+package activities
+
+import (
+	"context"
+	"dm-backend/internal/models"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConfigureTransport_UsesTLSWithCustomCA(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws/2" {
+			w.Write([]byte(`{"liveStatus":"open"}`))
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var msg models.DittoProtocolMessage
+		if conn.ReadJSON(&msg) == nil {
+			conn.WriteJSON(models.DittoProtocolMessage{Topic: msg.Topic, Headers: msg.Headers, Status: 204})
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600)
+
+	untrusted := &DittoClient{Host: host}
+	if err := untrusted.ConfigureTransport(TransportConfig{TLS: true}); err != nil {
+		t.Fatalf("ConfigureTransport failed: %v", err)
+	}
+	if _, err := untrusted.GetConnectionStatus(context.Background(), GetConnectionStatusParams{ConnectionID: "c1"}); err == nil {
+		t.Error("expected the server certificate to be rejected without the CA")
+	}
+
+	client := &DittoClient{Host: host}
+	if err := client.ConfigureTransport(TransportConfig{TLS: true, CAFile: caFile, RequestTimeout: 5 * time.Second}); err != nil {
+		t.Fatalf("ConfigureTransport failed: %v", err)
+	}
+	defer client.CloseWebSocket()
+	if status, err := client.GetConnectionStatus(context.Background(), GetConnectionStatusParams{ConnectionID: "c1"}); err != nil || status != "open" {
+		t.Errorf("expected status over https, got %q (%v)", status, err)
+	}
+	res, err := client.SendDittoProtocolMessage(context.Background(), SendDittoProtocolMessageParams{
+		ThingId: "org.example:thing",
+		Message: models.DittoProtocolMessage{Topic: "<namespace>/<name>/things/twin/commands/modify", Path: "/attributes/foo", Value: "bar"},
+	})
+	if err != nil || res.Status != 204 {
+		t.Errorf("expected command over wss, got %+v (%v)", res, err)
+	}
+}
+
+func TestConfigureTransport_TimesOutRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	client := &DittoClient{Host: strings.TrimPrefix(srv.URL, "http://")}
+	if err := client.ConfigureTransport(TransportConfig{RequestTimeout: 50 * time.Millisecond}); err != nil {
+		t.Fatalf("ConfigureTransport failed: %v", err)
+	}
+	start := time.Now()
+	if _, err := client.GetConnectionStatus(context.Background(), GetConnectionStatusParams{ConnectionID: "c1"}); err == nil {
+		t.Error("expected the request to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("expected the request to be canceled after the timeout, took %v", elapsed)
+	}
+}
+
+func TestConfigureTransport_RejectsInvalidFiles(t *testing.T) {
+	client := &DittoClient{}
+	if err := client.ConfigureTransport(TransportConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("expected error for missing CA file")
+	}
+	if err := client.ConfigureTransport(TransportConfig{CertFile: "cert.pem"}); err == nil {
+		t.Error("expected error for client certificate without key")
+	}
+}
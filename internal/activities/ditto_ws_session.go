@@ -0,0 +1,203 @@
+package activities
+
+import (
+	"context"
+	"dm-backend/internal/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsInitialBackoff  = 500 * time.Millisecond
+	wsMaxBackoff      = 30 * time.Second
+	wsWriteTimeout    = 10 * time.Second
+	wsResponseTimeout = 60 * time.Second
+)
+
+var errWebSocketClosed = errors.New("ditto websocket session closed")
+
+// wsResult is delivered to a waiting sender once the reply with its
+// correlation-id arrives, or the connection carrying the command is lost.
+type wsResult struct {
+	msg models.DittoProtocolMessage
+	err error
+}
+
+// wsSession keeps one authenticated WebSocket connection to Ditto open and
+// multiplexes Ditto protocol commands over it. Replies are matched to their
+// commands by the correlation-id header. A lost connection fails all
+// in-flight commands and is re-established with backoff on the next send.
+type wsSession struct {
+	url    string
+	header func(ctx context.Context) (http.Header, error) // headers of the handshake, e.g. Authorization
+	dialer *websocket.Dialer
+
+	dialMu  sync.Mutex // serializes (re)connect attempts
+	writeMu sync.Mutex // gorilla/websocket allows only one concurrent writer
+
+	mu      sync.Mutex // guards the fields below
+	conn    *websocket.Conn
+	pending map[string]chan wsResult
+	closed  bool
+}
+
+// newWSSession creates a session for url, dialer defaults to websocket.DefaultDialer
+func newWSSession(url string, dialer *websocket.Dialer, header func(ctx context.Context) (http.Header, error)) *wsSession {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	return &wsSession{
+		url:     url,
+		header:  header,
+		dialer:  dialer,
+		pending: make(map[string]chan wsResult),
+	}
+}
+
+// connection returns the current connection, dialing with exponential
+// backoff until ctx is done if there is none.
+func (s *wsSession) connection(ctx context.Context) (*websocket.Conn, error) {
+	s.dialMu.Lock()
+	defer s.dialMu.Unlock()
+
+	backoff := wsInitialBackoff
+	for {
+		s.mu.Lock()
+		conn, closed := s.conn, s.closed
+		s.mu.Unlock()
+		if closed {
+			return nil, errWebSocketClosed
+		}
+		if conn != nil {
+			return conn, nil
+		}
+
+		header, err := s.header(ctx)
+		if err == nil {
+			conn, _, err = s.dialer.DialContext(ctx, s.url, header)
+		}
+		if err == nil {
+			s.mu.Lock()
+			s.conn = conn
+			s.mu.Unlock()
+			go s.readLoop(conn)
+			return conn, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to connect to Ditto WebSocket: %w", err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, wsMaxBackoff)
+	}
+}
+
+// readLoop dispatches replies on conn to their waiting senders until the
+// connection fails.
+func (s *wsSession) readLoop(conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			s.drop(conn, fmt.Errorf("ditto websocket connection lost: %w", err))
+			return
+		}
+		var msg models.DittoProtocolMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			// Not a protocol message, e.g. a START-SEND-EVENTS:ACK frame
+			continue
+		}
+		correlationID, _ := msg.Headers["correlation-id"].(string)
+
+		s.mu.Lock()
+		ch, ok := s.pending[correlationID]
+		delete(s.pending, correlationID)
+		s.mu.Unlock()
+		if ok {
+			ch <- wsResult{msg: msg}
+		}
+	}
+}
+
+// drop discards conn if it is still the current connection and fails every
+// command waiting for a reply.
+func (s *wsSession) drop(conn *websocket.Conn, cause error) {
+	s.mu.Lock()
+	if s.conn == conn {
+		s.conn = nil
+		for id, ch := range s.pending {
+			ch <- wsResult{err: cause}
+			delete(s.pending, id)
+		}
+	}
+	s.mu.Unlock()
+	conn.Close()
+}
+
+// send writes msg and waits for the reply carrying the same correlation-id.
+func (s *wsSession) send(ctx context.Context, msg models.DittoProtocolMessage) (models.DittoProtocolMessage, error) {
+	correlationID, _ := msg.Headers["correlation-id"].(string)
+	if correlationID == "" {
+		return models.DittoProtocolMessage{}, fmt.Errorf("message is missing a correlation-id header")
+	}
+	jsonBytes, err := json.Marshal(msg)
+	if err != nil {
+		return models.DittoProtocolMessage{}, fmt.Errorf("failed to marshal Ditto protocol message: %w", err)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wsResponseTimeout)
+		defer cancel()
+	}
+
+	conn, err := s.connection(ctx)
+	if err != nil {
+		return models.DittoProtocolMessage{}, err
+	}
+
+	ch := make(chan wsResult, 1)
+	s.mu.Lock()
+	s.pending[correlationID] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, correlationID)
+		s.mu.Unlock()
+	}()
+
+	s.writeMu.Lock()
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	err = conn.WriteMessage(websocket.TextMessage, jsonBytes)
+	s.writeMu.Unlock()
+	if err != nil {
+		s.drop(conn, err)
+		return models.DittoProtocolMessage{}, fmt.Errorf("failed to send Ditto protocol message: %w", err)
+	}
+
+	select {
+	case res := <-ch:
+		return res.msg, res.err
+	case <-ctx.Done():
+		return models.DittoProtocolMessage{}, fmt.Errorf("no Ditto response for correlation-id %s: %w", correlationID, ctx.Err())
+	}
+}
+
+// close shuts the session down; subsequent sends fail.
+func (s *wsSession) close() error {
+	s.mu.Lock()
+	conn := s.conn
+	s.closed = true
+	s.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	s.drop(conn, errWebSocketClosed)
+	return nil
+}
@@ -0,0 +1,147 @@
+package activities
+
+import (
+	"context"
+	"dm-backend/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.temporal.io/sdk/temporal"
+)
+
+// newStubDittoWS starts a WebSocket server that answers every command with
+// the status returned by reply. If dropFirst is set, the first connection is
+// closed without answering.
+func newStubDittoWS(t *testing.T, dropFirst bool, reply func(msg models.DittoProtocolMessage) (int, interface{})) (*DittoClient, *atomic.Int32) {
+	var connections atomic.Int32
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Basic "+basicAuth("ditto", "ditto") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n := connections.Add(1)
+		for {
+			var msg models.DittoProtocolMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if dropFirst && n == 1 {
+				return
+			}
+			status, value := reply(msg)
+			resp := models.DittoProtocolMessage{
+				Topic:   msg.Topic,
+				Path:    msg.Path,
+				Headers: map[string]interface{}{"correlation-id": msg.Headers["correlation-id"]},
+				Status:  status,
+				Value:   value,
+			}
+			if err := conn.WriteJSON(resp); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	client := &DittoClient{
+		Host:     strings.TrimPrefix(srv.URL, "http://"),
+		Username: "ditto",
+		Password: "ditto",
+	}
+	t.Cleanup(func() { client.CloseWebSocket() })
+	return client, &connections
+}
+
+func TestSendDittoProtocolMessage_ReturnsResponse(t *testing.T) {
+	client, connections := newStubDittoWS(t, false, func(msg models.DittoProtocolMessage) (int, interface{}) {
+		return 204, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		res, err := client.SendDittoProtocolMessage(context.Background(), SendDittoProtocolMessageParams{
+			ThingId: "org.example:thing",
+			Message: models.DittoProtocolMessage{
+				Topic: "<namespace>/<name>/things/twin/commands/modify",
+				Path:  "/attributes/foo",
+				Value: "bar",
+			},
+		})
+		if err != nil {
+			t.Fatalf("SendDittoProtocolMessage failed: %v", err)
+		}
+		if res.Status != 204 {
+			t.Errorf("expected status 204, got %d", res.Status)
+		}
+	}
+	if got := connections.Load(); got != 1 {
+		t.Errorf("expected a single reused connection, got %d", got)
+	}
+}
+
+func TestSendDittoProtocolMessage_ReportsDittoError(t *testing.T) {
+	client, _ := newStubDittoWS(t, false, func(msg models.DittoProtocolMessage) (int, interface{}) {
+		return 403, map[string]interface{}{
+			"status":  403,
+			"error":   "policies:policy.notmodifiable",
+			"message": "The Policy could not be modified as the requester had insufficient permissions.",
+		}
+	})
+
+	_, err := client.SendDittoProtocolMessage(context.Background(), SendDittoProtocolMessageParams{
+		ThingId: "org.example:thing",
+		Message: models.DittoProtocolMessage{
+			Topic: "<namespace>/<name>/policies/commands/modify",
+			Path:  "entries/DEVICE",
+		},
+	})
+	if err == nil {
+		t.Fatal("expected an error for a rejected command, got nil")
+	}
+	if !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "policies:policy.notmodifiable") {
+		t.Errorf("expected error to carry Ditto status and error code, got: %v", err)
+	}
+	// The failure recorded by Temporal must stop retries of client errors
+	failure := temporal.GetDefaultFailureConverter().ErrorToFailure(err)
+	if info := failure.GetApplicationFailureInfo(); info == nil || info.GetType() != DittoErrorType || !info.GetNonRetryable() {
+		t.Errorf("expected a non-retryable %s failure, got %v", DittoErrorType, failure)
+	}
+	if dittoErr, ok := AsDittoError(err); !ok || dittoErr.Code != "policies:policy.notmodifiable" {
+		t.Errorf("expected the Ditto error as details, got %+v", dittoErr)
+	}
+}
+
+func TestSendDittoProtocolMessage_Reconnects(t *testing.T) {
+	client, connections := newStubDittoWS(t, true, func(msg models.DittoProtocolMessage) (int, interface{}) {
+		return 204, nil
+	})
+	params := SendDittoProtocolMessageParams{
+		ThingId: "org.example:thing",
+		Message: models.DittoProtocolMessage{
+			Topic: "<namespace>/<name>/things/twin/commands/delete",
+			Path:  "/",
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.SendDittoProtocolMessage(ctx, params); err == nil {
+		t.Fatal("expected the dropped connection to fail the in-flight command")
+	}
+	if _, err := client.SendDittoProtocolMessage(ctx, params); err != nil {
+		t.Fatalf("expected the session to reconnect, got: %v", err)
+	}
+	if got := connections.Load(); got != 2 {
+		t.Errorf("expected 2 connections, got %d", got)
+	}
+}
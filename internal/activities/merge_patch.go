@@ -0,0 +1,25 @@
+package activities
+
+// inverseMergePatch returns the JSON merge patch (RFC 7386) that restores current
+// after patch has been applied to it. Keys added by the patch are removed with null,
+// replaced values are set back to their previous value.
+func inverseMergePatch(current, patch map[string]interface{}) map[string]interface{} {
+	inverse := make(map[string]interface{}, len(patch))
+	for key, patchValue := range patch {
+		currentValue, exists := current[key]
+		if !exists {
+			if patchValue != nil {
+				inverse[key] = nil
+			}
+			continue
+		}
+		patchObject, patchIsObject := patchValue.(map[string]interface{})
+		currentObject, currentIsObject := currentValue.(map[string]interface{})
+		if patchIsObject && currentIsObject {
+			inverse[key] = inverseMergePatch(currentObject, patchObject)
+			continue
+		}
+		inverse[key] = currentValue
+	}
+	return inverse
+}
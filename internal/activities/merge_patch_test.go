@@ -0,0 +1,30 @@
+package activities
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInverseMergePatch(t *testing.T) {
+	current := map[string]interface{}{
+		"mode":     "slow",
+		"location": map[string]interface{}{"site": "a", "rack": "1"},
+		"tags":     []interface{}{"x"},
+	}
+	patch := map[string]interface{}{
+		"mode":     "fast",
+		"location": map[string]interface{}{"rack": "2", "slot": "7"},
+		"tags":     map[string]interface{}{"primary": "y"},
+		"new":      "value",
+		"removed":  nil,
+	}
+	expected := map[string]interface{}{
+		"mode":     "slow",
+		"location": map[string]interface{}{"rack": "1", "slot": nil},
+		"tags":     []interface{}{"x"},
+		"new":      nil,
+	}
+	if got := inverseMergePatch(current, patch); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected inverse patch:\n got: %#v\nwant: %#v", got, expected)
+	}
+}
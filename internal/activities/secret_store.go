@@ -0,0 +1,65 @@
+package activities
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrSecretNotFound    = errors.New("secret not found")
+	ErrInvalidSecretName = errors.New("invalid secret name")
+	ErrNoSecretStore     = errors.New("placeholders reference secrets but no secret store is configured")
+)
+
+var secretNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// SecretStore resolves secrets by name, so credentials only appear in activities and never in workflow history
+type SecretStore interface {
+	Secret(name string) (string, error)
+}
+
+// FileSecretStore reads each secret from the file <dir>/<name>, e.g. a mounted Kubernetes secret.
+// Trailing newlines are removed.
+type FileSecretStore struct {
+	Dir string
+}
+
+func (s FileSecretStore) Secret(name string) (string, error) {
+	if !secretNameRegex.MatchString(name) {
+		return "", fmt.Errorf("%w %q", ErrInvalidSecretName, name)
+	}
+	content, err := os.ReadFile(filepath.Join(s.Dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %s: %w", name, err)
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// resolveSecrets returns the placeholders with the secret placeholders (key: placeholder, value: secret name) filled in
+func (c *DittoClient) resolveSecrets(placeholders, secrets map[string]string) (map[string]string, error) {
+	if len(secrets) == 0 {
+		return placeholders, nil
+	}
+	if c.Secrets == nil {
+		return nil, ErrNoSecretStore
+	}
+	resolved := make(map[string]string, len(placeholders)+len(secrets))
+	for name, value := range placeholders {
+		resolved[name] = value
+	}
+	for placeholder, secretName := range secrets {
+		value, err := c.Secrets.Secret(secretName)
+		if err != nil {
+			return nil, fmt.Errorf("placeholder %s: %w", placeholder, err)
+		}
+		resolved[placeholder] = value
+	}
+	return resolved, nil
+}
@@ -0,0 +1,180 @@
+package activities
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// SnapshotStore keeps the values compensations restore outside the workflow history, e.g. device values
+// before a patch. Entries are grouped by a snapshot ID, usually derived from the workflow ID, and keyed
+// within it, e.g. by thing ID.
+type SnapshotStore interface {
+	Put(id, key string, value []byte) error
+	Get(id, key string) ([]byte, error) // ErrSnapshotNotFound if the key is not stored
+	// Keys returns up to limit keys of the snapshot in ascending order, starting after the given key
+	Keys(id, after string, limit int) ([]string, error)
+	Delete(id, key string) error
+	DeleteAll(id string) error
+}
+
+// MemorySnapshotStore keeps snapshots in memory, they are lost when the worker restarts
+type MemorySnapshotStore struct {
+	mu        sync.Mutex
+	snapshots map[string]map[string][]byte
+}
+
+func NewMemorySnapshotStore() *MemorySnapshotStore {
+	return &MemorySnapshotStore{snapshots: map[string]map[string][]byte{}}
+}
+
+func (s *MemorySnapshotStore) Put(id, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshots[id] == nil {
+		s.snapshots[id] = map[string][]byte{}
+	}
+	s.snapshots[id][key] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *MemorySnapshotStore) Get(id, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.snapshots[id][key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s/%s", ErrSnapshotNotFound, id, key)
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (s *MemorySnapshotStore) Keys(id, after string, limit int) ([]string, error) {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.snapshots[id]))
+	for key := range s.snapshots[id] {
+		keys = append(keys, key)
+	}
+	s.mu.Unlock()
+	return pageKeys(keys, after, limit), nil
+}
+
+func (s *MemorySnapshotStore) Delete(id, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.snapshots[id], key)
+	return nil
+}
+
+func (s *MemorySnapshotStore) DeleteAll(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.snapshots, id)
+	return nil
+}
+
+// DirSnapshotStore keeps each entry in the file <dir>/<id>/<key>, with id and key base64url encoded.
+// Point all workers at the same directory, e.g. a shared volume, so any worker can restore a snapshot.
+type DirSnapshotStore struct {
+	Dir string
+}
+
+var snapshotEncoding = base64.RawURLEncoding
+
+func (s DirSnapshotStore) path(id string, key ...string) string {
+	path := filepath.Join(s.Dir, snapshotEncoding.EncodeToString([]byte(id)))
+	for _, k := range key {
+		path = filepath.Join(path, snapshotEncoding.EncodeToString([]byte(k)))
+	}
+	return path
+}
+
+func (s DirSnapshotStore) Put(id, key string, value []byte) error {
+	if err := os.MkdirAll(s.path(id), 0o700); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	// Write to a temporary file first so readers never see a partial snapshot
+	tmp, err := os.CreateTemp(s.path(id), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(id, key)); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+func (s DirSnapshotStore) Get(id, key string) ([]byte, error) {
+	value, err := os.ReadFile(s.path(id, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s/%s", ErrSnapshotNotFound, id, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	return value, nil
+}
+
+func (s DirSnapshotStore) Keys(id, after string, limit int) ([]string, error) {
+	entries, err := os.ReadDir(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshot: %w", err)
+	}
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		key, err := snapshotEncoding.DecodeString(entry.Name())
+		if err != nil {
+			continue
+		}
+		keys = append(keys, string(key))
+	}
+	return pageKeys(keys, after, limit), nil
+}
+
+func (s DirSnapshotStore) Delete(id, key string) error {
+	if err := os.Remove(s.path(id, key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+	return nil
+}
+
+func (s DirSnapshotStore) DeleteAll(id string) error {
+	if err := os.RemoveAll(s.path(id)); err != nil {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+	return nil
+}
+
+// pageKeys sorts keys and returns up to limit of them following after, all of them for limit <= 0
+func pageKeys(keys []string, after string, limit int) []string {
+	sort.Strings(keys)
+	start := sort.SearchStrings(keys, after)
+	if start < len(keys) && keys[start] == after {
+		start++
+	}
+	keys = keys[start:]
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
@@ -0,0 +1,60 @@
+package activities
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotStores(t *testing.T) {
+	stores := map[string]SnapshotStore{
+		"memory": NewMemorySnapshotStore(),
+		"dir":    DirSnapshotStore{Dir: t.TempDir()},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			id := "device-patch/wf-1/run-1"
+			for _, key := range []string{"org.example:c", "org.example:a", "org.example:b"} {
+				if err := store.Put(id, key, []byte(key)); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			}
+			if err := store.Put("other", "org.example:z", []byte("z")); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+
+			value, err := store.Get(id, "org.example:b")
+			if err != nil || string(value) != "org.example:b" {
+				t.Errorf("unexpected value %q (%v)", value, err)
+			}
+			if _, err := store.Get(id, "org.example:z"); !errors.Is(err, ErrSnapshotNotFound) {
+				t.Errorf("expected ErrSnapshotNotFound, got %v", err)
+			}
+
+			keys, err := store.Keys(id, "", 2)
+			if err != nil || !reflect.DeepEqual(keys, []string{"org.example:a", "org.example:b"}) {
+				t.Errorf("unexpected first page %v (%v)", keys, err)
+			}
+			keys, err = store.Keys(id, "org.example:b", 2)
+			if err != nil || !reflect.DeepEqual(keys, []string{"org.example:c"}) {
+				t.Errorf("unexpected second page %v (%v)", keys, err)
+			}
+
+			if err := store.Delete(id, "org.example:a"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if keys, _ := store.Keys(id, "", 0); !reflect.DeepEqual(keys, []string{"org.example:b", "org.example:c"}) {
+				t.Errorf("unexpected keys after Delete %v", keys)
+			}
+			if err := store.DeleteAll(id); err != nil {
+				t.Fatalf("DeleteAll failed: %v", err)
+			}
+			if keys, _ := store.Keys(id, "", 0); len(keys) != 0 {
+				t.Errorf("expected no keys after DeleteAll, got %v", keys)
+			}
+			if _, err := store.Get("other", "org.example:z"); err != nil {
+				t.Errorf("DeleteAll removed another snapshot: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"dm-backend/internal/activities"
+	"dm-backend/internal/models"
+)
+
+const defaultPreviewSampleSize = 10
+
+// ConfigPreview is the result of a dry run of /api/config/start
+type ConfigPreview struct {
+	DryRun       bool                  `json:"dry_run"`
+	MatchedCount int                   `json:"matched_count"`
+	Sample       []PreviewMessage      `json:"sample"`
+	Errors       []PreviewMessageError `json:"errors,omitempty"`
+}
+
+// PreviewMessage is the message a thing would receive
+type PreviewMessage struct {
+	ThingId string                      `json:"thingId"`
+	Message models.DittoProtocolMessage `json:"message"`
+}
+
+// PreviewMessageError is a validation error, for a single thing if ThingId is set
+type PreviewMessageError struct {
+	ThingId string `json:"thingId,omitempty"`
+	Error   string `json:"error"`
+}
+
+// previewMassDeviceConfig counts the things matched by the request's RQL query and renders the message
+// for a sample of them, without sending anything to Ditto
+func previewMassDeviceConfig(ctx context.Context, dittoClient *activities.DittoClient, req StartConfigRequest) (ConfigPreview, error) {
+	preview := ConfigPreview{DryRun: true, Sample: []PreviewMessage{}}
+	if _, err := req.Rollout.toRolloutPlan(); err != nil {
+		preview.Errors = append(preview.Errors, PreviewMessageError{Error: "invalid rollout plan: " + err.Error()})
+	}
+
+	count, err := dittoClient.CountDevicesInDitto(ctx, req.RQLQuery)
+	if err != nil {
+		return preview, err
+	}
+	preview.MatchedCount = count
+
+	sampleSize := req.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = defaultPreviewSampleSize
+	}
+	page, err := dittoClient.FetchDevicePage(ctx, activities.SearchThingsParams{
+		Filter:   req.RQLQuery,
+		Fields:   []string{"thingId"},
+		PageSize: sampleSize,
+	})
+	if err != nil {
+		return preview, err
+	}
+	for _, device := range page.Items {
+		message, err := activities.RenderDittoProtocolMessage(device.ThingId, req.DittoProtocolMessage)
+		if err != nil {
+			preview.Errors = append(preview.Errors, PreviewMessageError{ThingId: device.ThingId, Error: err.Error()})
+			continue
+		}
+		preview.Sample = append(preview.Sample, PreviewMessage{ThingId: device.ThingId, Message: message})
+	}
+	return preview, nil
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"dm-backend/internal/activities"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type ConnectionTemplateRequest struct {
+	Name         string                       `json:"name,omitempty"` // only for create, taken from the path on update
+	Template     string                       `json:"template"`       // Ditto connection JSON as Go text/template
+	Placeholders []activities.PlaceholderSpec `json:"placeholders"`   // every placeholder used by the template
+}
+
+// ListConnectionTemplatesHandler returns the latest version of every connection template
+func ListConnectionTemplatesHandler(registry *activities.TemplateRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, registry.List())
+	}
+}
+
+// GetConnectionTemplateHandler returns a connection template, the latest version unless the version query parameter is set
+func GetConnectionTemplateHandler(registry *activities.TemplateRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version := 0
+		if raw := r.URL.Query().Get("version"); raw != "" {
+			v, err := strconv.Atoi(raw)
+			if err != nil || v <= 0 {
+				http.Error(w, "version must be a positive number", http.StatusBadRequest)
+				return
+			}
+			version = v
+		}
+		tmpl, err := registry.Get(r.PathValue("name"), version)
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, tmpl)
+	}
+}
+
+// ListConnectionTemplateVersionsHandler returns all versions of a connection template
+func ListConnectionTemplateVersionsHandler(registry *activities.TemplateRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		versions, err := registry.Versions(r.PathValue("name"))
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, versions)
+	}
+}
+
+// CreateConnectionTemplateHandler adds a new connection template after validating it by rendering
+func CreateConnectionTemplateHandler(registry *activities.TemplateRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ConnectionTemplateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmpl, err := registry.Create(req.Name, req.Template, req.Placeholders)
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, tmpl)
+	}
+}
+
+// UpdateConnectionTemplateHandler stores a new version of a connection template, sites keep the version they were created with
+func UpdateConnectionTemplateHandler(registry *activities.TemplateRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ConnectionTemplateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmpl, err := registry.Update(r.PathValue("name"), req.Template, req.Placeholders)
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, tmpl)
+	}
+}
+
+// DeleteConnectionTemplateHandler removes all versions of a user-managed connection template.
+// Templates still referenced by a site on any Ditto target are refused with 409.
+func DeleteConnectionTemplateHandler(registry *activities.TemplateRegistry, dittoClients *activities.DittoClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if _, err := registry.Versions(name); err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		for _, target := range dittoClients.Targets() {
+			dittoClient, err := dittoClients.Client(target)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			page, err := dittoClient.FetchDevicePage(r.Context(), activities.SearchThingsParams{
+				Filter:   fmt.Sprintf(`eq(attributes/connectionTemplate,%q)`, name),
+				Fields:   []string{"thingId"},
+				PageSize: 1,
+			})
+			if err != nil {
+				log.Printf("Failed to search sites using template %s: %v", name, err)
+				writeDittoError(w, "Failed to search sites using the template", err)
+				return
+			}
+			if len(page.Items) > 0 {
+				writeTemplateError(w, fmt.Errorf("%w: %s is used by %s on target %s", activities.ErrTemplateInUse, name, page.Items[0].ThingId, target))
+				return
+			}
+		}
+		if err := registry.Delete(name); err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeTemplateError maps registry errors to HTTP status codes, other errors are validation errors
+func writeTemplateError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, activities.ErrTemplateNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, activities.ErrTemplateExists), errors.Is(err, activities.ErrBuiltinTemplate), errors.Is(err, activities.ErrTemplateInUse):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Rejected connection template: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
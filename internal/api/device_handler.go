@@ -1,13 +1,19 @@
 package api
 
 import (
+	"dm-backend/internal/activities"
 	"dm-backend/internal/config"
 	"dm-backend/internal/models"
 	"dm-backend/internal/workflow"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
+	"go.temporal.io/api/enums/v1"
 	"go.temporal.io/sdk/client"
 )
 
@@ -37,9 +43,50 @@ func GetWorkflowStatusHandler(temporalClient client.Client) http.HandlerFunc {
 type StartConfigRequest struct {
 	RQLQuery             string                      `json:"rql_query"`
 	DittoProtocolMessage models.DittoProtocolMessage `json:"ditto_protocol_message"`
+	BatchSize            int                         `json:"batch_size,omitempty"`
+	MaxConcurrency       int                         `json:"max_concurrency,omitempty"`
+	Rollout              *RolloutPlanRequest         `json:"rollout,omitempty"`
+	DryRun               bool                        `json:"dry_run,omitempty"`     // Preview matched things and rendered messages without sending anything
+	SampleSize           int                         `json:"sample_size,omitempty"` // Rendered messages returned by a dry run, defaults to 10
+	Target               string                      `json:"target,omitempty"`      // Ditto target, defaults to the default target
 }
 
-func StartMassDeviceConfigHandler(temporalClient client.Client) http.HandlerFunc {
+// RolloutPlanRequest describes a staged rollout, e.g. a 1% canary, then 10%, then the rest
+type RolloutPlanRequest struct {
+	Stages []RolloutStageRequest `json:"stages"`
+}
+
+type RolloutStageRequest struct {
+	Percent      float64 `json:"percent"`                 // Cumulative share of matched devices
+	MaxErrorRate float64 `json:"max_error_rate"`          // 0..1, the rollout halts when a stage exceeds it
+	SoakDuration string  `json:"soak_duration,omitempty"` // e.g. "10m", waited after the stage
+}
+
+// toRolloutPlan converts and validates the requested rollout plan
+func (r *RolloutPlanRequest) toRolloutPlan() (workflow.RolloutPlan, error) {
+	var plan workflow.RolloutPlan
+	if r == nil {
+		return plan, nil
+	}
+	for i, stage := range r.Stages {
+		var soak time.Duration
+		if stage.SoakDuration != "" {
+			d, err := time.ParseDuration(stage.SoakDuration)
+			if err != nil {
+				return plan, fmt.Errorf("stage %d: invalid soak_duration: %w", i+1, err)
+			}
+			soak = d
+		}
+		plan.Stages = append(plan.Stages, workflow.RolloutStage{
+			Percent:      stage.Percent,
+			MaxErrorRate: stage.MaxErrorRate,
+			SoakDuration: soak,
+		})
+	}
+	return plan, plan.Validate()
+}
+
+func StartMassDeviceConfigHandler(temporalClient client.Client, dittoClients *activities.DittoClients) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
@@ -54,10 +101,36 @@ func StartMassDeviceConfigHandler(temporalClient client.Client) http.HandlerFunc
 			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		target, dittoClient, ok := resolveDittoTarget(w, dittoClients, req.Target)
+		if !ok {
+			return
+		}
+
+		if req.DryRun {
+			preview, err := previewMassDeviceConfig(r.Context(), dittoClient, req)
+			if err != nil {
+				log.Printf("Failed to preview config rollout: %v", err)
+				writeDittoError(w, "Failed to preview config rollout", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(preview)
+			return
+		}
+
+		rollout, err := req.Rollout.toRolloutPlan()
+		if err != nil {
+			http.Error(w, "Invalid rollout plan: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		params := workflow.ConfigWorkflowParams{
 			RQLQuery:             req.RQLQuery,
 			DittoProtocolMessage: req.DittoProtocolMessage,
+			BatchSize:            req.BatchSize,
+			MaxConcurrency:       req.MaxConcurrency,
+			Rollout:              rollout,
+			Target:               target,
 		}
 		options := client.StartWorkflowOptions{
 			TaskQueue: config.TaskQueue,
@@ -83,3 +156,191 @@ func StartMassDeviceConfigHandler(temporalClient client.Client) http.HandlerFunc
 		json.NewEncoder(w).Encode(resp)
 	}
 }
+
+// GetRolloutReportHandler returns the RolloutReport of a mass device configuration workflow.
+// Running workflows are queried for their current status, completed ones return their result.
+// Use format=csv to get one row per listed device instead of JSON.
+func GetRolloutReportHandler(temporalClient client.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workflowID := r.URL.Query().Get("workflowID")
+		if workflowID == "" {
+			http.Error(w, "workflowID required", http.StatusBadRequest)
+			return
+		}
+
+		desc, err := temporalClient.DescribeWorkflowExecution(r.Context(), workflowID, "")
+		if err != nil {
+			log.Printf("Failed to describe workflow: %v", err)
+			http.Error(w, "failed to get workflow status", http.StatusInternalServerError)
+			return
+		}
+
+		var report workflow.RolloutReport
+		if desc.GetWorkflowExecutionInfo().GetStatus() == enums.WORKFLOW_EXECUTION_STATUS_RUNNING {
+			resp, err := temporalClient.QueryWorkflow(r.Context(), workflowID, "", workflow.RolloutStatusQuery)
+			if err == nil {
+				err = resp.Get(&report)
+			}
+			if err != nil {
+				log.Printf("Failed to query rollout status: %v", err)
+				http.Error(w, "failed to query rollout status", http.StatusInternalServerError)
+				return
+			}
+		} else if err := temporalClient.GetWorkflow(r.Context(), workflowID, "").Get(r.Context(), &report); err != nil {
+			log.Printf("Failed to get rollout result: %v", err)
+			http.Error(w, "rollout did not complete: "+err.Error(), http.StatusConflict)
+			return
+		}
+
+		if r.URL.Query().Get("format") == "csv" {
+			writeRolloutReportCSV(w, report)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// writeRolloutReportCSV writes the in-flight, failed, skipped and acknowledged device outcomes as CSV
+func writeRolloutReportCSV(w http.ResponseWriter, report workflow.RolloutReport) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="rollout-report.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"thingId", "status", "dittoStatus", "reason"})
+	rows := append(append(append([]workflow.DeviceOutcome{}, report.InFlight...), report.Outcomes...), report.AcknowledgedOutcomes...)
+	for _, outcome := range rows {
+		dittoStatus := ""
+		if outcome.DittoStatus != 0 {
+			dittoStatus = strconv.Itoa(outcome.DittoStatus)
+		}
+		cw.Write([]string{outcome.ThingId, string(outcome.Status), dittoStatus, outcome.Reason})
+	}
+	cw.Flush()
+}
+
+// SignalRolloutHandler sends the given control signal to a running mass device configuration workflow
+func SignalRolloutHandler(temporalClient client.Client, signalName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workflowID := r.PathValue("workflowID")
+		if workflowID == "" {
+			http.Error(w, "workflowID required", http.StatusBadRequest)
+			return
+		}
+
+		if err := temporalClient.SignalWorkflow(r.Context(), workflowID, "", signalName, nil); err != nil {
+			log.Printf("Failed to signal workflow %s: %v", workflowID, err)
+			http.Error(w, "Failed to signal workflow: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"workflowID": workflowID,
+			"signal":     signalName,
+		})
+	}
+}
+
+// RollbackDevicePatchHandler asks a device patch workflow to restore the previous values of the patched devices
+func RollbackDevicePatchHandler(temporalClient client.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workflowID := r.PathValue("workflowID")
+		if workflowID == "" {
+			http.Error(w, "workflowID required", http.StatusBadRequest)
+			return
+		}
+
+		if err := temporalClient.SignalWorkflow(r.Context(), workflowID, "", workflow.RollbackSignal, nil); err != nil {
+			log.Printf("Failed to signal rollback to workflow %s: %v", workflowID, err)
+			http.Error(w, "Failed to signal workflow: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"workflowID": workflowID,
+			"signal":     workflow.RollbackSignal,
+		})
+	}
+}
+
+type StartDevicePatchRequest struct {
+	RQLQuery       string                 `json:"rql_query"`
+	Path           string                 `json:"path,omitempty"` // /attributes (default) or /features/<featureId>/properties
+	Patch          map[string]interface{} `json:"patch"`          // JSON merge patch
+	Condition      string                 `json:"condition,omitempty"`
+	BatchSize      int                    `json:"batch_size,omitempty"`
+	MaxConcurrency int                    `json:"max_concurrency,omitempty"`
+	AutoRollback   bool                   `json:"auto_rollback,omitempty"`
+	RollbackWindow string                 `json:"rollback_window,omitempty"` // e.g. "24h"
+	Target         string                 `json:"target,omitempty"`          // Ditto target, defaults to the default target
+}
+
+// StartDevicePatchHandler starts a workflow that merge-patches the attributes or feature properties
+// of every thing matched by an RQL query
+func StartDevicePatchHandler(temporalClient client.Client, dittoClients *activities.DittoClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req StartDevicePatchRequest
+		defer r.Body.Close()
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.RQLQuery == "" || len(req.Patch) == 0 {
+			http.Error(w, "rql_query and patch are required", http.StatusBadRequest)
+			return
+		}
+		target, _, ok := resolveDittoTarget(w, dittoClients, req.Target)
+		if !ok {
+			return
+		}
+		if req.Path == "" {
+			req.Path = activities.DefaultDevicePatchPath
+		}
+		if err := activities.ValidateDevicePatchPath(req.Path); err != nil {
+			http.Error(w, "Invalid path: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var rollbackWindow time.Duration
+		if req.RollbackWindow != "" {
+			d, err := time.ParseDuration(req.RollbackWindow)
+			if err != nil {
+				http.Error(w, "Invalid rollback_window: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			rollbackWindow = d
+		}
+
+		params := workflow.DevicePatchParams{
+			RQLQuery:       req.RQLQuery,
+			Path:           req.Path,
+			Patch:          req.Patch,
+			Condition:      req.Condition,
+			BatchSize:      req.BatchSize,
+			MaxConcurrency: req.MaxConcurrency,
+			AutoRollback:   req.AutoRollback,
+			RollbackWindow: rollbackWindow,
+			Target:         target,
+		}
+		options := client.StartWorkflowOptions{
+			TaskQueue: config.TaskQueue,
+		}
+
+		workflowRun, err := temporalClient.ExecuteWorkflow(r.Context(), options, workflow.DevicePatchWorkflow, params)
+		if err != nil {
+			log.Printf("Failed to start workflow: %v", err)
+			http.Error(w, "Failed to start workflow", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"workflowID": workflowRun.GetID(),
+			"runID":      workflowRun.GetRunID(),
+		})
+	}
+}
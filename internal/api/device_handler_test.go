@@ -0,0 +1,34 @@
+package api
+
+import (
+	"encoding/csv"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"dm-backend/internal/workflow"
+)
+
+func TestWriteRolloutReportCSV_ListsAcknowledgedDevices(t *testing.T) {
+	report := workflow.RolloutReport{
+		InFlight:             []workflow.DeviceOutcome{{ThingId: "org.example:device-3", Status: workflow.DeviceStatusSent}},
+		Outcomes:             []workflow.DeviceOutcome{{ThingId: "org.example:device-2", Status: workflow.DeviceStatusFailed, DittoStatus: 403, Reason: "forbidden"}},
+		AcknowledgedOutcomes: []workflow.DeviceOutcome{{ThingId: "org.example:device-1", Status: workflow.DeviceStatusAcknowledged, DittoStatus: 204}},
+	}
+	rec := httptest.NewRecorder()
+	writeRolloutReportCSV(rec, report)
+
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	expected := [][]string{
+		{"thingId", "status", "dittoStatus", "reason"},
+		{"org.example:device-3", "sent", "", ""},
+		{"org.example:device-2", "failed", "403", "forbidden"},
+		{"org.example:device-1", "acknowledged", "204", ""},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected rows %v, got %v", expected, rows)
+	}
+}
@@ -0,0 +1,27 @@
+package api
+
+import (
+	"dm-backend/internal/activities"
+	"net/http"
+)
+
+// DittoErrorResponse is the body of a request that failed because Ditto rejected a call
+type DittoErrorResponse struct {
+	Error string                 `json:"error"`
+	Ditto *activities.DittoError `json:"ditto"`
+}
+
+// writeDittoError responds with the status and error code Ditto returned for client errors, with
+// 502 Bad Gateway for Ditto server errors, and with a plain 502 if Ditto could not be reached
+func writeDittoError(w http.ResponseWriter, msg string, err error) {
+	dittoErr, ok := activities.AsDittoError(err)
+	if !ok {
+		http.Error(w, msg+": "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	status := dittoErr.Status
+	if status < 400 || status >= 500 {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, DittoErrorResponse{Error: msg + ": " + dittoErr.Error(), Ditto: dittoErr})
+}
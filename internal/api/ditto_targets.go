@@ -0,0 +1,30 @@
+package api
+
+import (
+	"dm-backend/internal/activities"
+	"net/http"
+)
+
+// DittoTargetsResponse lists the configured Ditto targets
+type DittoTargetsResponse struct {
+	Default string   `json:"default"`
+	Targets []string `json:"targets"`
+}
+
+// ListDittoTargetsHandler returns the Ditto targets requests can name in their target parameter
+func ListDittoTargetsHandler(dittoClients *activities.DittoClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, DittoTargetsResponse{Default: dittoClients.DefaultTarget(), Targets: dittoClients.Targets()})
+	}
+}
+
+// resolveDittoTarget returns the name and client of the requested target, an empty target is the default one.
+// Unknown targets are answered with 400.
+func resolveDittoTarget(w http.ResponseWriter, dittoClients *activities.DittoClients, target string) (string, *activities.DittoClient, bool) {
+	name, dittoClient, err := dittoClients.Resolve(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", nil, false
+	}
+	return name, dittoClient, true
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"dm-backend/internal/activities"
+	"dm-backend/internal/config"
+	"dm-backend/internal/workflow"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/client"
+)
+
+type StartReconcileRequest struct {
+	RQLQuery          string                 `json:"rql_query"`
+	FeatureId         string                 `json:"feature_id"`
+	DesiredProperties map[string]interface{} `json:"desired_properties"`
+	PollInterval      string                 `json:"poll_interval,omitempty"` // e.g. "5m"
+	MaxRetries        int                    `json:"max_retries,omitempty"`
+	MaxConcurrency    int                    `json:"max_concurrency,omitempty"`
+	StopWhenConverged bool                   `json:"stop_when_converged,omitempty"`
+	Target            string                 `json:"target,omitempty"` // Ditto target, defaults to the default target
+}
+
+// StartReconcileHandler starts a workflow that keeps the desired properties of a feature
+// in sync with the reported properties on every thing matched by an RQL query
+func StartReconcileHandler(temporalClient client.Client, dittoClients *activities.DittoClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req StartReconcileRequest
+		defer r.Body.Close()
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.RQLQuery == "" || req.FeatureId == "" || len(req.DesiredProperties) == 0 {
+			http.Error(w, "rql_query, feature_id and desired_properties are required", http.StatusBadRequest)
+			return
+		}
+		target, _, ok := resolveDittoTarget(w, dittoClients, req.Target)
+		if !ok {
+			return
+		}
+		var pollInterval time.Duration
+		if req.PollInterval != "" {
+			d, err := time.ParseDuration(req.PollInterval)
+			if err != nil {
+				http.Error(w, "Invalid poll_interval: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			pollInterval = d
+		}
+
+		params := workflow.ReconcileParams{
+			RQLQuery:          req.RQLQuery,
+			FeatureId:         req.FeatureId,
+			DesiredProperties: req.DesiredProperties,
+			PollInterval:      pollInterval,
+			MaxRetries:        req.MaxRetries,
+			MaxConcurrency:    req.MaxConcurrency,
+			StopWhenConverged: req.StopWhenConverged,
+			Target:            target,
+		}
+		options := client.StartWorkflowOptions{
+			TaskQueue: config.TaskQueue,
+		}
+
+		workflowRun, err := temporalClient.ExecuteWorkflow(r.Context(), options, workflow.ReconcileWorkflow, params)
+		if err != nil {
+			log.Printf("Failed to start workflow: %v", err)
+			http.Error(w, "Failed to start workflow", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"workflowID": workflowRun.GetID(),
+			"runID":      workflowRun.GetRunID(),
+		})
+	}
+}
+
+// GetReconcileReportHandler returns the converged, lagging and drifting devices of a reconciliation
+func GetReconcileReportHandler(temporalClient client.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workflowID := r.PathValue("workflowID")
+		if workflowID == "" {
+			http.Error(w, "workflowID required", http.StatusBadRequest)
+			return
+		}
+
+		desc, err := temporalClient.DescribeWorkflowExecution(r.Context(), workflowID, "")
+		if err != nil {
+			log.Printf("Failed to describe workflow: %v", err)
+			http.Error(w, "failed to get workflow status", http.StatusInternalServerError)
+			return
+		}
+
+		var report workflow.ReconcileReport
+		if desc.GetWorkflowExecutionInfo().GetStatus() == enums.WORKFLOW_EXECUTION_STATUS_RUNNING {
+			resp, err := temporalClient.QueryWorkflow(r.Context(), workflowID, "", workflow.ReconcileStatusQuery)
+			if err == nil {
+				err = resp.Get(&report)
+			}
+			if err != nil {
+				log.Printf("Failed to query reconcile status: %v", err)
+				http.Error(w, "failed to query reconcile status", http.StatusInternalServerError)
+				return
+			}
+		} else if err := temporalClient.GetWorkflow(r.Context(), workflowID, "").Get(r.Context(), &report); err != nil {
+			log.Printf("Failed to get reconcile result: %v", err)
+			http.Error(w, "reconciliation did not complete: "+err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
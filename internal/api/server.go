@@ -2,6 +2,8 @@ package api
 
 import (
 	"context"
+	"dm-backend/internal/activities"
+	"dm-backend/internal/workflow"
 	"log"
 	"net/http"
 	"os"
@@ -12,11 +14,35 @@ import (
 )
 
 // RunServer initializes and starts the HTTP server
-func RunServer(temporalClient client.Client) {
+func RunServer(temporalClient client.Client, dittoClients *activities.DittoClients, templates *activities.TemplateRegistry) {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/config/start", StartMassDeviceConfigHandler(temporalClient))
+	mux.HandleFunc("/api/config/start", StartMassDeviceConfigHandler(temporalClient, dittoClients))
 	mux.HandleFunc("/api/config/status", GetWorkflowStatusHandler(temporalClient))
-	mux.HandleFunc("/api/sites/create", StartCreateSitesHandler(temporalClient))
+	mux.HandleFunc("/api/config/report", GetRolloutReportHandler(temporalClient))
+	mux.HandleFunc("POST /api/config/{workflowID}/pause", SignalRolloutHandler(temporalClient, workflow.PauseSignal))
+	mux.HandleFunc("POST /api/config/{workflowID}/resume", SignalRolloutHandler(temporalClient, workflow.ResumeSignal))
+	mux.HandleFunc("POST /api/config/{workflowID}/cancel", SignalRolloutHandler(temporalClient, workflow.AbortSignal))
+	mux.HandleFunc("POST /api/devices/patch", StartDevicePatchHandler(temporalClient, dittoClients))
+	mux.HandleFunc("POST /api/devices/patch/{workflowID}/rollback", RollbackDevicePatchHandler(temporalClient))
+	mux.HandleFunc("POST /api/reconcile/start", StartReconcileHandler(temporalClient, dittoClients))
+	mux.HandleFunc("GET /api/reconcile/{workflowID}", GetReconcileReportHandler(temporalClient))
+	mux.HandleFunc("POST /api/reconcile/{workflowID}/pause", SignalRolloutHandler(temporalClient, workflow.PauseSignal))
+	mux.HandleFunc("POST /api/reconcile/{workflowID}/resume", SignalRolloutHandler(temporalClient, workflow.ResumeSignal))
+	mux.HandleFunc("POST /api/reconcile/{workflowID}/stop", SignalRolloutHandler(temporalClient, workflow.AbortSignal))
+	mux.HandleFunc("GET /api/sites", ListSitesHandler(dittoClients))
+	mux.HandleFunc("GET /api/sites/{siteName}", GetSiteHandler(dittoClients))
+	mux.HandleFunc("POST /api/sites/create", StartCreateSitesHandler(temporalClient, dittoClients))
+	mux.HandleFunc("POST /api/sites/validate", ValidateSitesHandler(dittoClients))
+	mux.HandleFunc("GET /api/sites/batches/{workflowID}", GetSiteBatchHandler(temporalClient))
+	mux.HandleFunc("PUT /api/sites/{siteName}", UpdateSiteHandler(temporalClient, dittoClients))
+	mux.HandleFunc("DELETE /api/sites/{siteName}", DeleteSiteHandler(temporalClient, dittoClients))
+	mux.HandleFunc("GET /api/connection-templates", ListConnectionTemplatesHandler(templates))
+	mux.HandleFunc("POST /api/connection-templates", CreateConnectionTemplateHandler(templates))
+	mux.HandleFunc("GET /api/connection-templates/{name}", GetConnectionTemplateHandler(templates))
+	mux.HandleFunc("PUT /api/connection-templates/{name}", UpdateConnectionTemplateHandler(templates))
+	mux.HandleFunc("DELETE /api/connection-templates/{name}", DeleteConnectionTemplateHandler(templates, dittoClients))
+	mux.HandleFunc("GET /api/connection-templates/{name}/versions", ListConnectionTemplateVersionsHandler(templates))
+	mux.HandleFunc("GET /api/ditto/targets", ListDittoTargetsHandler(dittoClients))
 	mux.HandleFunc("/api/ditto/incoming", DittoIncomingHandler(temporalClient))
 	mux.Handle("/swagger/", http.StripPrefix("/swagger/", http.FileServer(http.Dir("docs"))))
 
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"dm-backend/internal/models"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const maxSiteUploadSize = 10 << 20
+
+// siteCSVColumns sets a site field from a CSV cell, keyed by the normalized column name (see normalizeCSVColumn)
+var siteCSVColumns = map[string]func(site *models.Site, value string) error{
+	"sitename":       func(s *models.Site, v string) error { s.SiteName = v; return nil },
+	"protocol":       func(s *models.Site, v string) error { s.Protocol = v; return nil },
+	"template":       func(s *models.Site, v string) error { s.Template = v; return nil },
+	"host":           func(s *models.Site, v string) error { s.Host = v; return nil },
+	"port":           func(s *models.Site, v string) error { s.Port = v; return nil },
+	"username":       func(s *models.Site, v string) error { s.Username = v; return nil },
+	"password":       func(s *models.Site, v string) error { s.Password = v; return nil },
+	"passwordsecret": func(s *models.Site, v string) error { s.PasswordSecret = v; return nil },
+	"description":    func(s *models.Site, v string) error { s.Description = v; return nil },
+	"sourceaddress":  func(s *models.Site, v string) error { s.SourceAddress = v; return nil },
+	"targetaddress":  func(s *models.Site, v string) error { s.TargetAddress = v; return nil },
+	"tls": func(s *models.Site, v string) error {
+		if v == "" {
+			return nil
+		}
+		tls, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("tls must be true or false, got %q", v)
+		}
+		s.TLS = tls
+		return nil
+	},
+}
+
+// defaultSiteCSVColumns is the column order of CSV files without a header row
+var defaultSiteCSVColumns = []string{"sitename", "host", "port", "username", "password", "description"}
+
+// errInvalidSiteRows is returned by decodeSites together with the row errors
+var errInvalidSiteRows = errors.New("invalid rows")
+
+// decodeSites reads the sites of a request as JSON array, text/csv, or a multipart upload of either in the
+// form field "file". For CSV input lines holds the line number of each site, row problems are returned as
+// SiteValidation with errInvalidSiteRows.
+func decodeSites(w http.ResponseWriter, r *http.Request) (sites []models.Site, lines []int, rowErrors []SiteValidation, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSiteUploadSize)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return parseSitesCSV(r.Body)
+	case "multipart/form-data":
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("multipart upload must contain the form field \"file\": %w", err)
+		}
+		defer file.Close()
+		partType, _, _ := mime.ParseMediaType(header.Header.Get("Content-Type"))
+		if partType == "application/json" || strings.EqualFold(filepath.Ext(header.Filename), ".json") {
+			sites, err := decodeSitesJSON(file)
+			return sites, nil, nil, err
+		}
+		return parseSitesCSV(file)
+	default:
+		sites, err := decodeSitesJSON(r.Body)
+		return sites, nil, nil, err
+	}
+}
+
+func decodeSitesJSON(r io.Reader) ([]models.Site, error) {
+	var sites []models.Site
+	if err := decodeSiteJSON(r, &sites); err != nil {
+		return nil, err
+	}
+	return sites, nil
+}
+
+// decodeSiteJSON decodes the sites of a create or update request, rejecting unknown fields so a
+// misspelled field is not silently dropped
+func decodeSiteJSON(r io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON input: %w", err)
+	}
+	return nil
+}
+
+// parseSitesCSV maps the CSV columns to site fields. A first row consisting of known column names is
+// the header, matched case-insensitively ignoring spaces, '-' and '_' (e.g. "Site Name", "site_name").
+// Without header the columns are siteName, host, port, username, password, description.
+// Empty rows and rows starting with '#' are skipped.
+func parseSitesCSV(r io.Reader) ([]models.Site, []int, []SiteValidation, error) {
+	reader := csv.NewReader(skipBOM(r))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	var sites []models.Site
+	var lines []int
+	var rowErrors []SiteValidation
+	var columns []string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		if columns == nil {
+			header, err := parseSiteCSVHeader(record)
+			if err != nil {
+				rowErrors = append(rowErrors, SiteValidation{Line: line, Errors: []string{err.Error()}})
+				return nil, nil, rowErrors, errInvalidSiteRows
+			}
+			if header != nil {
+				columns = header
+				continue
+			}
+			columns = defaultSiteCSVColumns
+		}
+		if isEmptyCSVRecord(record) {
+			continue
+		}
+
+		var site models.Site
+		var problems []string
+		if len(record) > len(columns) {
+			problems = append(problems, fmt.Sprintf("row has %d fields, expected at most %d", len(record), len(columns)))
+		}
+		for i, value := range record {
+			if i >= len(columns) {
+				break
+			}
+			if err := siteCSVColumns[columns[i]](&site, strings.TrimSpace(value)); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if len(problems) > 0 {
+			rowErrors = append(rowErrors, SiteValidation{SiteName: site.SiteName, Line: line, Errors: problems})
+		}
+		sites = append(sites, site)
+		lines = append(lines, line)
+	}
+	if len(rowErrors) > 0 {
+		return nil, nil, rowErrors, errInvalidSiteRows
+	}
+	if len(sites) == 0 {
+		return nil, nil, nil, errors.New("CSV contains no sites")
+	}
+	return sites, lines, nil, nil
+}
+
+// parseSiteCSVHeader returns the normalized columns if the record is a header row, nil if it is a data row.
+// Only a row made entirely of column names is a header, so data values like "tls" do not turn a row into one.
+// A row starting with siteName that has unknown columns is a header with a typo and is rejected.
+func parseSiteCSVHeader(record []string) ([]string, error) {
+	columns := make([]string, len(record))
+	var unknown []string
+	for i, cell := range record {
+		columns[i] = normalizeCSVColumn(cell)
+		if _, ok := siteCSVColumns[columns[i]]; !ok {
+			unknown = append(unknown, strconv.Quote(cell))
+		}
+	}
+	if len(unknown) > 0 {
+		if columns[0] == "sitename" {
+			return nil, fmt.Errorf("unknown columns %s in header", strings.Join(unknown, ", "))
+		}
+		return nil, nil
+	}
+	seen := map[string]bool{}
+	for _, column := range columns {
+		if seen[column] {
+			return nil, fmt.Errorf("column %s appears more than once in header", column)
+		}
+		seen[column] = true
+	}
+	if !seen["sitename"] {
+		return nil, errors.New("header has no siteName column")
+	}
+	return columns, nil
+}
+
+func normalizeCSVColumn(name string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "_", "", "-", "").Replace(strings.TrimSpace(name)))
+}
+
+func isEmptyCSVRecord(record []string) bool {
+	for _, value := range record {
+		if strings.TrimSpace(value) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// skipBOM drops the UTF-8 byte order mark spreadsheet programs put at the start of CSV exports
+func skipBOM(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(3); err == nil && bytes.Equal(bom, []byte{0xEF, 0xBB, 0xBF}) {
+		br.Discard(3)
+	}
+	return br
+}
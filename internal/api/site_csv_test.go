@@ -0,0 +1,143 @@
+package api
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dm-backend/internal/models"
+)
+
+func TestParseSitesCSV(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		input     string
+		sites     []models.Site
+		lines     []int
+		rowErrors []SiteValidation
+		err       string // substring of the error, empty if none is expected
+	}{
+		{
+			name:  "header",
+			input: "Site Name,host,PORT,tls,password_secret\nsite1,broker,1883,true,site1-password\n",
+			sites: []models.Site{{SiteName: "site1", Host: "broker", Port: "1883", TLS: true, PasswordSecret: "site1-password"}},
+			lines: []int{2},
+		},
+		{
+			name:  "header with byte order mark",
+			input: "\xEF\xBB\xBFsiteName,host\nsite1,broker\n",
+			sites: []models.Site{{SiteName: "site1", Host: "broker"}},
+			lines: []int{2},
+		},
+		{
+			name:  "headerless",
+			input: "site1, broker ,1883,user,secret,first site\nsite2,broker2\n",
+			sites: []models.Site{
+				{SiteName: "site1", Host: "broker", Port: "1883", Username: "user", Password: "secret", Description: "first site"},
+				{SiteName: "site2", Host: "broker2"},
+			},
+			lines: []int{1, 2},
+		},
+		{
+			name:  "headerless with byte order mark",
+			input: "\xEF\xBB\xBFsite1,broker\n",
+			sites: []models.Site{{SiteName: "site1", Host: "broker"}},
+			lines: []int{1},
+		},
+		{
+			name:  "headerless first row with a column name as value",
+			input: "site1,tls,1883\nsite2,broker\n",
+			sites: []models.Site{{SiteName: "site1", Host: "tls", Port: "1883"}, {SiteName: "site2", Host: "broker"}},
+			lines: []int{1, 2},
+		},
+		{
+			name:  "comments and empty rows keep line numbers",
+			input: "# sites of plant 1\nsiteName,host\n\nsite1,broker\n,\nsite2,broker\n",
+			sites: []models.Site{{SiteName: "site1", Host: "broker"}, {SiteName: "site2", Host: "broker"}},
+			lines: []int{4, 6},
+		},
+		{
+			name:  "bad rows",
+			input: "siteName,tls\nsite1,maybe\nsite2,true,extra\nsite3,false\n",
+			rowErrors: []SiteValidation{
+				{SiteName: "site1", Line: 2, Errors: []string{`tls must be true or false, got "maybe"`}},
+				{SiteName: "site2", Line: 3, Errors: []string{"row has 3 fields, expected at most 2"}},
+			},
+			err: errInvalidSiteRows.Error(),
+		},
+		{
+			name:      "unknown header column",
+			input:     "# export\nsiteName,colour\nsite1,red\n",
+			rowErrors: []SiteValidation{{Line: 2, Errors: []string{`unknown columns "colour" in header`}}},
+			err:       errInvalidSiteRows.Error(),
+		},
+		{
+			name:  "no sites",
+			input: "siteName,host\n# none yet\n",
+			err:   "CSV contains no sites",
+		},
+		{
+			name:  "malformed CSV",
+			input: "siteName,host\nsite1,\"broker\n",
+			err:   "invalid CSV",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sites, lines, rowErrors, err := parseSitesCSV(strings.NewReader(tc.input))
+			if tc.err == "" && err != nil {
+				t.Fatalf("parseSitesCSV failed: %v", err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("expected error %q, got %v", tc.err, err)
+			}
+			if !reflect.DeepEqual(sites, tc.sites) {
+				t.Errorf("expected sites %+v, got %+v", tc.sites, sites)
+			}
+			if !reflect.DeepEqual(lines, tc.lines) {
+				t.Errorf("expected lines %v, got %v", tc.lines, lines)
+			}
+			if !reflect.DeepEqual(rowErrors, tc.rowErrors) {
+				t.Errorf("expected row errors %+v, got %+v", tc.rowErrors, rowErrors)
+			}
+		})
+	}
+}
+
+func TestParseSiteCSVHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		record  []string
+		columns []string // nil for a data row
+		err     string
+	}{
+		{"known columns", []string{"siteName", "Host", "port"}, []string{"sitename", "host", "port"}, ""},
+		{"spaces, dashes and underscores", []string{" Site Name ", "password-secret", "SOURCE_ADDRESS"}, []string{"sitename", "passwordsecret", "sourceaddress"}, ""},
+		{"data row", []string{"site1", "broker", "1883"}, nil, ""},
+		{"data row with column names as values", []string{"site1", "tls", "1883"}, nil, ""},
+		{"data row of a host named like a column", []string{"host", "broker"}, nil, ""},
+		{"unknown column", []string{"siteName", "colour"}, nil, `unknown columns "colour" in header`},
+		{"duplicate column", []string{"siteName", "host", "Host"}, nil, "column host appears more than once in header"},
+		{"no siteName column", []string{"host", "port"}, nil, "header has no siteName column"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			columns, err := parseSiteCSVHeader(tc.record)
+			if tc.err == "" && err != nil {
+				t.Fatalf("parseSiteCSVHeader failed: %v", err)
+			}
+			if tc.err != "" && (err == nil || err.Error() != tc.err) {
+				t.Fatalf("expected error %q, got %v", tc.err, err)
+			}
+			if !reflect.DeepEqual(columns, tc.columns) {
+				t.Errorf("expected columns %v, got %v", tc.columns, columns)
+			}
+		})
+	}
+}
+
+func TestParseSitesCSV_ReturnsErrInvalidSiteRows(t *testing.T) {
+	_, _, rowErrors, err := parseSitesCSV(strings.NewReader("siteName,port,tls\nsite1,1883,yes\n"))
+	if !errors.Is(err, errInvalidSiteRows) || len(rowErrors) != 1 {
+		t.Fatalf("expected errInvalidSiteRows with one row error, got %v (%+v)", err, rowErrors)
+	}
+}
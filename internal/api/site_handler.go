@@ -1,42 +1,277 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"dm-backend/internal/activities"
 	"dm-backend/internal/config"
+	"dm-backend/internal/models"
 	"dm-backend/internal/workflow"
 
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
 	"go.temporal.io/sdk/client"
 )
 
-func StartCreateSitesHandler(temporalClient client.Client) http.HandlerFunc {
+// Site creation statuses reported by StartCreateSitesHandler
+const (
+	SiteCreationStarted    = "started"
+	SiteCreationInProgress = workflow.SiteStatusInProgress // another workflow is creating the site
+	SiteCreationExists     = workflow.SiteStatusExists     // the gateway thing of the site exists
+)
+
+// SiteCreation reports what a create request did for one site
+type SiteCreation struct {
+	SiteName   string `json:"siteName"`
+	Status     string `json:"status"`
+	WorkflowID string `json:"workflowID,omitempty"` // CreateSiteWorkflow of the site, if started or in progress
+	ThingId    string `json:"thingId,omitempty"`    // gateway thing of an existing site
+}
+
+// CreateSitesResponse is returned by StartCreateSitesHandler, WorkflowID is empty if no site had to be created
+type CreateSitesResponse struct {
+	WorkflowID string         `json:"workflowID,omitempty"`
+	RunID      string         `json:"runID,omitempty"`
+	Sites      []SiteCreation `json:"sites"`
+}
+
+// StartCreateSitesHandler starts a batch workflow for the sites that neither exist nor are being created.
+// Sites are sent as JSON array, as text/csv or as multipart upload in the form field "file".
+// The max_concurrency query parameter limits the sites created at the same time (default 10), target selects
+// the Ditto target. Responds with 409 if there is nothing to create or the same batch is already running.
+func StartCreateSitesHandler(temporalClient client.Client, dittoClients *activities.DittoClients) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var params workflow.CreateSiteBatchWorkflowParams
-		if err := json.NewDecoder(r.Body).Decode(&params.Sites); err != nil {
-			http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		target, dittoClient, ok := resolveDittoTarget(w, dittoClients, r.URL.Query().Get("target"))
+		if !ok {
+			return
+		}
+		params := workflow.CreateSiteBatchWorkflowParams{Target: target}
+		if raw := r.URL.Query().Get("max_concurrency"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 {
+				http.Error(w, "max_concurrency must be a positive number", http.StatusBadRequest)
+				return
+			}
+			params.MaxConcurrency = n
+		}
+		sites, lines, rowErrors, err := decodeSites(w, r)
+		if err != nil {
+			writeDecodeSitesError(w, rowErrors, err)
+			return
+		}
+		if results, valid := validateSites(dittoClient, sites, lines); !valid {
+			writeJSON(w, http.StatusBadRequest, results)
 			return
 		}
 
-		options := client.StartWorkflowOptions{
-			TaskQueue: config.TaskQueue,
+		response, err := siteCreationStatuses(r.Context(), temporalClient, dittoClient, target, sites)
+		if err != nil {
+			log.Printf("Failed to check existing sites: %v", err)
+			writeDittoError(w, "Failed to check existing sites", err)
+			return
+		}
+		for i, site := range sites {
+			if response.Sites[i].Status == SiteCreationStarted {
+				params.Sites = append(params.Sites, site)
+			}
+		}
+		if len(params.Sites) == 0 {
+			writeJSON(w, http.StatusConflict, response)
+			return
 		}
 
-		workflowRun, err := temporalClient.ExecuteWorkflow(
-			r.Context(),
-			options,
-			workflow.CreateSiteBatchWorkflow,
-			params,
-		)
+		options := client.StartWorkflowOptions{
+			ID:                                       workflow.CreateSiteBatchWorkflowID(target, params.Sites),
+			TaskQueue:                                config.TaskQueue,
+			WorkflowIDReusePolicy:                    enumspb.WORKFLOW_ID_REUSE_POLICY_ALLOW_DUPLICATE,
+			WorkflowIDConflictPolicy:                 enumspb.WORKFLOW_ID_CONFLICT_POLICY_FAIL,
+			WorkflowExecutionErrorWhenAlreadyStarted: true,
+		}
+		workflowRun, err := temporalClient.ExecuteWorkflow(r.Context(), options, workflow.CreateSiteBatchWorkflow, params)
+		var alreadyStarted *serviceerror.WorkflowExecutionAlreadyStarted
+		if errors.As(err, &alreadyStarted) {
+			response.WorkflowID, response.RunID = options.ID, alreadyStarted.RunId
+			for i := range response.Sites {
+				if response.Sites[i].Status == SiteCreationStarted {
+					response.Sites[i].Status = SiteCreationInProgress
+				}
+			}
+			writeJSON(w, http.StatusConflict, response)
+			return
+		}
 		if err != nil {
 			http.Error(w, "Failed to start batch workflow: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		response.WorkflowID, response.RunID = workflowRun.GetID(), workflowRun.GetRunID()
+		writeJSON(w, http.StatusAccepted, response)
+	}
+}
+
+// GetSiteBatchHandler returns the progress of a running site batch, or the summary once it completed
+func GetSiteBatchHandler(temporalClient client.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workflowID := r.PathValue("workflowID")
+		desc, err := temporalClient.DescribeWorkflowExecution(r.Context(), workflowID, "")
+		var notFound *serviceerror.NotFound
+		if errors.As(err, &notFound) {
+			http.Error(w, "batch not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to describe workflow: %v", err)
+			http.Error(w, "failed to get workflow status", http.StatusInternalServerError)
+			return
+		}
+
+		var summary workflow.CreateSiteBatchSummary
+		if desc.GetWorkflowExecutionInfo().GetStatus() == enumspb.WORKFLOW_EXECUTION_STATUS_RUNNING {
+			resp, err := temporalClient.QueryWorkflow(r.Context(), workflowID, "", workflow.CreateSiteBatchProgressQuery)
+			if err == nil {
+				err = resp.Get(&summary)
+			}
+			if err != nil {
+				log.Printf("Failed to query batch progress: %v", err)
+				http.Error(w, "failed to query batch progress", http.StatusInternalServerError)
+				return
+			}
+		} else if err := temporalClient.GetWorkflow(r.Context(), workflowID, "").Get(r.Context(), &summary); err != nil {
+			log.Printf("Failed to get batch result: %v", err)
+			http.Error(w, "batch did not complete: "+err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusOK, summary)
+	}
+}
+
+// siteCreationStatuses reports for each site whether its gateway thing exists, a CreateSiteWorkflow is
+// running for it, or it has to be created
+func siteCreationStatuses(ctx context.Context, temporalClient client.Client, dittoClient *activities.DittoClient, target string, sites []models.Site) (CreateSitesResponse, error) {
+	existing, err := existingSiteThings(ctx, dittoClient, sites)
+	if err != nil {
+		return CreateSitesResponse{}, err
+	}
+	response := CreateSitesResponse{Sites: make([]SiteCreation, len(sites))}
+	for i, site := range sites {
+		result := SiteCreation{SiteName: site.SiteName, Status: SiteCreationStarted, WorkflowID: workflow.CreateSiteWorkflowID(target, site.SiteName)}
+		if thingID, ok := existing[site.SiteName]; ok {
+			result.Status, result.ThingId, result.WorkflowID = SiteCreationExists, thingID, ""
+		} else {
+			description, err := temporalClient.DescribeWorkflowExecution(ctx, result.WorkflowID, "")
+			var notFound *serviceerror.NotFound
+			switch {
+			case errors.As(err, &notFound):
+			case err != nil:
+				return CreateSitesResponse{}, fmt.Errorf("failed to describe workflow %s: %w", result.WorkflowID, err)
+			case description.GetWorkflowExecutionInfo().GetStatus() == enumspb.WORKFLOW_EXECUTION_STATUS_RUNNING:
+				result.Status = SiteCreationInProgress
+			}
+		}
+		response.Sites[i] = result
+	}
+	return response, nil
+}
+
+// existingSiteThings returns the gateway thing IDs of the sites that exist, keyed by site name
+func existingSiteThings(ctx context.Context, dittoClient *activities.DittoClient, sites []models.Site) (map[string]string, error) {
+	names := make([]string, len(sites))
+	for i, site := range sites {
+		names[i] = strconv.Quote(site.SiteName)
+	}
+	existing := map[string]string{}
+	params := activities.SearchThingsParams{
+		Filter:   fmt.Sprintf("in(attributes/siteName,%s)", strings.Join(names, ",")),
+		Fields:   []string{"thingId", "attributes/siteName"},
+		PageSize: 200,
+	}
+	for {
+		page, err := dittoClient.FetchDevicePage(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		for _, thing := range page.Items {
+			siteName, _ := thing.Attributes["siteName"].(string)
+			existing[siteName] = thing.ThingId
+		}
+		if page.Cursor == "" {
+			return existing, nil
+		}
+		params.Cursor = page.Cursor
+	}
+}
+
+// UpdateSiteHandler starts a workflow that updates the connection, policy entry and attributes of a site
+func UpdateSiteHandler(temporalClient client.Client, dittoClients *activities.DittoClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target, dittoClient, ok := resolveDittoTarget(w, dittoClients, r.URL.Query().Get("target"))
+		if !ok {
+			return
+		}
+		siteName := r.PathValue("siteName")
+		var site models.Site
+		if err := decodeSiteJSON(r.Body, &site); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if site.SiteName != "" && site.SiteName != siteName {
+			http.Error(w, "siteName in body does not match the path", http.StatusBadRequest)
+			return
+		}
+		site.SiteName = siteName
+		if results, valid := validateSites(dittoClient, []models.Site{site}, nil); !valid {
+			writeJSON(w, http.StatusBadRequest, results[0])
+			return
+		}
+
+		options := client.StartWorkflowOptions{
+			TaskQueue: config.TaskQueue,
+		}
+		workflowRun, err := temporalClient.ExecuteWorkflow(r.Context(), options, workflow.UpdateSiteWorkflow, workflow.UpdateSiteParams{Site: site, Target: target})
+		if err != nil {
+			http.Error(w, "Failed to start update workflow: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeSiteWorkflowStarted(w, workflowRun)
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"workflowID": workflowRun.GetID(),
-			"runID":      workflowRun.GetRunID(),
-		})
+// DeleteSiteHandler starts a workflow that decommissions a site
+func DeleteSiteHandler(temporalClient client.Client, dittoClients *activities.DittoClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target, _, ok := resolveDittoTarget(w, dittoClients, r.URL.Query().Get("target"))
+		if !ok {
+			return
+		}
+		params := workflow.DeleteSiteParams{SiteName: r.PathValue("siteName"), Target: target}
+		if err := models.ValidateSiteName(params.SiteName); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		options := client.StartWorkflowOptions{
+			TaskQueue: config.TaskQueue,
+		}
+		workflowRun, err := temporalClient.ExecuteWorkflow(r.Context(), options, workflow.DeleteSiteWorkflow, params)
+		if err != nil {
+			http.Error(w, "Failed to start delete workflow: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeSiteWorkflowStarted(w, workflowRun)
 	}
 }
+
+func writeSiteWorkflowStarted(w http.ResponseWriter, workflowRun client.WorkflowRun) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"workflowID": workflowRun.GetID(),
+		"runID":      workflowRun.GetRunID(),
+	})
+}
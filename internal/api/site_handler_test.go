@@ -0,0 +1,32 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"dm-backend/internal/activities"
+)
+
+func TestUpdateSiteHandler_RejectsUnknownFields(t *testing.T) {
+	clients, err := activities.NewDittoClients("default", map[string]*activities.DittoClient{"default": {Host: "localhost:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	// No workflow is started for a rejected request, so no Temporal client is needed
+	mux.HandleFunc("PUT /api/sites/{siteName}", UpdateSiteHandler(nil, clients))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/sites/site1", strings.NewReader(`{"host":"broker","passwordSecert":"site1-password"}`)))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `unknown field "passwordSecert"`) {
+		t.Errorf("expected 400 naming the unknown field, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestDecodeSitesJSON_RejectsUnknownFields(t *testing.T) {
+	if _, err := decodeSitesJSON(strings.NewReader(`[{"siteName":"site1","hots":"broker"}]`)); err == nil || !strings.Contains(err.Error(), `unknown field "hots"`) {
+		t.Errorf("expected an unknown field error, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"dm-backend/internal/activities"
+	"dm-backend/internal/models"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultSitePageSize = 20
+
+// SiteView combines the gateway thing of a site with its connection
+type SiteView struct {
+	SiteName    string                 `json:"siteName"`
+	Description string                 `json:"description,omitempty"`
+	ThingId     string                 `json:"thingId"`
+	PolicyId    string                 `json:"policyId,omitempty"`
+	Attributes  map[string]interface{} `json:"attributes,omitempty"`
+	Connection  *SiteConnectionView    `json:"connection,omitempty"` // nil if the site has no connection
+}
+
+// SiteConnectionView is the connection of a site with its live status
+type SiteConnectionView struct {
+	activities.ConnectionSummary
+	LiveStatus  string `json:"liveStatus,omitempty"`
+	StatusError string `json:"statusError,omitempty"` // set if the live status could not be retrieved
+}
+
+// SiteList is a page of sites, pass Cursor to get the next page
+type SiteList struct {
+	Items  []SiteView `json:"items"`
+	Cursor string     `json:"cursor,omitempty"`
+}
+
+// ListSitesHandler lists the sites page by page.
+// Query parameters: name (substring of the site name), filter (additional RQL filter on the gateway thing),
+// page_size (default 20, max 200), cursor (from the previous page) and target (Ditto target, defaults to the default target).
+func ListSitesHandler(dittoClients *activities.DittoClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		_, dittoClient, ok := resolveDittoTarget(w, dittoClients, query.Get("target"))
+		if !ok {
+			return
+		}
+		pageSize := defaultSitePageSize
+		if raw := query.Get("page_size"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 {
+				http.Error(w, "page_size must be a positive number", http.StatusBadRequest)
+				return
+			}
+			pageSize = n
+		}
+
+		filters := []string{"exists(attributes/siteName)"}
+		if name := query.Get("name"); name != "" {
+			filters = append(filters, fmt.Sprintf(`like(attributes/siteName,%q)`, "*"+name+"*"))
+		}
+		if filter := query.Get("filter"); filter != "" {
+			filters = append(filters, filter)
+		}
+
+		page, err := dittoClient.FetchDevicePage(r.Context(), activities.SearchThingsParams{
+			Filter:   "and(" + strings.Join(filters, ",") + ")",
+			Fields:   []string{"thingId", "policyId", "attributes"},
+			PageSize: pageSize,
+			Cursor:   query.Get("cursor"),
+		})
+		if err != nil {
+			log.Printf("Failed to search sites: %v", err)
+			writeDittoError(w, "Failed to search sites", err)
+			return
+		}
+		sites, err := siteViews(r.Context(), dittoClient, page.Items)
+		if err != nil {
+			log.Printf("Failed to list connections: %v", err)
+			writeDittoError(w, "Failed to list connections", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SiteList{Items: sites, Cursor: page.Cursor})
+	}
+}
+
+// GetSiteHandler returns a single site by name
+func GetSiteHandler(dittoClients *activities.DittoClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, dittoClient, ok := resolveDittoTarget(w, dittoClients, r.URL.Query().Get("target"))
+		if !ok {
+			return
+		}
+		siteName := r.PathValue("siteName")
+		page, err := dittoClient.FetchDevicePage(r.Context(), activities.SearchThingsParams{
+			Filter:   fmt.Sprintf(`eq(attributes/siteName,%q)`, siteName),
+			Fields:   []string{"thingId", "policyId", "attributes"},
+			PageSize: 1,
+		})
+		if err != nil {
+			log.Printf("Failed to search site %s: %v", siteName, err)
+			writeDittoError(w, "Failed to search site", err)
+			return
+		}
+		if len(page.Items) == 0 {
+			http.Error(w, "site not found", http.StatusNotFound)
+			return
+		}
+		sites, err := siteViews(r.Context(), dittoClient, page.Items)
+		if err != nil {
+			log.Printf("Failed to list connections: %v", err)
+			writeDittoError(w, "Failed to list connections", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sites[0])
+	}
+}
+
+// siteViews joins the gateway things with their connections and fetches the live status of each connection
+func siteViews(ctx context.Context, dittoClient *activities.DittoClient, things []models.Device) ([]SiteView, error) {
+	connections, err := dittoClient.ListConnections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	connectionsByName := make(map[string]activities.ConnectionSummary, len(connections))
+	for _, connection := range connections {
+		connectionsByName[connection.Name] = connection
+	}
+
+	sites := make([]SiteView, len(things))
+	var wg sync.WaitGroup
+	for i, thing := range things {
+		siteName, _ := thing.Attributes["siteName"].(string)
+		description, _ := thing.Attributes["siteDescription"].(string)
+		sites[i] = SiteView{
+			SiteName:    siteName,
+			Description: description,
+			ThingId:     thing.ThingId,
+			PolicyId:    thing.PolicyId,
+			Attributes:  thing.Attributes,
+		}
+		connection, ok := connectionsByName[models.SiteConnectionName(siteName)]
+		if !ok {
+			continue
+		}
+		view := &SiteConnectionView{ConnectionSummary: connection}
+		sites[i].Connection = view
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, err := dittoClient.GetConnectionStatus(ctx, activities.GetConnectionStatusParams{ConnectionID: connection.ID})
+			if err != nil {
+				view.StatusError = err.Error()
+				return
+			}
+			view.LiveStatus = status
+		}()
+	}
+	wg.Wait()
+	return sites, nil
+}
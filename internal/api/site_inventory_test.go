@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dm-backend/internal/activities"
+)
+
+// newStubSiteDitto serves the gateway things of site1 and site2 on two search pages, a connection
+// for each with a live status for site1's only, and records the search requests
+func newStubSiteDitto(t *testing.T) (*activities.DittoClients, *[]*http.Request) {
+	var searches []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/2/search/things":
+			searches = append(searches, r)
+			query := r.URL.Query()
+			if strings.Contains(query.Get("filter"), "missing") {
+				w.Write([]byte(`{"items":[]}`))
+				return
+			}
+			if query.Get("option") == "size(1),cursor(c1)" {
+				w.Write([]byte(`{"items":[{"thingId":"gateway:site2","policyId":"gateway:site2-policy","attributes":{"siteName":"site2"}}]}`))
+				return
+			}
+			w.Write([]byte(`{"items":[{"thingId":"gateway:site1","policyId":"gateway:site1-policy","attributes":{"siteName":"site1","siteDescription":"plant 1"}}],"cursor":"c1"}`))
+		case "/api/2/connections":
+			w.Write([]byte(`[{"id":"c-1","name":"site1-conn","connectionType":"mqtt-5","connectionStatus":"open"},{"id":"c-2","name":"site2-conn","connectionStatus":"closed"}]`))
+		case "/api/2/connections/c-1/status":
+			w.Write([]byte(`{"liveStatus":"open"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status":404,"error":"connectivity:connection.notfound","message":"not found"}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	clients, err := activities.NewDittoClients("default", map[string]*activities.DittoClient{
+		"default": {Host: strings.TrimPrefix(srv.URL, "http://")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clients, &searches
+}
+
+func TestListSitesHandler_FiltersAndPages(t *testing.T) {
+	clients, searches := newStubSiteDitto(t)
+	handler := ListSitesHandler(clients)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", `/api/sites?name=site&filter=eq(attributes/region,"eu")&page_size=1`, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var first SiteList
+	json.NewDecoder(rec.Body).Decode(&first)
+	query := (*searches)[0].URL.Query()
+	if filter := query.Get("filter"); filter != `and(exists(attributes/siteName),like(attributes/siteName,"*site*"),eq(attributes/region,"eu"))` {
+		t.Errorf("unexpected search filter %q", filter)
+	}
+	if option := query.Get("option"); option != "size(1)" {
+		t.Errorf("expected option size(1), got %q", option)
+	}
+	expected := SiteList{
+		Items: []SiteView{{
+			SiteName:    "site1",
+			Description: "plant 1",
+			ThingId:     "gateway:site1",
+			PolicyId:    "gateway:site1-policy",
+			Attributes:  map[string]interface{}{"siteName": "site1", "siteDescription": "plant 1"},
+			Connection: &SiteConnectionView{
+				ConnectionSummary: activities.ConnectionSummary{ID: "c-1", Name: "site1-conn", ConnectionType: "mqtt-5", ConnectionStatus: "open"},
+				LiveStatus:        "open",
+			},
+		}},
+		Cursor: "c1",
+	}
+	if !reflect.DeepEqual(first, expected) {
+		t.Errorf("expected %+v, got %+v", expected, first)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/api/sites?page_size=1&cursor=c1", nil))
+	var second SiteList
+	json.NewDecoder(rec.Body).Decode(&second)
+	if len(second.Items) != 1 || second.Items[0].SiteName != "site2" || second.Cursor != "" {
+		t.Fatalf("expected site2 on the last page, got %+v", second)
+	}
+	if connection := second.Items[0].Connection; connection == nil || connection.LiveStatus != "" || connection.StatusError == "" {
+		t.Errorf("expected the live status error of site2's connection, got %+v", connection)
+	}
+}
+
+func TestListSitesHandler_RejectsInvalidPageSize(t *testing.T) {
+	clients, searches := newStubSiteDitto(t)
+	rec := httptest.NewRecorder()
+	ListSitesHandler(clients)(rec, httptest.NewRequest("GET", "/api/sites?page_size=0", nil))
+	if rec.Code != http.StatusBadRequest || len(*searches) != 0 {
+		t.Errorf("expected 400 without searching, got %d and %d searches", rec.Code, len(*searches))
+	}
+}
+
+func TestGetSiteHandler(t *testing.T) {
+	clients, searches := newStubSiteDitto(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/sites/{siteName}", GetSiteHandler(clients))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/sites/site1", nil))
+	var site SiteView
+	json.NewDecoder(rec.Body).Decode(&site)
+	if rec.Code != http.StatusOK || site.ThingId != "gateway:site1" || site.Connection == nil || site.Connection.LiveStatus != "open" {
+		t.Errorf("expected site1 with its live connection status, got %d %+v", rec.Code, site)
+	}
+	if filter := (*searches)[0].URL.Query().Get("filter"); filter != `eq(attributes/siteName,"site1")` {
+		t.Errorf("unexpected search filter %q", filter)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/sites/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown site, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"dm-backend/internal/activities"
+	"dm-backend/internal/models"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// SiteValidation is the validation result of one site
+type SiteValidation struct {
+	SiteName string   `json:"siteName"`
+	Line     int      `json:"line,omitempty"` // line of the site in an uploaded CSV file
+	Valid    bool     `json:"valid"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// validateSites checks the site fields and renders each site's connection template with its
+// placeholders and secrets, so bad input is rejected before any Ditto resources are created.
+// lines holds the CSV line of each site, nil for JSON input.
+func validateSites(dittoClient *activities.DittoClient, sites []models.Site, lines []int) ([]SiteValidation, bool) {
+	results := make([]SiteValidation, len(sites))
+	seen := map[string]bool{}
+	allValid := true
+	for i, site := range sites {
+		var problems []string
+		if err := site.Validate(); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if err := dittoClient.ValidateConnection(site.TemplateName(), site.ConnectionPlaceholders(""), site.ConnectionSecrets()); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if seen[site.SiteName] {
+			problems = append(problems, fmt.Sprintf("site %q is listed more than once", site.SiteName))
+		}
+		seen[site.SiteName] = true
+		results[i] = SiteValidation{SiteName: site.SiteName, Valid: len(problems) == 0, Errors: problems}
+		if lines != nil {
+			results[i].Line = lines[i]
+		}
+		allValid = allValid && results[i].Valid
+	}
+	return results, allValid
+}
+
+// ValidateSitesHandler validates a list of sites, as JSON or CSV, without creating anything
+func ValidateSitesHandler(dittoClients *activities.DittoClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, dittoClient, ok := resolveDittoTarget(w, dittoClients, r.URL.Query().Get("target"))
+		if !ok {
+			return
+		}
+		sites, lines, rowErrors, err := decodeSites(w, r)
+		if err != nil {
+			writeDecodeSitesError(w, rowErrors, err)
+			return
+		}
+		results, _ := validateSites(dittoClient, sites, lines)
+		writeJSON(w, http.StatusOK, results)
+	}
+}
+
+// writeDecodeSitesError responds with the row errors of a CSV upload, or the error if the input could not be read
+func writeDecodeSitesError(w http.ResponseWriter, rowErrors []SiteValidation, err error) {
+	if errors.Is(err, errInvalidSiteRows) {
+		writeJSON(w, http.StatusBadRequest, rowErrors)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
@@ -0,0 +1,104 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	commonpb "go.temporal.io/api/common/v1"
+	"go.temporal.io/sdk/converter"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// MetadataEncodingEncrypted marks payloads encrypted by EncryptionCodec
+	MetadataEncodingEncrypted = "binary/encrypted"
+	// MetadataEncryptionKeyID names the key a payload was encrypted with
+	MetadataEncryptionKeyID = "encryption-key-id"
+)
+
+// EncryptionCodec encrypts Temporal payloads with AES-GCM, so workflow inputs, results and
+// activity parameters such as site credentials are stored encrypted in the workflow history
+type EncryptionCodec struct {
+	keyID string
+	aead  cipher.AEAD
+}
+
+// NewEncryptionCodec creates a codec for a 16, 24 or 32 byte AES key
+func NewEncryptionCodec(keyID string, key []byte) (*EncryptionCodec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES-GCM: %w", err)
+	}
+	return &EncryptionCodec{keyID: keyID, aead: aead}, nil
+}
+
+// NewDataConverter returns the default data converter with payloads encrypted by a base64 encoded AES key
+func NewDataConverter(keyID, base64Key string) (converter.DataConverter, error) {
+	key, err := base64.StdEncoding.DecodeString(base64Key)
+	if err != nil {
+		return nil, fmt.Errorf("payload encryption key is not base64: %w", err)
+	}
+	codec, err := NewEncryptionCodec(keyID, key)
+	if err != nil {
+		return nil, err
+	}
+	return converter.NewCodecDataConverter(converter.GetDefaultDataConverter(), codec), nil
+}
+
+// Encode encrypts each payload including its metadata
+func (c *EncryptionCodec) Encode(payloads []*commonpb.Payload) ([]*commonpb.Payload, error) {
+	result := make([]*commonpb.Payload, len(payloads))
+	for i, p := range payloads {
+		plaintext, err := proto.Marshal(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal payload: %w", err)
+		}
+		nonce := make([]byte, c.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		result[i] = &commonpb.Payload{
+			Metadata: map[string][]byte{
+				converter.MetadataEncoding: []byte(MetadataEncodingEncrypted),
+				MetadataEncryptionKeyID:    []byte(c.keyID),
+			},
+			Data: c.aead.Seal(nonce, nonce, plaintext, nil),
+		}
+	}
+	return result, nil
+}
+
+// Decode decrypts encrypted payloads, payloads written without encryption are returned unchanged
+func (c *EncryptionCodec) Decode(payloads []*commonpb.Payload) ([]*commonpb.Payload, error) {
+	result := make([]*commonpb.Payload, len(payloads))
+	for i, p := range payloads {
+		if string(p.Metadata[converter.MetadataEncoding]) != MetadataEncodingEncrypted {
+			result[i] = p
+			continue
+		}
+		if keyID := string(p.Metadata[MetadataEncryptionKeyID]); keyID != c.keyID {
+			return nil, fmt.Errorf("payload was encrypted with key %q, configured key is %q", keyID, c.keyID)
+		}
+		nonceSize := c.aead.NonceSize()
+		if len(p.Data) < nonceSize {
+			return nil, fmt.Errorf("encrypted payload is too short")
+		}
+		plaintext, err := c.aead.Open(nil, p.Data[:nonceSize], p.Data[nonceSize:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+		}
+		decoded := &commonpb.Payload{}
+		if err := proto.Unmarshal(plaintext, decoded); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal payload: %w", err)
+		}
+		result[i] = decoded
+	}
+	return result, nil
+}
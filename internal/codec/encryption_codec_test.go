@@ -0,0 +1,60 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"go.temporal.io/sdk/converter"
+)
+
+type siteInput struct {
+	SiteName string
+	Password string
+}
+
+func TestDataConverter_EncryptsPayloads(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	dc, err := NewDataConverter("k1", key)
+	if err != nil {
+		t.Fatalf("NewDataConverter failed: %v", err)
+	}
+
+	payload, err := dc.ToPayload(siteInput{SiteName: "site1", Password: "s3cret"})
+	if err != nil {
+		t.Fatalf("ToPayload failed: %v", err)
+	}
+	if bytes.Contains(payload.Data, []byte("s3cret")) {
+		t.Error("expected the password not to appear in the encoded payload")
+	}
+	if string(payload.Metadata[converter.MetadataEncoding]) != MetadataEncodingEncrypted {
+		t.Errorf("expected encrypted encoding, got %q", payload.Metadata[converter.MetadataEncoding])
+	}
+
+	var decoded siteInput
+	if err := dc.FromPayload(payload, &decoded); err != nil || decoded.Password != "s3cret" {
+		t.Errorf("expected round trip, got %+v (%v)", decoded, err)
+	}
+
+	// Payloads written before encryption was enabled can still be read
+	plain, _ := converter.GetDefaultDataConverter().ToPayload(siteInput{SiteName: "site2"})
+	if err := dc.FromPayload(plain, &decoded); err != nil || decoded.SiteName != "site2" {
+		t.Errorf("expected unencrypted payload to decode, got %+v (%v)", decoded, err)
+	}
+
+	otherKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32))
+	other, _ := NewDataConverter("k2", otherKey)
+	if err := other.FromPayload(payload, &decoded); err == nil || !strings.Contains(err.Error(), `key "k1"`) {
+		t.Errorf("expected key mismatch error, got %v", err)
+	}
+}
+
+func TestNewDataConverter_RejectsInvalidKeys(t *testing.T) {
+	if _, err := NewDataConverter("k1", "not base64!"); err == nil {
+		t.Error("expected error for non-base64 key")
+	}
+	if _, err := NewDataConverter("k1", base64.StdEncoding.EncodeToString([]byte("short"))); err == nil {
+		t.Error("expected error for invalid key length")
+	}
+}
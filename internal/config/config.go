@@ -1,29 +1,183 @@
 package config
 
 import (
+	"log"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type AppConfig struct {
-	DittoHost           string
-	DittoUsername       string
-	DittoDevopsUsername string
-	DittoDevopsPassword string
-	DittoPassword       string
-	DittoNamespace      string
-	TemporalHost        string
+	TemporalHost           string
+	TemplateDir            string                       // Directory of user-managed connection templates
+	SecretDir              string                       // Directory with one file per secret referenced by sites
+	SnapshotDir            string                       // Directory shared by the workers keeping the values compensations restore
+	SitePolicyTemplateFile string                       // Go text/template of the policy created for each site, defaults to the built-in one
+	PayloadKey             string                       // Base64 AES key, Temporal payloads are encrypted when set
+	PayloadKeyID           string                       // Identifies PayloadKey in encrypted payloads
+	DefaultDittoTarget     string                       // Target of requests that name none
+	DittoTargets           map[string]DittoTargetConfig // By name, "default" holds the unprefixed DITTO_* settings
+}
+
+// Authentication methods of DittoAuthConfig
+const (
+	DittoAuthBasic             = "basic"
+	DittoAuthBearer            = "bearer"
+	DittoAuthClientCredentials = "client_credentials"
+)
+
+// DittoAuthConfig selects how the client authenticates with Ditto. The connections API always uses the devops credentials.
+type DittoAuthConfig struct {
+	Method       string // basic (Username/Password), bearer or client_credentials
+	BearerToken  string
+	TokenURL     string // OAuth2 token endpoint of the client credentials flow
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+}
+
+// DittoTransportConfig configures the HTTP and WebSocket connections to Ditto
+type DittoTransportConfig struct {
+	TLS                 bool   // Use https and wss
+	CAFile              string // PEM bundle of additional trusted CAs
+	CertFile            string // PEM client certificate and key for mutual TLS
+	KeyFile             string
+	InsecureSkipVerify  bool
+	ProxyURL            string // Defaults to HTTP_PROXY/HTTPS_PROXY
+	RequestTimeout      time.Duration
+	DialTimeout         time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int // 0 is unlimited
+	IdleConnTimeout     time.Duration
 }
 
 const TaskQueue = "MASS_DEVICE_CONFIG_TASK_QUEUE"
 
+// DefaultDittoTarget is the name of the Ditto target configured by the unprefixed DITTO_* variables
+const DefaultDittoTarget = "default"
+
+var dittoTargetNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// DittoTargetConfig is a Ditto environment the backend manages, e.g. staging, production or a region
+type DittoTargetConfig struct {
+	Host           string
+	Username       string
+	Password       string
+	DevopsUsername string
+	DevopsPassword string
+	PolicySubject  string // Subject granted access in site policies, defaults to nginx:<Username> with basic auth
+	Transport      DittoTransportConfig
+	Auth           DittoAuthConfig
+}
+
 func LoadConfig() AppConfig {
-	return AppConfig{
-		DittoHost:           os.Getenv("DITTO_HOSTPORT"),
-		DittoUsername:       os.Getenv("DITTO_USERNAME"),
-		DittoPassword:       os.Getenv("DITTO_PASSWORD"),
-		DittoDevopsUsername: os.Getenv("DITTO_DEVOPS_USERNAME"),
-		DittoDevopsPassword: os.Getenv("DITTO_DEVOPS_PASSWORD"),
-		DittoNamespace:      os.Getenv("DITTO_NAMESPACE"),
-		TemporalHost:        os.Getenv("TEMPORAL_HOSTPORT"),
+	defaultTarget := loadDittoTarget("DITTO_")
+	cfg := AppConfig{
+		TemporalHost:           os.Getenv("TEMPORAL_HOSTPORT"),
+		TemplateDir:            os.Getenv("CONNECTION_TEMPLATE_DIR"),
+		SecretDir:              os.Getenv("SECRET_DIR"),
+		SnapshotDir:            os.Getenv("SNAPSHOT_DIR"),
+		SitePolicyTemplateFile: os.Getenv("SITE_POLICY_TEMPLATE_FILE"),
+		PayloadKey:             os.Getenv("PAYLOAD_ENCRYPTION_KEY"),
+		PayloadKeyID:           getEnvDefault("PAYLOAD_ENCRYPTION_KEY_ID", "default"),
+		DefaultDittoTarget:     getEnvDefault("DITTO_DEFAULT_TARGET", DefaultDittoTarget),
+		DittoTargets:           map[string]DittoTargetConfig{},
+	}
+
+	names := strings.FieldsFunc(os.Getenv("DITTO_TARGETS"), func(r rune) bool { return r == ',' || r == ' ' })
+	if defaultTarget.Host != "" || len(names) == 0 {
+		cfg.DittoTargets[DefaultDittoTarget] = defaultTarget
+	}
+	for _, name := range names {
+		if !dittoTargetNameRegex.MatchString(name) {
+			log.Fatalf("DITTO_TARGETS: invalid target name %q, use lowercase letters, digits and '-'", name)
+		}
+		if _, ok := cfg.DittoTargets[name]; ok {
+			log.Fatalf("DITTO_TARGETS: target %q is configured twice", name)
+		}
+		cfg.DittoTargets[name] = loadDittoTarget("DITTO_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_")
+	}
+	return cfg
+}
+
+// loadDittoTarget reads the settings of a Ditto target from the variables with the prefix, e.g. DITTO_STAGING_HOSTPORT
+func loadDittoTarget(prefix string) DittoTargetConfig {
+	return DittoTargetConfig{
+		Host:           os.Getenv(prefix + "HOSTPORT"),
+		Username:       os.Getenv(prefix + "USERNAME"),
+		Password:       os.Getenv(prefix + "PASSWORD"),
+		DevopsUsername: os.Getenv(prefix + "DEVOPS_USERNAME"),
+		DevopsPassword: os.Getenv(prefix + "DEVOPS_PASSWORD"),
+		PolicySubject:  os.Getenv(prefix + "POLICY_SUBJECT"),
+		Transport: DittoTransportConfig{
+			TLS:                 getEnvBool(prefix+"TLS", false),
+			CAFile:              os.Getenv(prefix + "CA_FILE"),
+			CertFile:            os.Getenv(prefix + "CLIENT_CERT_FILE"),
+			KeyFile:             os.Getenv(prefix + "CLIENT_KEY_FILE"),
+			InsecureSkipVerify:  getEnvBool(prefix+"TLS_INSECURE_SKIP_VERIFY", false),
+			ProxyURL:            os.Getenv(prefix + "PROXY_URL"),
+			RequestTimeout:      getEnvDuration(prefix+"REQUEST_TIMEOUT", 30*time.Second),
+			DialTimeout:         getEnvDuration(prefix+"DIAL_TIMEOUT", 10*time.Second),
+			MaxIdleConns:        getEnvInt(prefix+"MAX_IDLE_CONNS", 100),
+			MaxIdleConnsPerHost: getEnvInt(prefix+"MAX_IDLE_CONNS_PER_HOST", 20),
+			MaxConnsPerHost:     getEnvInt(prefix+"MAX_CONNS_PER_HOST", 0),
+			IdleConnTimeout:     getEnvDuration(prefix+"IDLE_CONN_TIMEOUT", 90*time.Second),
+		},
+		Auth: DittoAuthConfig{
+			Method:       getEnvDefault(prefix+"AUTH", DittoAuthBasic),
+			BearerToken:  os.Getenv(prefix + "BEARER_TOKEN"),
+			TokenURL:     os.Getenv(prefix + "OAUTH_TOKEN_URL"),
+			ClientID:     os.Getenv(prefix + "OAUTH_CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "OAUTH_CLIENT_SECRET"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "OAUTH_SCOPES")),
+		},
+	}
+}
+
+func getEnvDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvBool, getEnvInt and getEnvDuration exit on invalid values, a misconfigured transport should not start silently
+
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("%s must be true or false, got %q", key, value)
+	}
+	return b
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("%s must be a non-negative number, got %q", key, value)
+	}
+	return n
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Fatalf("%s must be a duration such as 30s, got %q", key, value)
 	}
+	return d
 }
@@ -1,7 +1,8 @@
 package models
 
 type Device struct {
-	ThingId  string `json:"thingId"`
-	PolicyId string `json:"policyId"`
-	// attributes string
+	ThingId    string                 `json:"thingId"`
+	PolicyId   string                 `json:"policyId"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Features   map[string]interface{} `json:"features,omitempty"`
 }
@@ -6,4 +6,5 @@ type DittoProtocolMessage struct {
 	Path    string                 `json:"path,omitempty"`
 	Value   interface{}            `json:"value,omitempty"`
 	Headers map[string]interface{} `json:"headers,omitempty"`
+	Status  int                    `json:"status,omitempty"` // set on responses only
 }
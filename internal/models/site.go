@@ -1,11 +1,180 @@
-// filepath: /Users/thomas/dev/dm-backend/internal/models/site.go
 package models
 
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Site protocols, each selects the connection template of the same name
+const (
+	SiteProtocolMQTT5    = "mqtt5"
+	SiteProtocolMQTT3    = "mqtt3"
+	SiteProtocolAMQP10   = "amqp10"
+	SiteProtocolKafka    = "kafka"
+	SiteProtocolHTTPPush = "http-push"
+)
+
+// SiteProtocols lists the supported site protocols, the first one is the default
+var SiteProtocols = []string{SiteProtocolMQTT5, SiteProtocolMQTT3, SiteProtocolAMQP10, SiteProtocolKafka, SiteProtocolHTTPPush}
+
+var httpPushAddressRegex = regexp.MustCompile(`^(GET|POST|PUT|PATCH|DELETE):/`)
+
+// SiteNamespace is the Ditto namespace of the gateway things and policies of sites
+const SiteNamespace = "gateway"
+
+// maxSiteNameLength keeps the site policy ID and connection name derived from a site name well within Ditto's limits
+const maxSiteNameLength = 64
+
+// siteNameRegex is a subset of the Ditto entity name charset that needs no escaping in thing and policy IDs,
+// connection names, RQL filters, URLs and workflow IDs
+var siteNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
 type Site struct {
-    SiteName    string `json:"siteName"`
-    Host        string `json:"host"`
-    Port        string `json:"port"`
-    Username    string `json:"username"`
-    Password    string `json:"password"`
-    Description string `json:"description"`
-}
\ No newline at end of file
+	SiteName    string `json:"siteName"`
+	Protocol    string `json:"protocol,omitempty"` // one of SiteProtocols, defaults to mqtt5
+	Template    string `json:"template,omitempty"` // user-managed connection template, defaults to the protocol's template
+	Host        string `json:"host"`
+	Port        string `json:"port"`
+	TLS         bool   `json:"tls,omitempty"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	Description string `json:"description"`
+
+	// PasswordSecret names a secret in the worker's secret store used instead of Password,
+	// it is resolved when the connection is rendered and never stored in workflow history
+	PasswordSecret string `json:"passwordSecret,omitempty"`
+
+	// Protocol specific addresses: MQTT topics, AMQP 1.0 addresses, Kafka topics,
+	// or "<METHOD>:/<path>" for HTTP push targets
+	SourceAddress string `json:"sourceAddress,omitempty"` // inbound, required for amqp10, not supported by http-push
+	TargetAddress string `json:"targetAddress,omitempty"` // outbound, required for amqp10, kafka and http-push
+}
+
+// SiteConnectionName returns the name of the Ditto connection created for a site
+func SiteConnectionName(siteName string) string {
+	return siteName + "-conn"
+}
+
+// SitePolicyID returns the ID of the dedicated policy created for a site
+func SitePolicyID(siteName string) string {
+	return SiteNamespace + ":" + siteName + "-policy"
+}
+
+// TemplateName returns the connection template of the site, by default the one of its protocol
+func (s Site) TemplateName() string {
+	if s.Template != "" {
+		return s.Template
+	}
+	if s.Protocol == "" {
+		return SiteProtocolMQTT5
+	}
+	return s.Protocol
+}
+
+// ConnectionPlaceholders returns the values for the site's connection template
+func (s Site) ConnectionPlaceholders(thingID string) map[string]string {
+	return map[string]string{
+		"ThingID":        thingID,
+		"ConnectionName": SiteConnectionName(s.SiteName),
+		"Scheme":         s.ConnectionScheme(),
+		"Host":           s.Host,
+		"Port":           s.Port,
+		"Username":       s.Username,
+		"Password":       s.Password,
+		"SourceAddress":  s.SourceAddress,
+		"TargetAddress":  s.TargetAddress,
+	}
+}
+
+// ConnectionSecrets returns the placeholders resolved from the secret store, key: placeholder, value: secret name
+func (s Site) ConnectionSecrets() map[string]string {
+	if s.PasswordSecret == "" {
+		return nil
+	}
+	return map[string]string{"Password": s.PasswordSecret}
+}
+
+// ConnectionScheme returns the URI scheme of the site connection
+func (s Site) ConnectionScheme() string {
+	switch s.Protocol {
+	case SiteProtocolAMQP10:
+		if s.TLS {
+			return "amqps"
+		}
+		return "amqp"
+	case SiteProtocolHTTPPush:
+		if s.TLS {
+			return "https"
+		}
+		return "http"
+	default:
+		if s.TLS {
+			return "ssl"
+		}
+		return "tcp"
+	}
+}
+
+// ValidateSiteName checks that a site name can be used in the IDs of the site's Ditto entities
+func ValidateSiteName(siteName string) error {
+	switch {
+	case siteName == "":
+		return fmt.Errorf("siteName is required")
+	case len(siteName) > maxSiteNameLength:
+		return fmt.Errorf("siteName must be at most %d characters", maxSiteNameLength)
+	case !siteNameRegex.MatchString(siteName):
+		return fmt.Errorf("siteName must start with a letter or digit and contain only letters, digits, '_', '.' and '-'")
+	}
+	return nil
+}
+
+// Validate checks the common and protocol specific fields of a site
+func (s Site) Validate() error {
+	var problems []string
+	if err := ValidateSiteName(s.SiteName); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if s.Host == "" {
+		problems = append(problems, "host is required")
+	}
+	if port, err := strconv.Atoi(s.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("port must be a number between 1 and 65535, got %q", s.Port))
+	}
+	if (s.Password != "" || s.PasswordSecret != "") && s.Username == "" {
+		problems = append(problems, "username is required with a password")
+	}
+	if s.Password != "" && s.PasswordSecret != "" {
+		problems = append(problems, "password and passwordSecret are mutually exclusive")
+	}
+
+	protocol := s.Protocol
+	if protocol == "" {
+		protocol = SiteProtocolMQTT5
+	}
+	switch protocol {
+	case SiteProtocolMQTT5, SiteProtocolMQTT3:
+	case SiteProtocolAMQP10:
+		if s.SourceAddress == "" || s.TargetAddress == "" {
+			problems = append(problems, "sourceAddress and targetAddress are required for amqp10")
+		}
+	case SiteProtocolKafka:
+		if s.TargetAddress == "" {
+			problems = append(problems, "targetAddress (topic) is required for kafka")
+		}
+	case SiteProtocolHTTPPush:
+		if s.SourceAddress != "" {
+			problems = append(problems, "sourceAddress is not supported for http-push")
+		}
+		if !httpPushAddressRegex.MatchString(s.TargetAddress) {
+			problems = append(problems, fmt.Sprintf("targetAddress must be <METHOD>:/<path> for http-push, got %q", s.TargetAddress))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported protocol %q, must be one of %v", s.Protocol, SiteProtocols))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid site %q: %s", s.SiteName, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+
+	"go.temporal.io/sdk/workflow"
+)
+
+// compensations collects undo steps of a saga, they run in reverse order when a later step fails
+type compensations []func(ctx workflow.Context) error
+
+func (c *compensations) add(step func(ctx workflow.Context) error) {
+	*c = append(*c, step)
+}
+
+// addActivity registers an activity as undo step
+func (c *compensations) addActivity(activity string, args ...interface{}) {
+	c.add(func(ctx workflow.Context) error {
+		return workflow.ExecuteActivity(ctx, activity, args...).Get(ctx, nil)
+	})
+}
+
+// run executes all undo steps on a disconnected context, so they also run when the workflow is cancelled.
+// A failing step does not stop the remaining ones, all errors are returned joined.
+func (c compensations) run(ctx workflow.Context) error {
+	ctx, _ = workflow.NewDisconnectedContext(ctx)
+	var errs []error
+	for i := len(c) - 1; i >= 0; i-- {
+		if err := c[i](ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compensate runs the undo steps and wraps the error of the failed step
+func (c compensations) compensate(ctx workflow.Context, step string, err error) error {
+	if compensationErr := c.run(ctx); compensationErr != nil {
+		workflow.GetLogger(ctx).Error("Compensation failed", "step", step, "error", compensationErr)
+		return fmt.Errorf("%s failed after retries: %w (compensation failed: %v)", step, err, compensationErr)
+	}
+	return fmt.Errorf("%s failed after retries: %w", step, err)
+}
+
+// connectionSnapshotID groups the connection snapshots a site workflow run takes for compensation
+func connectionSnapshotID(ctx workflow.Context) string {
+	execution := workflow.GetInfo(ctx).WorkflowExecution
+	return "site-connection/" + execution.ID + "/" + execution.RunID
+}
+
+// disconnected returns a context that is not cancelled with the workflow, for cleanup steps
+func disconnected(ctx workflow.Context) workflow.Context {
+	ctx, _ = workflow.NewDisconnectedContext(ctx)
+	return ctx
+}
@@ -0,0 +1,71 @@
+package workflow
+
+import (
+	"go.temporal.io/sdk/workflow"
+)
+
+// Signals accepted by MassDeviceConfigWorkflow
+const (
+	PauseSignal  = "pause"
+	ResumeSignal = "resume"
+	AbortSignal  = "abort"
+)
+
+// rolloutControl tracks the pause/resume/abort signals sent to a rollout.
+// Pausing or aborting stops dispatching new devices; in-flight activities finish.
+type rolloutControl struct {
+	pauseCh, resumeCh, abortCh workflow.ReceiveChannel
+
+	paused  bool
+	aborted bool
+}
+
+// newRolloutControl starts listening for control signals
+func newRolloutControl(ctx workflow.Context, paused bool) *rolloutControl {
+	c := &rolloutControl{
+		pauseCh:  workflow.GetSignalChannel(ctx, PauseSignal),
+		resumeCh: workflow.GetSignalChannel(ctx, ResumeSignal),
+		abortCh:  workflow.GetSignalChannel(ctx, AbortSignal),
+		paused:   paused,
+	}
+	workflow.Go(ctx, func(ctx workflow.Context) {
+		for {
+			selector := workflow.NewSelector(ctx)
+			c.addReceivers(ctx, selector)
+			selector.Select(ctx)
+		}
+	})
+	return c
+}
+
+func (c *rolloutControl) addReceivers(ctx workflow.Context, selector workflow.Selector) {
+	selector.AddReceive(c.pauseCh, func(ch workflow.ReceiveChannel, _ bool) {
+		ch.Receive(ctx, nil)
+		c.paused = true
+	})
+	selector.AddReceive(c.resumeCh, func(ch workflow.ReceiveChannel, _ bool) {
+		ch.Receive(ctx, nil)
+		c.paused = false
+	})
+	selector.AddReceive(c.abortCh, func(ch workflow.ReceiveChannel, _ bool) {
+		ch.Receive(ctx, nil)
+		c.aborted = true
+	})
+}
+
+// drain applies signals that have not been processed yet, so none are lost on continue-as-new
+func (c *rolloutControl) drain(ctx workflow.Context) {
+	for c.pauseCh.Len()+c.resumeCh.Len()+c.abortCh.Len() > 0 {
+		selector := workflow.NewSelector(ctx)
+		c.addReceivers(ctx, selector)
+		selector.Select(ctx)
+	}
+}
+
+// wait blocks while the rollout is paused and reports whether dispatching may continue
+func (c *rolloutControl) wait(ctx workflow.Context) bool {
+	if err := workflow.Await(ctx, func() bool { return !c.paused || c.aborted }); err != nil {
+		return false
+	}
+	return !c.aborted
+}
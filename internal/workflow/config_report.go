@@ -0,0 +1,95 @@
+package workflow
+
+// RolloutStatusQuery is the query type that returns the current RolloutReport of a MassDeviceConfigWorkflow
+const RolloutStatusQuery = "rollout-status"
+
+// maxReportedOutcomes bounds each list of outcomes kept in the report. The report is carried
+// across continue-as-new and returned by queries, so it must stay well below Temporal's
+// payload size limit even with long error messages; the counts still cover every device.
+const maxReportedOutcomes = 500
+
+type DeviceStatus string
+
+const (
+	DeviceStatusPending      DeviceStatus = "pending"      // fetched, not yet dispatched
+	DeviceStatusSent         DeviceStatus = "sent"         // dispatched, waiting for Ditto's response
+	DeviceStatusAcknowledged DeviceStatus = "acknowledged" // Ditto applied the command
+	DeviceStatusFailed       DeviceStatus = "failed"       // Ditto rejected the command or it could not be delivered
+	DeviceStatusSkipped      DeviceStatus = "skipped"      // not dispatched because the rollout stopped
+	DeviceStatusRolledBack   DeviceStatus = "rolled-back"  // change was compensated by restoring the previous values
+)
+
+// DeviceOutcome is the status of the rollout for a single thing
+type DeviceOutcome struct {
+	ThingId     string       `json:"thingId"`
+	Status      DeviceStatus `json:"status"`
+	DittoStatus int          `json:"dittoStatus,omitempty"`
+	Reason      string       `json:"reason,omitempty"`
+}
+
+// RolloutReport summarizes a mass device configuration rollout. Failed and skipped devices are listed
+// in Outcomes and acknowledged ones in AcknowledgedOutcomes, each list bounded so the report stays small
+// enough to carry across continue-as-new.
+type RolloutReport struct {
+	Processed         int             `json:"processed"`
+	Acknowledged      int             `json:"acknowledged"`
+	Failed            int             `json:"failed"`
+	Skipped           int             `json:"skipped"`
+	Completed         bool            `json:"completed"`
+	Paused            bool            `json:"paused,omitempty"`
+	Aborted           bool            `json:"aborted,omitempty"`
+	Halted            bool            `json:"halted,omitempty"`
+	HaltReason        string          `json:"haltReason,omitempty"`
+	Total             int             `json:"total,omitempty"` // Devices matched when a staged rollout started
+	Stage             int             `json:"stage,omitempty"` // Index of the current stage of a staged rollout
+	Stages            []StageReport   `json:"stages,omitempty"`
+	InFlight          []DeviceOutcome `json:"inFlight,omitempty"` // pending and sent devices of the current batch, query results only
+	Outcomes          []DeviceOutcome `json:"outcomes"`
+	OutcomesTruncated bool            `json:"outcomesTruncated,omitempty"`
+
+	AcknowledgedOutcomes  []DeviceOutcome `json:"acknowledgedOutcomes"`
+	AcknowledgedTruncated bool            `json:"acknowledgedTruncated,omitempty"`
+}
+
+// record adds the final outcomes of a batch to the report
+func (r *RolloutReport) record(batch []DeviceOutcome) {
+	for _, outcome := range batch {
+		r.Processed++
+		if r.Stage < len(r.Stages) {
+			r.Stages[r.Stage].Processed++
+			if outcome.Status == DeviceStatusFailed {
+				r.Stages[r.Stage].Failed++
+			}
+		}
+		switch outcome.Status {
+		case DeviceStatusAcknowledged:
+			r.Acknowledged++
+			if len(r.AcknowledgedOutcomes) < maxReportedOutcomes {
+				r.AcknowledgedOutcomes = append(r.AcknowledgedOutcomes, outcome)
+			} else {
+				r.AcknowledgedTruncated = true
+			}
+			continue
+		case DeviceStatusFailed:
+			r.Failed++
+		case DeviceStatusSkipped:
+			r.Skipped++
+		}
+		if len(r.Outcomes) < maxReportedOutcomes {
+			r.Outcomes = append(r.Outcomes, outcome)
+		} else {
+			r.OutcomesTruncated = true
+		}
+	}
+}
+
+// withInFlight returns a copy of the report listing the unfinished devices of batch
+func (r RolloutReport) withInFlight(batch []DeviceOutcome) RolloutReport {
+	r.InFlight = nil
+	for _, outcome := range batch {
+		if outcome.Status == DeviceStatusPending || outcome.Status == DeviceStatusSent {
+			r.InFlight = append(r.InFlight, outcome)
+		}
+	}
+	return r
+}
@@ -0,0 +1,67 @@
+package workflow
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// RolloutStage is one step of a staged rollout
+type RolloutStage struct {
+	Percent      float64       // Cumulative share of matched devices covered once the stage completes, e.g. 1, 10, 100
+	MaxErrorRate float64       // Halt the rollout when failed/processed devices of the stage exceed this ratio (0..1)
+	SoakDuration time.Duration // Wait after the stage before starting the next one
+}
+
+// RolloutPlan splits a rollout into canary and follow-up stages.
+// The last stage always covers the remaining devices. An empty plan rolls out to all devices at once.
+type RolloutPlan struct {
+	Stages []RolloutStage
+}
+
+// Validate checks that stage percentages are ascending within (0, 100] and error rates within [0, 1]
+func (p RolloutPlan) Validate() error {
+	previous := 0.0
+	for i, stage := range p.Stages {
+		if stage.Percent <= previous || stage.Percent > 100 {
+			return fmt.Errorf("stage %d: percent must be greater than the previous stage and at most 100, got %g", i+1, stage.Percent)
+		}
+		if stage.MaxErrorRate < 0 || stage.MaxErrorRate > 1 {
+			return fmt.Errorf("stage %d: max error rate must be between 0 and 1, got %g", i+1, stage.MaxErrorRate)
+		}
+		if stage.SoakDuration < 0 {
+			return fmt.Errorf("stage %d: soak duration must not be negative", i+1)
+		}
+		previous = stage.Percent
+	}
+	return nil
+}
+
+// StageReport tracks the progress of one rollout stage
+type StageReport struct {
+	Percent   float64 `json:"percent"`
+	Limit     int     `json:"limit"` // Total processed devices at which the stage completes, 0 for the last stage
+	Processed int     `json:"processed"`
+	Failed    int     `json:"failed"`
+	Completed bool    `json:"completed"`
+}
+
+// ErrorRate returns the ratio of failed to processed devices of the stage
+func (s StageReport) ErrorRate() float64 {
+	if s.Processed == 0 {
+		return 0
+	}
+	return float64(s.Failed) / float64(s.Processed)
+}
+
+// stageReports computes the device limit of each stage for the given number of matched devices
+func (p RolloutPlan) stageReports(total int) []StageReport {
+	stages := make([]StageReport, len(p.Stages))
+	for i, stage := range p.Stages {
+		stages[i].Percent = stage.Percent
+		if i < len(p.Stages)-1 {
+			stages[i].Limit = int(math.Ceil(float64(total) * stage.Percent / 100))
+		}
+	}
+	return stages
+}
@@ -1,46 +1,229 @@
 package workflow
 
 import (
+	"dm-backend/internal/activities"
 	"dm-backend/internal/models"
+	"errors"
+	"fmt"
 	"time"
 
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/workflow"
 )
 
+const (
+	defaultBatchSize        = 100
+	defaultMaxConcurrency   = 10
+	defaultMaxBatchesPerRun = 50
+)
+
 type ConfigWorkflowParams struct {
 	RQLQuery             string
 	DittoProtocolMessage models.DittoProtocolMessage
+	BatchSize            int // Devices fetched and dispatched per batch, defaults to 100 (max 200)
+	MaxConcurrency       int // Max in-flight SendDittoProtocolMessage activities, defaults to 10
+	MaxBatchesPerRun     int // Batches processed before continuing as new, defaults to 50
+	Rollout              RolloutPlan
+	Target               string // Ditto target, empty for the default target
+
+	// Carried across continue-as-new, leave empty when starting a rollout
+	Cursor string
+	Report RolloutReport
 }
 
-func MassDeviceConfigWorkflow(ctx workflow.Context, params ConfigWorkflowParams) error {
+// MassDeviceConfigWorkflow sends a Ditto protocol message to every device matched by the RQL query.
+// Devices are fetched and dispatched in batches following the search cursor, and the workflow
+// continues as new with the cursor when its history grows. The outcome for each device is
+// tracked in a RolloutReport, available through the RolloutStatusQuery and returned on completion.
+// With a RolloutPlan, devices are rolled out stage by stage and the rollout halts when a stage
+// exceeds its error rate.
+func MassDeviceConfigWorkflow(ctx workflow.Context, params ConfigWorkflowParams) (RolloutReport, error) {
 	ao := workflow.ActivityOptions{
 		StartToCloseTimeout: time.Minute,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			BackoffCoefficient: 2.0,
+			MaximumAttempts:    3,
+		},
 	}
 	ctx = workflow.WithActivityOptions(ctx, ao)
+	ctx = activities.WithDittoTarget(ctx, params.Target)
+
+	if params.BatchSize <= 0 {
+		params.BatchSize = defaultBatchSize
+	}
+	if params.MaxConcurrency <= 0 {
+		params.MaxConcurrency = defaultMaxConcurrency
+	}
+	if params.MaxBatchesPerRun <= 0 {
+		params.MaxBatchesPerRun = defaultMaxBatchesPerRun
+	}
+
+	report := params.Report
+	control := newRolloutControl(ctx, report.Paused)
+	report.Paused = false
+	var batch []DeviceOutcome
+	err := workflow.SetQueryHandler(ctx, RolloutStatusQuery, func() (RolloutReport, error) {
+		status := report.withInFlight(batch)
+		status.Paused, status.Aborted = control.paused, control.aborted
+		return status, nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if err := params.Rollout.Validate(); err != nil {
+		return report, temporal.NewNonRetryableApplicationError(err.Error(), "InvalidRolloutPlan", err)
+	}
+	if len(params.Rollout.Stages) > 0 && report.Stages == nil {
+		if err := workflow.ExecuteActivity(ctx, "CountDevicesInDitto", params.RQLQuery).Get(ctx, &report.Total); err != nil {
+			return report, err
+		}
+		report.Stages = params.Rollout.stageReports(report.Total)
+	}
+
+	for batches := 0; ; batches++ {
+		if !control.wait(ctx) {
+			report.Aborted = true
+			return report, nil
+		}
+		if batches >= params.MaxBatchesPerRun || workflow.GetInfo(ctx).GetContinueAsNewSuggested() {
+			control.drain(ctx)
+			workflow.GetLogger(ctx).Info("Continuing as new", "Processed", report.Processed)
+			report.Paused = control.paused
+			params.Report = report
+			return report, workflow.NewContinueAsNewError(ctx, MassDeviceConfigWorkflow, params)
+		}
+
+		// Fetch the next batch of devices from Ditto, not crossing the limit of the current stage
+		pageSize := params.BatchSize
+		if report.Stage < len(report.Stages) && report.Stages[report.Stage].Limit > 0 {
+			pageSize = min(pageSize, report.Stages[report.Stage].Limit-report.Processed)
+		}
+		var page activities.DevicePage
+		searchParams := activities.SearchThingsParams{
+			Filter:   params.RQLQuery,
+			PageSize: pageSize,
+			Cursor:   params.Cursor,
+		}
+		if err := workflow.ExecuteActivity(ctx, "FetchDevicePage", searchParams).Get(ctx, &page); err != nil {
+			return report, err
+		}
 
-	// Fetch devices from Ditto
-	var devices []models.Device
-	if err := workflow.ExecuteActivity(ctx, "FetchDevicesFromDitto", params.RQLQuery).Get(ctx, &devices); err != nil {
-		return err
+		batch = make([]DeviceOutcome, len(page.Items))
+		for i, device := range page.Items {
+			batch[i] = DeviceOutcome{ThingId: device.ThingId, Status: DeviceStatusPending}
+		}
+		sendToDevices(ctx, control, batch, params.DittoProtocolMessage, params.MaxConcurrency)
+		report.record(batch)
+		batch = nil
+
+		if control.aborted {
+			report.Aborted = true
+			return report, nil
+		}
+		if page.Cursor == "" {
+			// The last page also ends the current stage, its error rate decides whether the rollout succeeded
+			if report.Stage < len(report.Stages) && !checkStageErrorRate(&report, params.Rollout.Stages[report.Stage]) {
+				return report, nil
+			}
+			report.Completed = true
+			return report, nil
+		}
+		params.Cursor = page.Cursor
+
+		for report.Stage < len(report.Stages) && report.Stages[report.Stage].Limit > 0 &&
+			report.Processed >= report.Stages[report.Stage].Limit {
+			if !completeStage(ctx, control, &report, params.Rollout.Stages[report.Stage]) {
+				return report, nil
+			}
+		}
 	}
+}
 
-	// Send Ditto protocol message for each device
-	futures := make([]workflow.Future, len(devices))
-	for i, device := range devices {
-		// Pass ThingId and the protocol message to the activity
-		activityParams := struct {
-			ThingId string
-			Message models.DittoProtocolMessage
-		}{
-			ThingId: device.ThingId,
-			Message: params.DittoProtocolMessage,
+// completeStage checks the error rate of the current stage and soaks before moving to the next one.
+// It returns false if the rollout halted or was aborted during the soak.
+func completeStage(ctx workflow.Context, control *rolloutControl, report *RolloutReport, plan RolloutStage) bool {
+	if !checkStageErrorRate(report, plan) {
+		return false
+	}
+	stage := report.Stages[report.Stage]
+	if plan.SoakDuration > 0 && stage.Processed > 0 {
+		workflow.GetLogger(ctx).Info("Soaking after stage", "Stage", report.Stage+1, "Duration", plan.SoakDuration)
+		if _, err := workflow.AwaitWithTimeout(ctx, plan.SoakDuration, func() bool { return control.aborted }); err != nil || control.aborted {
+			report.Aborted = true
+			return false
 		}
-		futures[i] = workflow.ExecuteActivity(ctx, "SendDittoProtocolMessage", activityParams)
 	}
-	for _, f := range futures {
-		if err := f.Get(ctx, nil); err != nil {
-			return err
+	report.Stage++
+	return true
+}
+
+// checkStageErrorRate completes the current stage and halts the rollout if its error rate exceeds the plan's
+func checkStageErrorRate(report *RolloutReport, plan RolloutStage) bool {
+	stage := &report.Stages[report.Stage]
+	stage.Completed = true
+	if rate := stage.ErrorRate(); rate > plan.MaxErrorRate {
+		report.Halted = true
+		report.HaltReason = fmt.Sprintf("stage %d (%g%%) error rate %.2f%% exceeds %.2f%%",
+			report.Stage+1, stage.Percent, rate*100, plan.MaxErrorRate*100)
+		return false
+	}
+	return true
+}
+
+// sendToDevices sends the message to each device of the batch with at most maxConcurrency
+// activities in flight, updating each outcome as the activities complete. While the rollout
+// is paused no new devices are dispatched; once aborted the remaining devices are skipped.
+func sendToDevices(ctx workflow.Context, control *rolloutControl, batch []DeviceOutcome, message models.DittoProtocolMessage, maxConcurrency int) {
+	selector := workflow.NewSelector(ctx)
+	inFlight := 0
+	for i := range batch {
+		if control.paused {
+			// Let in-flight devices finish so their outcome is visible while paused
+			for ; inFlight > 0; inFlight-- {
+				selector.Select(ctx)
+			}
+		}
+		if !control.wait(ctx) {
+			for j := i; j < len(batch); j++ {
+				batch[j].Status = DeviceStatusSkipped
+				batch[j].Reason = "rollout aborted"
+			}
+			break
+		}
+		if inFlight == maxConcurrency {
+			selector.Select(ctx)
+			inFlight--
 		}
+		activityParams := activities.SendDittoProtocolMessageParams{
+			ThingId: batch[i].ThingId,
+			Message: message,
+		}
+		f := workflow.ExecuteActivity(ctx, "SendDittoProtocolMessage", activityParams)
+		batch[i].Status = DeviceStatusSent
+		selector.AddFuture(f, func(f workflow.Future) {
+			var result activities.SendDittoProtocolMessageResult
+			if err := f.Get(ctx, &result); err != nil {
+				batch[i].Status = DeviceStatusFailed
+				batch[i].Reason = failureReason(err)
+				return
+			}
+			batch[i].Status = DeviceStatusAcknowledged
+			batch[i].DittoStatus = result.Status
+		})
+		inFlight++
+	}
+	for ; inFlight > 0; inFlight-- {
+		selector.Select(ctx)
+	}
+}
+
+// failureReason unwraps the activity error to the message returned by the activity
+func failureReason(err error) string {
+	var appErr *temporal.ApplicationError
+	if errors.As(err, &appErr) {
+		return appErr.Error()
 	}
-	return nil
+	return err.Error()
 }
@@ -0,0 +1,291 @@
+package workflow_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"dm-backend/internal/activities"
+	"dm-backend/internal/models"
+	"dm-backend/internal/workflow"
+
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/testsuite"
+	sdkworkflow "go.temporal.io/sdk/workflow"
+)
+
+// MockConfigActivities serves Devices in pages of the requested size and records sent messages
+type MockConfigActivities struct {
+	Devices    []models.Device
+	FailThings map[string]bool
+
+	mu   sync.Mutex
+	Sent []string
+}
+
+func (m *MockConfigActivities) FetchDevicePage(_ context.Context, params activities.SearchThingsParams) (activities.DevicePage, error) {
+	start := 0
+	if params.Cursor != "" {
+		fmt.Sscanf(params.Cursor, "%d", &start)
+	}
+	pageSize := params.PageSize
+	if pageSize <= 0 {
+		pageSize = 200
+	}
+	end := min(start+pageSize, len(m.Devices))
+	page := activities.DevicePage{Items: m.Devices[start:end]}
+	if end < len(m.Devices) {
+		page.Cursor = fmt.Sprintf("%d", end)
+	}
+	return page, nil
+}
+
+func (m *MockConfigActivities) CountDevicesInDitto(_ context.Context, _ string) (int, error) {
+	return len(m.Devices), nil
+}
+
+func (m *MockConfigActivities) SendDittoProtocolMessage(_ context.Context, params activities.SendDittoProtocolMessageParams) (activities.SendDittoProtocolMessageResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Sent = append(m.Sent, params.ThingId)
+	if m.FailThings[params.ThingId] {
+		return activities.SendDittoProtocolMessageResult{}, errors.New("ditto rejected command with status 403")
+	}
+	return activities.SendDittoProtocolMessageResult{Status: 204}, nil
+}
+
+func mockDevices(n int) []models.Device {
+	devices := make([]models.Device, n)
+	for i := range devices {
+		devices[i] = models.Device{ThingId: fmt.Sprintf("org.example:device-%d", i)}
+	}
+	return devices
+}
+
+func TestMassDeviceConfigWorkflow_ProcessesAllBatches(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockConfigActivities{Devices: mockDevices(25)}
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.SendDittoProtocolMessage)
+
+	env.ExecuteWorkflow(workflow.MassDeviceConfigWorkflow, workflow.ConfigWorkflowParams{
+		RQLQuery:       `eq(attributes/type,"gateway")`,
+		BatchSize:      10,
+		MaxConcurrency: 3,
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	require.Len(t, mockActs.Sent, 25)
+
+	var report workflow.RolloutReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.True(t, report.Completed)
+	require.Equal(t, 25, report.Processed)
+	require.Equal(t, 25, report.Acknowledged)
+	require.Len(t, report.AcknowledgedOutcomes, 25)
+	require.Equal(t, workflow.DeviceStatusAcknowledged, report.AcknowledgedOutcomes[0].Status)
+	require.Empty(t, report.Outcomes)
+}
+
+func TestMassDeviceConfigWorkflow_ReportsFailedDevices(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockConfigActivities{
+		Devices:    mockDevices(5),
+		FailThings: map[string]bool{"org.example:device-3": true},
+	}
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.SendDittoProtocolMessage)
+
+	env.ExecuteWorkflow(workflow.MassDeviceConfigWorkflow, workflow.ConfigWorkflowParams{
+		RQLQuery: `eq(attributes/type,"gateway")`,
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	var report workflow.RolloutReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.Equal(t, 5, report.Processed)
+	require.Equal(t, 4, report.Acknowledged)
+	require.Equal(t, 1, report.Failed)
+	require.Len(t, report.AcknowledgedOutcomes, 4)
+	require.Len(t, report.Outcomes, 1)
+	require.Equal(t, "org.example:device-3", report.Outcomes[0].ThingId)
+	require.Equal(t, workflow.DeviceStatusFailed, report.Outcomes[0].Status)
+	require.Contains(t, report.Outcomes[0].Reason, "403")
+
+	queried, err := env.QueryWorkflow(workflow.RolloutStatusQuery)
+	require.NoError(t, err)
+	var status workflow.RolloutReport
+	require.NoError(t, queried.Get(&status))
+	require.Equal(t, 1, status.Failed)
+}
+
+func TestMassDeviceConfigWorkflow_ContinuesAsNewWithCursor(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockConfigActivities{Devices: mockDevices(25)}
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.SendDittoProtocolMessage)
+
+	env.ExecuteWorkflow(workflow.MassDeviceConfigWorkflow, workflow.ConfigWorkflowParams{
+		RQLQuery:         `eq(attributes/type,"gateway")`,
+		BatchSize:        10,
+		MaxBatchesPerRun: 2,
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.True(t, sdkworkflow.IsContinueAsNewError(env.GetWorkflowError()))
+	require.Len(t, mockActs.Sent, 20)
+}
+
+func TestMassDeviceConfigWorkflow_ResumesAfterPause(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockConfigActivities{Devices: mockDevices(5)}
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.SendDittoProtocolMessage)
+
+	env.RegisterDelayedCallback(func() {
+		require.Empty(t, mockActs.Sent)
+		env.SignalWorkflow(workflow.ResumeSignal, nil)
+	}, time.Minute)
+
+	env.ExecuteWorkflow(workflow.MassDeviceConfigWorkflow, workflow.ConfigWorkflowParams{
+		RQLQuery: `eq(attributes/type,"gateway")`,
+		Report:   workflow.RolloutReport{Paused: true},
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	var report workflow.RolloutReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.True(t, report.Completed)
+	require.False(t, report.Paused)
+	require.Equal(t, 5, report.Acknowledged)
+}
+
+func TestMassDeviceConfigWorkflow_AbortStopsDispatching(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockConfigActivities{Devices: mockDevices(5)}
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.SendDittoProtocolMessage)
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(workflow.AbortSignal, nil)
+	}, time.Minute)
+
+	env.ExecuteWorkflow(workflow.MassDeviceConfigWorkflow, workflow.ConfigWorkflowParams{
+		RQLQuery: `eq(attributes/type,"gateway")`,
+		Report:   workflow.RolloutReport{Paused: true},
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	require.Empty(t, mockActs.Sent)
+
+	var report workflow.RolloutReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.True(t, report.Aborted)
+	require.False(t, report.Completed)
+}
+
+func TestMassDeviceConfigWorkflow_StagedRolloutCompletes(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockConfigActivities{Devices: mockDevices(40)}
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.CountDevicesInDitto)
+	env.RegisterActivity(mockActs.SendDittoProtocolMessage)
+
+	env.ExecuteWorkflow(workflow.MassDeviceConfigWorkflow, workflow.ConfigWorkflowParams{
+		RQLQuery: `eq(attributes/type,"gateway")`,
+		Rollout: workflow.RolloutPlan{Stages: []workflow.RolloutStage{
+			{Percent: 5, SoakDuration: time.Hour},
+			{Percent: 25, MaxErrorRate: 0.1},
+			{Percent: 100},
+		}},
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	var report workflow.RolloutReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.True(t, report.Completed)
+	require.Equal(t, 40, report.Total)
+	require.Equal(t, 40, report.Acknowledged)
+	require.Equal(t, 2, report.Stage)
+	require.Equal(t, 2, report.Stages[0].Processed)
+	require.Equal(t, 8, report.Stages[1].Processed)
+	require.Equal(t, 30, report.Stages[2].Processed)
+}
+
+func TestMassDeviceConfigWorkflow_HaltsWhenCanaryFails(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockConfigActivities{
+		Devices:    mockDevices(100),
+		FailThings: map[string]bool{"org.example:device-0": true},
+	}
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.CountDevicesInDitto)
+	env.RegisterActivity(mockActs.SendDittoProtocolMessage)
+
+	env.ExecuteWorkflow(workflow.MassDeviceConfigWorkflow, workflow.ConfigWorkflowParams{
+		RQLQuery: `eq(attributes/type,"gateway")`,
+		Rollout: workflow.RolloutPlan{Stages: []workflow.RolloutStage{
+			{Percent: 1},
+			{Percent: 100},
+		}},
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	var report workflow.RolloutReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.True(t, report.Halted)
+	require.False(t, report.Completed)
+	require.Equal(t, 1, report.Processed)
+	require.Contains(t, report.HaltReason, "stage 1")
+}
+
+func TestMassDeviceConfigWorkflow_HaltsWhenFinalStageFails(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockConfigActivities{
+		Devices:    mockDevices(10),
+		FailThings: map[string]bool{"org.example:device-8": true, "org.example:device-9": true},
+	}
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.CountDevicesInDitto)
+	env.RegisterActivity(mockActs.SendDittoProtocolMessage)
+
+	env.ExecuteWorkflow(workflow.MassDeviceConfigWorkflow, workflow.ConfigWorkflowParams{
+		RQLQuery: `eq(attributes/type,"gateway")`,
+		Rollout: workflow.RolloutPlan{Stages: []workflow.RolloutStage{
+			{Percent: 20},
+			{Percent: 100, MaxErrorRate: 0.1},
+		}},
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	var report workflow.RolloutReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.Equal(t, 10, report.Processed)
+	require.True(t, report.Halted)
+	require.False(t, report.Completed)
+	require.True(t, report.Stages[1].Completed)
+	require.Contains(t, report.HaltReason, "stage 2")
+}
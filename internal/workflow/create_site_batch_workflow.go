@@ -1,35 +1,206 @@
 package workflow
 
 import (
+	"crypto/sha256"
+	"dm-backend/internal/activities"
 	"dm-backend/internal/models"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
 	"time"
 
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/workflow"
 )
 
+const (
+	CreateSiteBatchProgressQuery = "create-site-batch-progress"
+	defaultSiteBatchConcurrency  = 10
+)
+
 // CreateSiteBatchWorkflowParams defines the input for the batch workflow
 type CreateSiteBatchWorkflowParams struct {
-	Sites []models.Site
+	Sites          []models.Site
+	MaxConcurrency int    // CreateSiteWorkflows running at the same time, defaults to 10
+	Target         string // Ditto target of all sites, empty for the default target
+}
+
+// Site statuses of a batch
+const (
+	SiteStatusPending    = "pending"
+	SiteStatusRunning    = "running"
+	SiteStatusCreated    = "created"
+	SiteStatusFailed     = "failed"
+	SiteStatusInProgress = "in_progress" // skipped, another workflow is creating the site
+	SiteStatusExists     = "exists"      // skipped, the gateway thing of the site exists
+)
+
+// SiteBatchResult is the outcome of one site of a batch
+type SiteBatchResult struct {
+	SiteName     string `json:"siteName"`
+	Status       string `json:"status"`
+	ThingID      string `json:"thingId,omitempty"`
+	ConnectionID string `json:"connectionId,omitempty"`
+	Error        string `json:"error,omitempty"`
+	ErrorCode    string `json:"errorCode,omitempty"` // Ditto error code of a failed site, e.g. "things:thing.notmodifiable"
+}
+
+// CreateSiteBatchSummary is the progress and, once completed, the result of a batch
+type CreateSiteBatchSummary struct {
+	Total   int               `json:"total"`
+	Pending int               `json:"pending"`
+	Running int               `json:"running"`
+	Created int               `json:"created"`
+	Skipped int               `json:"skipped"`
+	Failed  int               `json:"failed"`
+	Sites   []SiteBatchResult `json:"sites"`
 }
 
-// CreateSiteBatchWorkflow starts a CreateSiteWorkflow for each site in the batch
-func CreateSiteBatchWorkflow(ctx workflow.Context, params CreateSiteBatchWorkflowParams) error {
+// CreateSiteWorkflowID returns the workflow ID of the creation of a site, so a site is created by one workflow at a
+// time. Sites of different Ditto targets are independent; target is the resolved target name, also for the default
+// target. ':' separates the parts as neither target nor site names may contain it.
+func CreateSiteWorkflowID(target, siteName string) string {
+	return "create-site:" + target + ":" + siteName
+}
+
+// CreateSiteBatchWorkflowID derives the batch workflow ID from the target and site names, resubmitting the same
+// sites maps to the same batch
+func CreateSiteBatchWorkflowID(target string, sites []models.Site) string {
+	names := make([]string, len(sites))
+	for i, site := range sites {
+		names[i] = site.SiteName
+	}
+	sort.Strings(names)
+	names = append([]string{"target:" + target}, names...)
+	sum := sha256.Sum256([]byte(strings.Join(names, "\n")))
+	return "create-sites-" + hex.EncodeToString(sum[:8])
+}
+
+// CreateSiteBatchWorkflow runs a CreateSiteWorkflow for each site with at most MaxConcurrency at a time.
+// It waits for all of them, a failed site does not stop the others, and returns the result of every site.
+// Sites that are already being created by another workflow or that already exist are skipped.
+func CreateSiteBatchWorkflow(ctx workflow.Context, params CreateSiteBatchWorkflowParams) (CreateSiteBatchSummary, error) {
 	ao := workflow.ActivityOptions{
 		StartToCloseTimeout: time.Minute,
 	}
 	ctx = workflow.WithActivityOptions(ctx, ao)
+	ctx = activities.WithDittoTarget(ctx, params.Target)
+	logger := workflow.GetLogger(ctx)
+	if params.MaxConcurrency <= 0 {
+		params.MaxConcurrency = defaultSiteBatchConcurrency
+	}
+	// Site workflow IDs always name the target, the API passes it resolved
+	if params.Target == "" {
+		if err := workflow.ExecuteActivity(ctx, "DittoTarget").Get(ctx, &params.Target); err != nil {
+			return CreateSiteBatchSummary{}, err
+		}
+	}
 
-	futures := make([]workflow.Future, len(params.Sites))
+	results := make([]SiteBatchResult, len(params.Sites))
 	for i, site := range params.Sites {
-		siteParams := CreateSiteParams{Site: site}
-		futures[i] = workflow.ExecuteChildWorkflow(ctx, CreateSiteWorkflow, siteParams)
+		results[i] = SiteBatchResult{SiteName: site.SiteName, Status: SiteStatusPending}
 	}
+	err := workflow.SetQueryHandler(ctx, CreateSiteBatchProgressQuery, func() (CreateSiteBatchSummary, error) {
+		return summarizeSiteBatch(results), nil
+	})
+	if err != nil {
+		return CreateSiteBatchSummary{}, err
+	}
+
+	running := 0
+	wg := workflow.NewWaitGroup(ctx)
+	for i, site := range params.Sites {
+		workflow.Await(ctx, func() bool { return running < params.MaxConcurrency })
+		running++
+		results[i].Status = SiteStatusRunning
+		wg.Add(1)
+		workflow.Go(ctx, func(ctx workflow.Context) {
+			defer func() {
+				running--
+				wg.Done()
+			}()
+			childCtx := workflow.WithChildOptions(ctx, workflow.ChildWorkflowOptions{
+				WorkflowID: CreateSiteWorkflowID(params.Target, site.SiteName),
+				// A running creation of the same site is always rejected. Completed ones are not, so a deleted
+				// site can be created again. CreateThing rejects a site whose gateway thing the search finds;
+				// CreateSitePolicy only adopts an unused policy and the workflow never deletes an adopted one.
+				WorkflowIDReusePolicy: enumspb.WORKFLOW_ID_REUSE_POLICY_ALLOW_DUPLICATE,
+			})
+			var created CreateSiteResult
+			err := workflow.ExecuteChildWorkflow(childCtx, CreateSiteWorkflow, CreateSiteParams{Site: site, Target: params.Target}).Get(ctx, &created)
+			switch {
+			case err == nil:
+				results[i].Status = SiteStatusCreated
+				results[i].ThingID, results[i].ConnectionID = created.ThingID, created.ConnectionID
+			case isSiteInProgress(err):
+				logger.Info("Site is already being created, skipping", "siteName", site.SiteName)
+				results[i].Status = SiteStatusInProgress
+			case isSiteExists(err):
+				logger.Info("Site already exists, skipping", "siteName", site.SiteName)
+				results[i].Status = SiteStatusExists
+			default:
+				logger.Error("Site creation failed", "siteName", site.SiteName, "error", err)
+				results[i].Status = SiteStatusFailed
+				results[i].Error = siteErrorMessage(err)
+				if dittoErr, ok := activities.AsDittoError(err); ok {
+					results[i].ErrorCode = dittoErr.Code
+				}
+			}
+		})
+	}
+	wg.Wait(ctx)
+
+	summary := summarizeSiteBatch(results)
+	logger.Info("Site batch completed", "created", summary.Created, "skipped", summary.Skipped, "failed", summary.Failed)
+	return summary, nil
+}
+
+// summarizeSiteBatch counts the site statuses
+func summarizeSiteBatch(results []SiteBatchResult) CreateSiteBatchSummary {
+	summary := CreateSiteBatchSummary{Total: len(results), Sites: append([]SiteBatchResult{}, results...)}
+	for _, result := range results {
+		switch result.Status {
+		case SiteStatusPending:
+			summary.Pending++
+		case SiteStatusRunning:
+			summary.Running++
+		case SiteStatusCreated:
+			summary.Created++
+		case SiteStatusInProgress, SiteStatusExists:
+			summary.Skipped++
+		case SiteStatusFailed:
+			summary.Failed++
+		}
+	}
+	return summary
+}
+
+// siteErrorMessage returns the cause of a failed child workflow without the child workflow wrapper
+func siteErrorMessage(err error) string {
+	var childErr *temporal.ChildWorkflowExecutionError
+	if errors.As(err, &childErr) && errors.Unwrap(childErr) != nil {
+		return errors.Unwrap(childErr).Error()
+	}
+	return err.Error()
+}
+
+// isSiteInProgress reports whether a child workflow could not start because the site is being created already
+func isSiteInProgress(err error) bool {
+	var alreadyStarted *temporal.ChildWorkflowExecutionAlreadyStartedError
+	return errors.As(err, &alreadyStarted)
+}
 
-	// Wait for all child workflows to complete
-	for _, f := range futures {
-		if err := f.Get(ctx, nil); err != nil {
-			return err
+// isSiteExists reports whether a CreateSiteWorkflow failed because the site policy or gateway thing already exists.
+// Errors wrapped by the child workflow arrive as application errors themselves, so the whole chain is checked.
+func isSiteExists(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if appErr, ok := err.(*temporal.ApplicationError); ok {
+			if appErr.Type() == activities.ThingExistsErrorType || appErr.Type() == activities.PolicyExistsErrorType {
+				return true
+			}
 		}
 	}
-	return nil
+	return false
 }
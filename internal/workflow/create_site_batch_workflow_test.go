@@ -0,0 +1,173 @@
+package workflow_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"dm-backend/internal/activities"
+	"dm-backend/internal/models"
+	"dm-backend/internal/workflow"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/testsuite"
+	sdkworkflow "go.temporal.io/sdk/workflow"
+)
+
+func TestCreateSiteBatchWorkflow_UsesSiteWorkflowIDsAndSkipsExistingSites(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+	env.RegisterWorkflow(workflow.CreateSiteWorkflow)
+	env.RegisterActivity((&MockActivities{}).DittoTarget)
+
+	var ids []string
+	env.OnWorkflow(workflow.CreateSiteWorkflow, mock.Anything, mock.Anything).Return(
+		func(ctx sdkworkflow.Context, params workflow.CreateSiteParams) (workflow.CreateSiteResult, error) {
+			ids = append(ids, sdkworkflow.GetInfo(ctx).WorkflowExecution.ID)
+			if params.Site.SiteName == "site2" {
+				return workflow.CreateSiteResult{}, temporal.NewNonRetryableApplicationError("thing with siteName=site2 already exists", activities.ThingExistsErrorType, nil)
+			}
+			return workflow.CreateSiteResult{ThingID: "gateway:" + params.Site.SiteName, ConnectionID: params.Site.SiteName + "-conn-id"}, nil
+		})
+
+	env.ExecuteWorkflow(workflow.CreateSiteBatchWorkflow, workflow.CreateSiteBatchWorkflowParams{
+		Sites: []models.Site{{SiteName: "site1"}, {SiteName: "site2"}},
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	require.ElementsMatch(t, []string{"create-site:default:site1", "create-site:default:site2"}, ids)
+
+	var summary workflow.CreateSiteBatchSummary
+	require.NoError(t, env.GetWorkflowResult(&summary))
+	require.Equal(t, 1, summary.Created)
+	require.Equal(t, 1, summary.Skipped)
+	require.Equal(t, workflow.SiteBatchResult{SiteName: "site1", Status: workflow.SiteStatusCreated, ThingID: "gateway:site1", ConnectionID: "site1-conn-id"}, summary.Sites[0])
+	require.Equal(t, workflow.SiteStatusExists, summary.Sites[1].Status)
+}
+
+func TestCreateSiteBatchWorkflow_ReportsFailuresAndBoundsConcurrency(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+	env.RegisterWorkflow(workflow.CreateSiteWorkflow)
+	env.RegisterActivity((&MockActivities{}).DittoTarget)
+
+	running, maxRunning := 0, 0
+	env.OnWorkflow(workflow.CreateSiteWorkflow, mock.Anything, mock.Anything).Return(
+		func(ctx sdkworkflow.Context, params workflow.CreateSiteParams) (workflow.CreateSiteResult, error) {
+			running++
+			maxRunning = max(maxRunning, running)
+			defer func() { running-- }()
+			if err := sdkworkflow.Sleep(ctx, time.Minute); err != nil {
+				return workflow.CreateSiteResult{}, err
+			}
+			if params.Site.SiteName == "site3" {
+				return workflow.CreateSiteResult{}, errors.New("broker unreachable")
+			}
+			return workflow.CreateSiteResult{ThingID: "gateway:" + params.Site.SiteName}, nil
+		})
+
+	env.RegisterDelayedCallback(func() {
+		value, err := env.QueryWorkflow(workflow.CreateSiteBatchProgressQuery)
+		require.NoError(t, err)
+		var progress workflow.CreateSiteBatchSummary
+		require.NoError(t, value.Get(&progress))
+		require.Equal(t, 2, progress.Running)
+		require.Equal(t, 3, progress.Pending)
+	}, 30*time.Second)
+
+	sites := []models.Site{{SiteName: "site1"}, {SiteName: "site2"}, {SiteName: "site3"}, {SiteName: "site4"}, {SiteName: "site5"}}
+	env.ExecuteWorkflow(workflow.CreateSiteBatchWorkflow, workflow.CreateSiteBatchWorkflowParams{Sites: sites, MaxConcurrency: 2})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	require.Equal(t, 2, maxRunning)
+
+	var summary workflow.CreateSiteBatchSummary
+	require.NoError(t, env.GetWorkflowResult(&summary))
+	require.Equal(t, 5, summary.Total)
+	require.Equal(t, 4, summary.Created)
+	require.Equal(t, 1, summary.Failed)
+	require.Equal(t, workflow.SiteStatusFailed, summary.Sites[2].Status)
+	require.Contains(t, summary.Sites[2].Error, "broker unreachable")
+}
+
+func TestCreateSiteBatchWorkflow_ReportsExistingSitesOfChildWorkflows(t *testing.T) {
+	for name, mockActs := range map[string]*MockActivities{
+		"policy exists": {PolicyExists: true},
+		"thing exists":  {ThingExists: true},
+	} {
+		ts := testsuite.WorkflowTestSuite{}
+		env := ts.NewTestWorkflowEnvironment()
+		env.RegisterWorkflow(workflow.CreateSiteWorkflow)
+		registerSiteActivities(env, mockActs)
+
+		env.ExecuteWorkflow(workflow.CreateSiteBatchWorkflow, workflow.CreateSiteBatchWorkflowParams{
+			Sites: []models.Site{{SiteName: "site1", Host: "broker", Port: "1883"}},
+		})
+		require.True(t, env.IsWorkflowCompleted(), name)
+		require.NoError(t, env.GetWorkflowError(), name)
+		var summary workflow.CreateSiteBatchSummary
+		require.NoError(t, env.GetWorkflowResult(&summary), name)
+		require.Equal(t, workflow.SiteStatusExists, summary.Sites[0].Status, name)
+	}
+}
+
+func TestCreateSiteBatchWorkflow_ReportsDittoErrorCodes(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+	env.RegisterWorkflow(workflow.CreateSiteWorkflow)
+	registerSiteActivities(env, &MockActivities{CreateThingError: &activities.DittoError{
+		Status:  403,
+		Code:    "things:thing.notcreatable",
+		Message: "The Thing could not be created as the Policy does not allow it.",
+	}})
+
+	env.ExecuteWorkflow(workflow.CreateSiteBatchWorkflow, workflow.CreateSiteBatchWorkflowParams{
+		Sites: []models.Site{{SiteName: "site1", Host: "broker", Port: "1883"}},
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	var summary workflow.CreateSiteBatchSummary
+	require.NoError(t, env.GetWorkflowResult(&summary))
+	require.Equal(t, workflow.SiteStatusFailed, summary.Sites[0].Status)
+	require.Equal(t, "things:thing.notcreatable", summary.Sites[0].ErrorCode)
+}
+
+func TestCreateSiteBatchWorkflow_RunsSitesOnTarget(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	ts.SetContextPropagators([]sdkworkflow.ContextPropagator{activities.DittoTargetPropagator()})
+	env := ts.NewTestWorkflowEnvironment()
+	env.RegisterWorkflow(workflow.CreateSiteWorkflow)
+	mockActs := &MockActivities{}
+	registerSiteActivities(env, mockActs)
+	var ids []string
+	env.SetOnChildWorkflowStartedListener(func(info *sdkworkflow.Info, _ sdkworkflow.Context, _ converter.EncodedValues) {
+		ids = append(ids, info.WorkflowExecution.ID)
+	})
+
+	env.ExecuteWorkflow(workflow.CreateSiteBatchWorkflow, workflow.CreateSiteBatchWorkflowParams{
+		Sites:  []models.Site{{SiteName: "site1", Host: "broker", Port: "1883"}},
+		Target: "staging",
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	require.Equal(t, []string{"create-site:staging:site1"}, ids)
+	require.Equal(t, []string{"staging"}, mockActs.Targets)
+}
+
+func TestCreateSiteBatchWorkflowID_IgnoresOrder(t *testing.T) {
+	a := workflow.CreateSiteBatchWorkflowID("default", []models.Site{{SiteName: "site1"}, {SiteName: "site2"}})
+	b := workflow.CreateSiteBatchWorkflowID("default", []models.Site{{SiteName: "site2"}, {SiteName: "site1"}})
+	c := workflow.CreateSiteBatchWorkflowID("default", []models.Site{{SiteName: "site1"}})
+	d := workflow.CreateSiteBatchWorkflowID("staging", []models.Site{{SiteName: "site1"}, {SiteName: "site2"}})
+	require.Equal(t, a, b)
+	require.NotEqual(t, a, c)
+	require.NotEqual(t, a, d)
+}
+
+func TestCreateSiteWorkflowID_IsUnambiguous(t *testing.T) {
+	require.NotEqual(t, workflow.CreateSiteWorkflowID("eu", "west-site1"), workflow.CreateSiteWorkflowID("eu-west", "site1"))
+	require.Equal(t, "create-site:default:site1", workflow.CreateSiteWorkflowID("default", "site1"))
+}
@@ -10,13 +10,27 @@ import (
 	"go.temporal.io/sdk/workflow"
 )
 
+const (
+	defaultConnectTimeout  = 2 * time.Minute
+	connectionPollInterval = 5 * time.Second
+)
+
 // CreateSiteParams defines the input for the createSite workflow
 type CreateSiteParams struct {
-	Site models.Site
+	Site           models.Site
+	ConnectTimeout time.Duration // Time for the connection to report liveStatus open, defaults to 2 minutes
+	Target         string        // Ditto target, empty for the default target
+}
+
+// CreateSiteResult identifies the resources created for a site
+type CreateSiteResult struct {
+	ThingID      string
+	ConnectionID string
 }
 
-// CreateSiteWorkflow creates a gateway thing and a connection, with compensation on failure
-func CreateSiteWorkflow(ctx workflow.Context, params CreateSiteParams) error {
+// CreateSiteWorkflow creates a gateway thing and a connection, opens the connection and waits
+// until it is live, with compensation on failure
+func CreateSiteWorkflow(ctx workflow.Context, params CreateSiteParams) (CreateSiteResult, error) {
 	ao := workflow.ActivityOptions{
 		StartToCloseTimeout: time.Minute,
 		RetryPolicy: &temporal.RetryPolicy{
@@ -26,78 +40,178 @@ func CreateSiteWorkflow(ctx workflow.Context, params CreateSiteParams) error {
 		},
 	}
 	ctx = workflow.WithActivityOptions(ctx, ao)
+	ctx = activities.WithDittoTarget(ctx, params.Target)
+	if err := params.Site.Validate(); err != nil {
+		return CreateSiteResult{}, temporal.NewNonRetryableApplicationError(err.Error(), "InvalidSite", nil)
+	}
+
+	// 0. Pin the connection template version, it is recorded on the gateway thing
+	templateVersion, err := connectionTemplateVersion(ctx, params.Site.TemplateName())
+	if err != nil {
+		return CreateSiteResult{}, err
+	}
+
+	// 1. Create the site policy from the policy template
+	policyID := models.SitePolicyID(params.Site.SiteName)
+	createPolicyParams := activities.CreateSitePolicyParams{PolicyID: policyID, SiteName: params.Site.SiteName}
+	var sitePolicy activities.CreateSitePolicyResult
+	if err := workflow.ExecuteActivity(ctx, "CreateSitePolicy", createPolicyParams).Get(ctx, &sitePolicy); err != nil {
+		return CreateSiteResult{}, err
+	}
+	var undo compensations
+	// An adopted policy may belong to a site whose thing the search did not list yet, only delete our own
+	if sitePolicy.Created {
+		undo.addActivity("DeletePolicy", activities.DeletePolicyParams{PolicyID: policyID})
+	}
 
-	// 1. Create Gateway Thing
+	// 2. Create Gateway Thing with the site policy
 	thingData := map[string]interface{}{
+		"policyId": policyID,
 		"attributes": map[string]interface{}{
-			"siteName":        params.Site.SiteName, // unique attribute
-			"siteDescription": params.Site.Description,
+			"siteName":                  params.Site.SiteName, // unique attribute
+			"siteDescription":           params.Site.Description,
+			"connectionTemplate":        params.Site.TemplateName(),
+			"connectionTemplateVersion": templateVersion,
 		},
 	}
 	createThingParams := activities.CreateThingParams{
-		Namespace:          "gateway", // or use from config if needed
+		Namespace:          models.SiteNamespace,
 		UniqueAttributeKey: "siteName",
 		ThingData:          thingData,
 	}
 	var thingID string
-	err := workflow.ExecuteActivity(ctx, "CreateThing", createThingParams).Get(ctx, &thingID)
+	err = workflow.ExecuteActivity(ctx, "CreateThing", createThingParams).Get(ctx, &thingID)
 	if err != nil {
-		return err
-	}
-
-	var subject = fmt.Sprintf("integration:%s", thingID)
-
-	// 1.5. Update Gateway Policy by sending Ditto Protocol Message
-	updatePolicyParams := activities.SendDittoProtocolMessageParams{
-		ThingId: thingID,
-		Message: models.DittoProtocolMessage{
-			Topic:   "<namespace>/<name>/policies/commands/modify",
-			Headers: map[string]interface{}{"correlation-id": "update-policy"},
-			Path:    "entries/DEVICE",
-			Value: map[string]interface{}{
-				"subjects": map[string]interface{}{
-					subject: map[string]interface{}{
-						"type": "connection",
-					},
-				},
-				"resources": map[string]interface{}{
-					"thing:/": map[string]interface{}{
-						"grant":  []string{"READ", "WRITE"},
-						"revoke": []string{},
-					},
-					"message:/": map[string]interface{}{
-						"grant":  []string{"READ", "WRITE"},
-						"revoke": []string{},
-					},
-				},
-			},
-		},
+		return CreateSiteResult{}, undo.compensate(ctx, "createGatewayThing", err)
 	}
-	err = workflow.ExecuteActivity(ctx, "UpdateGatewayPolicy", updatePolicyParams).Get(ctx, nil)
+	undo.addActivity("DeleteThing", activities.DeleteThingParams{ThingID: thingID})
+
+	// 3. Grant the site connection access to the gateway thing
+	err = workflow.ExecuteActivity(ctx, "ModifyPolicyEntry", gatewayPolicyEntryParams(policyID, thingID)).Get(ctx, nil)
 	if err != nil {
-		// Compensation: delete the thing if policy update fails after retries
-		_ = workflow.ExecuteActivity(ctx, "DeleteThing", thingID)
-		return fmt.Errorf("updateGatewayPolicy failed after retries: %w", err)
+		return CreateSiteResult{}, undo.compensate(ctx, "updateGatewayPolicy", err)
 	}
 
-	// 2. Create Gateway Connection
+	// 4. Create Gateway Connection
 	createConnParams := activities.CreateConnectionParams{
-		ConnectionName: params.Site.SiteName + "-conn",
-		TemplateName:   "mqtt5",
-		Placeholders: map[string]string{
-			"ThingID":        thingID,
-			"ConnectionName": params.Site.SiteName + "-conn",
-			"MQTTHost":       params.Site.Host,
-			"MQTTPort":       params.Site.Port,
-			"Username":       params.Site.Username,
-			"Password":       params.Site.Password,
-		},
+		ConnectionName:  models.SiteConnectionName(params.Site.SiteName),
+		TemplateName:    params.Site.TemplateName(),
+		TemplateVersion: templateVersion,
+		Placeholders:    params.Site.ConnectionPlaceholders(thingID),
+		Secrets:         params.Site.ConnectionSecrets(),
 	}
-	err = workflow.ExecuteActivity(ctx, "CreateConnection", createConnParams).Get(ctx, nil)
+	var connectionID string
+	err = workflow.ExecuteActivity(ctx, "CreateConnection", createConnParams).Get(ctx, &connectionID)
 	if err != nil {
 		// Compensation: delete the thing if connection creation fails after retries
-		_ = workflow.ExecuteActivity(ctx, "DeleteThing", thingID)
-		return fmt.Errorf("createGatewayConnection failed after retries: %w", err)
+		return CreateSiteResult{}, undo.compensate(ctx, "createGatewayConnection", err)
 	}
-	return nil
+	undo.addActivity("DeleteConnection", activities.DeleteConnectionParams{ConnectionID: connectionID})
+
+	// 5. Open the connection and wait until it is live
+	openParams := activities.ConnectionCommandParams{ConnectionID: connectionID, Command: activities.OpenConnectionCommand}
+	if err := workflow.ExecuteActivity(ctx, "SendConnectionCommand", openParams).Get(ctx, nil); err != nil {
+		return CreateSiteResult{}, undo.compensate(ctx, "openGatewayConnection", err)
+	}
+	connectTimeout := params.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	if err := waitForConnectionOpen(ctx, connectionID, connectTimeout); err != nil {
+		return CreateSiteResult{}, undo.compensate(ctx, "waitForGatewayConnection", err)
+	}
+	return CreateSiteResult{ThingID: thingID, ConnectionID: connectionID}, nil
+}
+
+// waitForConnectionOpen polls the live status of a connection with a durable timer until it is open.
+// It fails with a non-retryable error reporting the last live status once the timeout passes.
+func waitForConnectionOpen(ctx workflow.Context, connectionID string, timeout time.Duration) error {
+	deadline := workflow.Now(ctx).Add(timeout)
+	statusParams := activities.GetConnectionStatusParams{ConnectionID: connectionID}
+	for {
+		var liveStatus string
+		err := workflow.ExecuteActivity(ctx, "GetConnectionStatus", statusParams).Get(ctx, &liveStatus)
+		if err != nil {
+			return err
+		}
+		if liveStatus == "open" {
+			return nil
+		}
+		if !workflow.Now(ctx).Before(deadline) {
+			return temporal.NewNonRetryableApplicationError(
+				fmt.Sprintf("connection %s did not open within %s, last live status %q: broker unreachable or credentials rejected", connectionID, timeout, liveStatus),
+				"ConnectionNotOpen", nil)
+		}
+		if err := workflow.Sleep(ctx, connectionPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// gatewayPolicyLabel is the label of the policy entry granting the site connection access to the gateway thing
+const gatewayPolicyLabel = "DEVICE"
+
+// gatewayPolicyEntryParams creates or replaces the gateway policy entry of the site connection
+func gatewayPolicyEntryParams(policyID, thingID string) activities.ModifyPolicyEntryParams {
+	return activities.ModifyPolicyEntryParams{
+		PolicyID: policyID,
+		Label:    gatewayPolicyLabel,
+		Entry: map[string]interface{}{
+			"subjects": map[string]interface{}{
+				fmt.Sprintf("integration:%s", thingID): map[string]interface{}{
+					"type": "connection",
+				},
+			},
+			"resources": map[string]interface{}{
+				"thing:/": map[string]interface{}{
+					"grant":  []string{"READ", "WRITE"},
+					"revoke": []string{},
+				},
+				"message:/": map[string]interface{}{
+					"grant":  []string{"READ", "WRITE"},
+					"revoke": []string{},
+				},
+			},
+		},
+	}
+}
+
+// connectionTemplateVersion returns the latest version of a connection template
+func connectionTemplateVersion(ctx workflow.Context, templateName string) (int, error) {
+	var version int
+	err := workflow.ExecuteActivity(ctx, "GetConnectionTemplateVersion", activities.GetConnectionTemplateParams{
+		TemplateName: templateName,
+	}).Get(ctx, &version)
+	return version, err
+}
+
+// findSiteThing looks up the gateway thing of a site by its unique siteName attribute
+func findSiteThing(ctx workflow.Context, siteName string) (models.Device, bool, error) {
+	searchParams := activities.SearchThingsParams{
+		Filter:   fmt.Sprintf(`eq(attributes/siteName,%q)`, siteName),
+		Fields:   []string{"thingId", "policyId", "attributes"},
+		PageSize: 1,
+	}
+	var page activities.DevicePage
+	if err := workflow.ExecuteActivity(ctx, "FetchDevicePage", searchParams).Get(ctx, &page); err != nil {
+		return models.Device{}, false, err
+	}
+	if len(page.Items) == 0 {
+		return models.Device{}, false, nil
+	}
+	return page.Items[0], true, nil
+}
+
+// findSiteConnection returns the ID of the site connection, or "" if there is none
+func findSiteConnection(ctx workflow.Context, siteName string) (string, error) {
+	var connectionID string
+	err := workflow.ExecuteActivity(ctx, "FindConnection", activities.FindConnectionParams{
+		ConnectionName: models.SiteConnectionName(siteName),
+	}).Get(ctx, &connectionID)
+	return connectionID, err
+}
+
+// siteNotFoundError fails a site workflow without retries when the site does not exist
+func siteNotFoundError(siteName string) error {
+	return temporal.NewNonRetryableApplicationError(fmt.Sprintf("site %s not found", siteName), "SiteNotFound", nil)
 }
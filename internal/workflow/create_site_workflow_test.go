@@ -1,26 +1,45 @@
 package workflow_test
 
 import (
+	"context"
 	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	"dm-backend/internal/activities"
 	"dm-backend/internal/models"
 	"dm-backend/internal/workflow"
 
 	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/testsuite"
 )
 
 type MockActivities struct {
+	PolicyExists         bool
+	PolicyAdopted        bool // CreateSitePolicy adopts an existing policy instead of creating it
+	ThingExists          bool
 	FailCreateThing      bool
+	CreateThingError     *activities.DittoError // returned by CreateThing as the Ditto error of a rejected request
 	FailCreateConnection bool
+	LiveStatuses         []string // returned by successive GetConnectionStatus calls, the last one repeats
+
+	mu      sync.Mutex
+	Deleted []string
+	Targets []string // Ditto targets CreateSitePolicy was called for
 }
 
 func (m *MockActivities) CreateThing(_ interface{}, _ activities.CreateThingParams) (string, error) {
 	if m.FailCreateThing {
 		return "", errors.New("CreateThing failed")
 	}
+	if m.ThingExists {
+		return "", temporal.NewNonRetryableApplicationError("thing with siteName=site1 already exists", activities.ThingExistsErrorType, nil)
+	}
+	if m.CreateThingError != nil {
+		return "", temporal.NewNonRetryableApplicationError(m.CreateThingError.Error(), activities.DittoErrorType, nil, *m.CreateThingError)
+	}
 	return "gateway:site-thing-id", nil
 }
 
@@ -31,18 +50,90 @@ func (m *MockActivities) CreateConnection(_ interface{}, _ activities.CreateConn
 	return "site-conn-id", nil
 }
 
-func (m *MockActivities) DeleteThing(_ interface{}, _ string) error {
+func (m *MockActivities) CreateSitePolicy(ctx context.Context, params activities.CreateSitePolicyParams) (activities.CreateSitePolicyResult, error) {
+	m.mu.Lock()
+	m.Targets = append(m.Targets, activities.DittoTargetFromContext(ctx))
+	m.mu.Unlock()
+	if m.PolicyExists {
+		return activities.CreateSitePolicyResult{}, temporal.NewNonRetryableApplicationError("policy "+params.PolicyID+" already exists", activities.PolicyExistsErrorType, nil)
+	}
+	return activities.CreateSitePolicyResult{Created: !m.PolicyAdopted}, nil
+}
+
+func (m *MockActivities) ModifyPolicyEntry(_ context.Context, _ activities.ModifyPolicyEntryParams) error {
+	return nil
+}
+
+func (m *MockActivities) DeletePolicy(_ context.Context, params activities.DeletePolicyParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Deleted = append(m.Deleted, params.PolicyID)
+	return nil
+}
+
+func (m *MockActivities) GetConnectionTemplateVersion(_ context.Context, _ activities.GetConnectionTemplateParams) (int, error) {
+	return 1, nil
+}
+
+func (m *MockActivities) SendConnectionCommand(_ context.Context, _ activities.ConnectionCommandParams) error {
+	return nil
+}
+
+func (m *MockActivities) GetConnectionStatus(_ context.Context, _ activities.GetConnectionStatusParams) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.LiveStatuses) == 0 {
+		return "open", nil
+	}
+	status := m.LiveStatuses[0]
+	if len(m.LiveStatuses) > 1 {
+		m.LiveStatuses = m.LiveStatuses[1:]
+	}
+	return status, nil
+}
+
+func (m *MockActivities) DeleteConnection(_ context.Context, params activities.DeleteConnectionParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Deleted = append(m.Deleted, params.ConnectionID)
 	return nil
 }
 
+func (m *MockActivities) DeleteThing(_ context.Context, params activities.DeleteThingParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Deleted = append(m.Deleted, params.ThingID)
+	return nil
+}
+
+// DittoTarget resolves the default target to "default" like a worker with only the DITTO_* settings
+func (m *MockActivities) DittoTarget(ctx context.Context) (string, error) {
+	if target := activities.DittoTargetFromContext(ctx); target != "" {
+		return target, nil
+	}
+	return "default", nil
+}
+
+func registerSiteActivities(env *testsuite.TestWorkflowEnvironment, mockActs *MockActivities) {
+	env.RegisterActivity(mockActs.DittoTarget)
+	env.RegisterActivity(mockActs.CreateThing)
+	env.RegisterActivity(mockActs.CreateConnection)
+	env.RegisterActivity(mockActs.DeleteThing)
+	env.RegisterActivity(mockActs.CreateSitePolicy)
+	env.RegisterActivity(mockActs.ModifyPolicyEntry)
+	env.RegisterActivity(mockActs.DeletePolicy)
+	env.RegisterActivity(mockActs.SendConnectionCommand)
+	env.RegisterActivity(mockActs.GetConnectionTemplateVersion)
+	env.RegisterActivity(mockActs.GetConnectionStatus)
+	env.RegisterActivity(mockActs.DeleteConnection)
+}
+
 func TestCreateSiteWorkflow_Success(t *testing.T) {
 	ts := testsuite.WorkflowTestSuite{}
 	env := ts.NewTestWorkflowEnvironment()
 
 	mockActs := &MockActivities{}
-	env.RegisterActivity(mockActs.CreateThing)
-	env.RegisterActivity(mockActs.CreateConnection)
-	env.RegisterActivity(mockActs.DeleteThing)
+	registerSiteActivities(env, mockActs)
 
 	params := workflow.CreateSiteParams{
 		Site: models.Site{
@@ -58,6 +149,10 @@ func TestCreateSiteWorkflow_Success(t *testing.T) {
 	env.ExecuteWorkflow(workflow.CreateSiteWorkflow, params)
 	require.True(t, env.IsWorkflowCompleted())
 	require.NoError(t, env.GetWorkflowError())
+
+	var result workflow.CreateSiteResult
+	require.NoError(t, env.GetWorkflowResult(&result))
+	require.Equal(t, workflow.CreateSiteResult{ThingID: "gateway:site-thing-id", ConnectionID: "site-conn-id"}, result)
 }
 
 func TestCreateSiteWorkflow_CreateThingFails(t *testing.T) {
@@ -65,9 +160,7 @@ func TestCreateSiteWorkflow_CreateThingFails(t *testing.T) {
 	env := ts.NewTestWorkflowEnvironment()
 
 	mockActs := &MockActivities{FailCreateThing: true}
-	env.RegisterActivity(mockActs.CreateThing)
-	env.RegisterActivity(mockActs.CreateConnection)
-	env.RegisterActivity(mockActs.DeleteThing)
+	registerSiteActivities(env, mockActs)
 
 	params := workflow.CreateSiteParams{
 		Site: models.Site{
@@ -84,6 +177,39 @@ func TestCreateSiteWorkflow_CreateThingFails(t *testing.T) {
 	require.True(t, env.IsWorkflowCompleted())
 	require.Error(t, env.GetWorkflowError())
 	require.Contains(t, env.GetWorkflowError().Error(), "CreateThing failed")
+	require.Equal(t, []string{"gateway:site1-policy"}, mockActs.Deleted)
+}
+
+func TestCreateSiteWorkflow_PolicyExists(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockActivities{PolicyExists: true}
+	registerSiteActivities(env, mockActs)
+
+	env.ExecuteWorkflow(workflow.CreateSiteWorkflow, workflow.CreateSiteParams{
+		Site: models.Site{SiteName: "site1", Host: "localhost", Port: "1883"},
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	var appErr *temporal.ApplicationError
+	require.ErrorAs(t, env.GetWorkflowError(), &appErr)
+	require.Equal(t, activities.PolicyExistsErrorType, appErr.Type())
+	require.Empty(t, mockActs.Deleted)
+}
+
+func TestCreateSiteWorkflow_KeepsAdoptedPolicyWhenThingExists(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockActivities{PolicyAdopted: true, ThingExists: true}
+	registerSiteActivities(env, mockActs)
+
+	env.ExecuteWorkflow(workflow.CreateSiteWorkflow, workflow.CreateSiteParams{
+		Site: models.Site{SiteName: "site1", Host: "localhost", Port: "1883"},
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.ErrorContains(t, env.GetWorkflowError(), "thing with siteName=site1 already exists")
+	require.Empty(t, mockActs.Deleted, "the adopted policy may belong to the live site")
 }
 
 func TestCreateSiteWorkflow_CreateConnectionFailsWithCompensation(t *testing.T) {
@@ -91,9 +217,7 @@ func TestCreateSiteWorkflow_CreateConnectionFailsWithCompensation(t *testing.T)
 	env := ts.NewTestWorkflowEnvironment()
 
 	mockActs := &MockActivities{FailCreateConnection: true}
-	env.RegisterActivity(mockActs.CreateThing)
-	env.RegisterActivity(mockActs.CreateConnection)
-	env.RegisterActivity(mockActs.DeleteThing)
+	registerSiteActivities(env, mockActs)
 
 	params := workflow.CreateSiteParams{
 		Site: models.Site{
@@ -110,4 +234,53 @@ func TestCreateSiteWorkflow_CreateConnectionFailsWithCompensation(t *testing.T)
 	require.True(t, env.IsWorkflowCompleted())
 	require.Error(t, env.GetWorkflowError())
 	require.Contains(t, env.GetWorkflowError().Error(), "createGatewayConnection failed after retries")
+	require.Equal(t, []string{"gateway:site-thing-id", "gateway:site1-policy"}, mockActs.Deleted)
+}
+
+func TestCreateSiteWorkflow_WaitsForConnectionOpen(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockActivities{LiveStatuses: []string{"closed", "closed", "open"}}
+	registerSiteActivities(env, mockActs)
+
+	env.ExecuteWorkflow(workflow.CreateSiteWorkflow, workflow.CreateSiteParams{
+		Site: models.Site{SiteName: "site1", Host: "localhost", Port: "1883"},
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	require.Empty(t, mockActs.Deleted)
+}
+
+func TestCreateSiteWorkflow_ConnectionNeverOpensWithCompensation(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockActivities{LiveStatuses: []string{"failed"}}
+	registerSiteActivities(env, mockActs)
+
+	env.ExecuteWorkflow(workflow.CreateSiteWorkflow, workflow.CreateSiteParams{
+		Site:           models.Site{SiteName: "site1", Host: "unreachable", Port: "1883"},
+		ConnectTimeout: time.Minute,
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.Error(t, env.GetWorkflowError())
+	require.Contains(t, env.GetWorkflowError().Error(), `did not open within 1m0s, last live status "failed"`)
+	// Connection is deleted before the thing and the thing before its policy
+	require.Equal(t, []string{"site-conn-id", "gateway:site-thing-id", "gateway:site1-policy"}, mockActs.Deleted)
+}
+
+func TestCreateSiteWorkflow_InvalidSite(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockActivities{}
+	registerSiteActivities(env, mockActs)
+
+	env.ExecuteWorkflow(workflow.CreateSiteWorkflow, workflow.CreateSiteParams{
+		Site: models.Site{SiteName: "site1", Protocol: models.SiteProtocolAMQP10, Host: "broker", Port: "5671"},
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.Error(t, env.GetWorkflowError())
+	require.Contains(t, env.GetWorkflowError().Error(), "sourceAddress and targetAddress are required for amqp10")
 }
@@ -0,0 +1,110 @@
+package workflow
+
+import (
+	"dm-backend/internal/activities"
+	"dm-backend/internal/models"
+	"fmt"
+	"time"
+
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// deleteSitePolicyTimeout bounds the retries of deleting the site policy of a decommissioned site
+const deleteSitePolicyTimeout = 10 * time.Minute
+
+// DeleteSiteParams defines the input for the deleteSite workflow
+type DeleteSiteParams struct {
+	SiteName string
+	Target   string // Ditto target, empty for the default target
+}
+
+// DeleteSiteWorkflow decommissions a site: it closes and deletes the connection, removes the gateway
+// policy entry and deletes the gateway thing and its site policy. Completed steps are undone when a later step fails.
+func DeleteSiteWorkflow(ctx workflow.Context, params DeleteSiteParams) error {
+	ao := workflow.ActivityOptions{
+		StartToCloseTimeout: time.Minute,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			BackoffCoefficient: 2.0,
+			MaximumAttempts:    5,
+		},
+	}
+	ctx = workflow.WithActivityOptions(ctx, ao)
+	ctx = activities.WithDittoTarget(ctx, params.Target)
+	if err := models.ValidateSiteName(params.SiteName); err != nil {
+		return temporal.NewNonRetryableApplicationError(err.Error(), "InvalidSite", nil)
+	}
+
+	thing, found, err := findSiteThing(ctx, params.SiteName)
+	if err != nil {
+		return err
+	}
+	connectionID, err := findSiteConnection(ctx, params.SiteName)
+	if err != nil {
+		return err
+	}
+	if !found && connectionID == "" {
+		return siteNotFoundError(params.SiteName)
+	}
+
+	var undo compensations
+
+	// 1. Close and delete the connection, keeping its definition in the snapshot store to recreate it
+	if connectionID != "" {
+		snapshotParams := activities.SnapshotConnectionParams{SnapshotID: connectionSnapshotID(ctx), ConnectionID: connectionID}
+		defer deleteSnapshot(disconnected(ctx), snapshotParams.SnapshotID)
+		var previous activities.ConnectionSnapshot
+		if err := workflow.ExecuteActivity(ctx, "SnapshotConnection", snapshotParams).Get(ctx, &previous); err != nil {
+			return err
+		}
+		closeParams := activities.ConnectionCommandParams{ConnectionID: connectionID, Command: activities.CloseConnectionCommand}
+		if err := workflow.ExecuteActivity(ctx, "SendConnectionCommand", closeParams).Get(ctx, nil); err != nil {
+			return fmt.Errorf("closeGatewayConnection failed after retries: %w", err)
+		}
+		if previous.ConnectionStatus == "open" {
+			undo.addActivity("SendConnectionCommand", activities.ConnectionCommandParams{ConnectionID: connectionID, Command: activities.OpenConnectionCommand})
+		}
+
+		err = workflow.ExecuteActivity(ctx, "DeleteConnection", activities.DeleteConnectionParams{ConnectionID: connectionID}).Get(ctx, nil)
+		if err != nil {
+			return undo.compensate(ctx, "deleteGatewayConnection", err)
+		}
+		undo.addActivity("RestoreConnection", activities.RestoreConnectionParams{SnapshotID: snapshotParams.SnapshotID, ConnectionID: connectionID})
+	}
+	if !found {
+		return nil
+	}
+
+	// 2. Remove the gateway policy entry of the connection
+	removeEntryParams := activities.DeletePolicyEntryParams{PolicyID: thing.PolicyId, Label: gatewayPolicyLabel}
+	if err := workflow.ExecuteActivity(ctx, "DeletePolicyEntry", removeEntryParams).Get(ctx, nil); err != nil {
+		return undo.compensate(ctx, "removeGatewayPolicyEntry", err)
+	}
+	undo.addActivity("ModifyPolicyEntry", gatewayPolicyEntryParams(thing.PolicyId, thing.ThingId))
+
+	// 3. Delete the gateway thing
+	if err := workflow.ExecuteActivity(ctx, "DeleteThing", activities.DeleteThingParams{ThingID: thing.ThingId}).Get(ctx, nil); err != nil {
+		return undo.compensate(ctx, "deleteGatewayThing", err)
+	}
+
+	// 4. Delete the site policy. Sites created before they had a dedicated policy keep theirs.
+	// The site is gone at this point, so a failure is not compensated: the deletion is retried for
+	// longer and the workflow fails if the policy is still left. Creating the site again adopts it.
+	if thing.PolicyId == models.SitePolicyID(params.SiteName) {
+		policyCtx := workflow.WithActivityOptions(ctx, workflow.ActivityOptions{
+			StartToCloseTimeout:    time.Minute,
+			ScheduleToCloseTimeout: deleteSitePolicyTimeout,
+			RetryPolicy: &temporal.RetryPolicy{
+				InitialInterval:    time.Second,
+				BackoffCoefficient: 2.0,
+				MaximumInterval:    time.Minute,
+			},
+		})
+		err := workflow.ExecuteActivity(policyCtx, "DeletePolicy", activities.DeletePolicyParams{PolicyID: thing.PolicyId}).Get(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("deleteSitePolicy failed after retries, the site is decommissioned but its policy %s is left: %w", thing.PolicyId, err)
+		}
+	}
+	return nil
+}
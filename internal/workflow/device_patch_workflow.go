@@ -0,0 +1,329 @@
+package workflow
+
+import (
+	"dm-backend/internal/activities"
+	"fmt"
+	"time"
+
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// RollbackSignal requests a DevicePatchWorkflow to restore the snapshotted values of the patched devices
+const RollbackSignal = "rollback"
+
+// DevicePatchStatusQuery is the query type that returns the current DevicePatchReport
+const DevicePatchStatusQuery = "device-patch-status"
+
+type DevicePatchParams struct {
+	RQLQuery         string
+	Path             string                 // Thing resource to patch: /attributes (default) or /features/<featureId>/properties
+	Patch            map[string]interface{} // JSON merge patch applied to the resource of each matched thing
+	Condition        string                 // Optional RQL condition each thing must fulfil when patched
+	BatchSize        int                    // Devices fetched and patched per page, defaults to 100 (max 200)
+	MaxConcurrency   int                    // Max devices patched in parallel, defaults to 10
+	MaxBatchesPerRun int                    // Pages processed before continuing as new, defaults to 50
+	AutoRollback     bool                   // Stop patching and restore the patched devices as soon as any device fails
+	RollbackWindow   time.Duration          // How long a rollback can be requested after patching
+	Target           string                 // Ditto target, empty for the default target
+
+	// Carried across continue-as-new, leave empty when starting a patch
+	SnapshotID        string // Groups the device snapshots in the worker's snapshot store
+	Cursor            string // Search cursor while patching, snapshot cursor while rolling back
+	RollingBack       bool
+	RollbackRequested bool // A RollbackSignal arrived while patching
+	Report            DevicePatchReport
+}
+
+// DevicePatchReport summarizes a device patch. Acknowledged and restored devices are only counted;
+// failed and skipped devices and failed restores are listed in Outcomes, so the report stays small
+// enough to carry across continue-as-new.
+type DevicePatchReport struct {
+	Patched           int             `json:"patched"`
+	Failed            int             `json:"failed"`
+	Skipped           int             `json:"skipped"`
+	RolledBack        int             `json:"rolledBack"`
+	RollbackFailed    int             `json:"rollbackFailed"`
+	Outcomes          []DeviceOutcome `json:"outcomes"`
+	OutcomesTruncated bool            `json:"outcomesTruncated,omitempty"`
+}
+
+// DevicePatchWorkflow merge-patches the attributes or feature properties of every thing matched by
+// the RQL query using the ConfigureDevice activity, page by page, continuing as new with the search
+// cursor when its history grows. Before patching, the affected values of each device are snapshotted
+// into the worker's snapshot store, outside the workflow history, and the patch is conditioned on the
+// snapshot's ETag, so the change can be compensated: automatically when AutoRollback is set and a
+// device fails, or on a RollbackSignal received within the RollbackWindow. Only acknowledged patches
+// are rolled back, each restore is conditioned on the ETag the patch left, so later changes to a
+// device are not overwritten.
+func DevicePatchWorkflow(ctx workflow.Context, params DevicePatchParams) (DevicePatchReport, error) {
+	ao := workflow.ActivityOptions{
+		StartToCloseTimeout: time.Minute,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			BackoffCoefficient: 2.0,
+			MaximumAttempts:    3,
+		},
+	}
+	ctx = workflow.WithActivityOptions(ctx, ao)
+	ctx = activities.WithDittoTarget(ctx, params.Target)
+	if params.BatchSize <= 0 {
+		params.BatchSize = defaultBatchSize
+	}
+	if params.MaxConcurrency <= 0 {
+		params.MaxConcurrency = defaultMaxConcurrency
+	}
+	if params.MaxBatchesPerRun <= 0 {
+		params.MaxBatchesPerRun = defaultMaxBatchesPerRun
+	}
+	if params.Path == "" {
+		params.Path = activities.DefaultDevicePatchPath
+	}
+	if err := activities.ValidateDevicePatchPath(params.Path); err != nil {
+		return DevicePatchReport{}, temporal.NewNonRetryableApplicationError(err.Error(), "InvalidPatchPath", err)
+	}
+	if params.SnapshotID == "" {
+		execution := workflow.GetInfo(ctx).WorkflowExecution
+		params.SnapshotID = "device-patch/" + execution.ID + "/" + execution.RunID
+	}
+
+	report := params.Report
+	err := workflow.SetQueryHandler(ctx, DevicePatchStatusQuery, func() (DevicePatchReport, error) {
+		return report, nil
+	})
+	if err != nil {
+		return report, err
+	}
+	rollbackRequests := workflow.GetSignalChannel(ctx, RollbackSignal)
+	continueAsNew := func() (DevicePatchReport, error) {
+		// Signals still buffered would be lost with this run
+		for rollbackRequests.ReceiveAsync(nil) {
+			params.RollbackRequested = true
+		}
+		workflow.GetLogger(ctx).Info("Continuing as new", "Patched", report.Patched, "RollingBack", params.RollingBack)
+		params.Report = report
+		return report, workflow.NewContinueAsNewError(ctx, DevicePatchWorkflow, params)
+	}
+
+	if !params.RollingBack {
+		// Snapshot and patch the matched things page by page
+		for batches := 0; ; batches++ {
+			if batches >= params.MaxBatchesPerRun || workflow.GetInfo(ctx).GetContinueAsNewSuggested() {
+				return continueAsNew()
+			}
+			var page activities.DevicePage
+			searchParams := activities.SearchThingsParams{
+				Filter:   params.RQLQuery,
+				Fields:   []string{"thingId"},
+				PageSize: params.BatchSize,
+				Cursor:   params.Cursor,
+			}
+			if err := workflow.ExecuteActivity(ctx, "FetchDevicePage", searchParams).Get(ctx, &page); err != nil {
+				return report, err
+			}
+			batch := make([]DeviceOutcome, len(page.Items))
+			for i, device := range page.Items {
+				batch[i] = DeviceOutcome{ThingId: device.ThingId, Status: DeviceStatusPending}
+			}
+			if err := patchDevices(ctx, batch, params); err != nil {
+				return report, err
+			}
+			report.record(batch)
+			if (params.AutoRollback && report.Failed > 0) || page.Cursor == "" {
+				break
+			}
+			params.Cursor = page.Cursor
+		}
+
+		// Compensate
+		rollback := params.AutoRollback && report.Failed > 0
+		if rollback {
+			workflow.GetLogger(ctx).Info("Rolling back device patch", "Failed", report.Failed)
+		} else if params.RollbackWindow > 0 && report.Patched > 0 {
+			rollback = params.RollbackRequested || awaitRollbackRequest(ctx, rollbackRequests, params.RollbackWindow)
+			if rollback {
+				workflow.GetLogger(ctx).Info("Rolling back device patch on request")
+			}
+		}
+		if !rollback {
+			deleteSnapshot(ctx, params.SnapshotID)
+			return report, nil
+		}
+		params.RollingBack, params.Cursor = true, ""
+	}
+
+	// Restore the acknowledged devices page by page
+	for batches := 0; ; batches++ {
+		if batches >= params.MaxBatchesPerRun || workflow.GetInfo(ctx).GetContinueAsNewSuggested() {
+			return continueAsNew()
+		}
+		var page activities.PatchedDevicePage
+		listParams := activities.ListPatchedDevicesParams{SnapshotID: params.SnapshotID, Cursor: params.Cursor, PageSize: params.BatchSize}
+		if err := workflow.ExecuteActivity(ctx, "ListPatchedDevices", listParams).Get(ctx, &page); err != nil {
+			return report, err
+		}
+		if err := restoreDevices(ctx, page.ThingIds, &report, params); err != nil {
+			return report, err
+		}
+		if page.Cursor == "" {
+			break
+		}
+		params.Cursor = page.Cursor
+	}
+	deleteSnapshot(ctx, params.SnapshotID)
+	if missing := report.Patched - report.RolledBack - report.RollbackFailed; missing > 0 {
+		// The snapshot store lost entries, e.g. it is not shared by all workers, so these devices keep the patch
+		return report, temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("rollback found no snapshot for %d of %d patched devices", missing, report.Patched), "SnapshotsMissing", nil)
+	}
+	return report, nil
+}
+
+// awaitRollbackRequest waits up to window for a RollbackSignal and reports whether one arrived
+func awaitRollbackRequest(ctx workflow.Context, rollbackRequests workflow.ReceiveChannel, window time.Duration) bool {
+	received := false
+	timerCtx, cancelTimer := workflow.WithCancel(ctx)
+	defer cancelTimer()
+	selector := workflow.NewSelector(ctx)
+	selector.AddReceive(rollbackRequests, func(c workflow.ReceiveChannel, _ bool) {
+		c.Receive(ctx, nil)
+		received = true
+	})
+	selector.AddFuture(workflow.NewTimer(timerCtx, window), func(workflow.Future) {})
+	selector.Select(ctx)
+	return received
+}
+
+// patchDevices snapshots and patches the devices of a page with at most MaxConcurrency in flight.
+// With AutoRollback no new patches are sent after a failure, the remaining devices are skipped.
+func patchDevices(ctx workflow.Context, batch []DeviceOutcome, params DevicePatchParams) error {
+	running, failed := 0, false
+	wg := workflow.NewWaitGroup(ctx)
+	for i := range batch {
+		if err := workflow.Await(ctx, func() bool { return running < params.MaxConcurrency }); err != nil {
+			return err
+		}
+		if params.AutoRollback && failed {
+			for j := i; j < len(batch); j++ {
+				batch[j].Status = DeviceStatusSkipped
+				batch[j].Reason = "patch stopped after a failure"
+			}
+			break
+		}
+		running++
+		wg.Add(1)
+		workflow.Go(ctx, func(ctx workflow.Context) {
+			defer func() {
+				running--
+				wg.Done()
+			}()
+			patchDevice(ctx, &batch[i], params)
+			failed = failed || batch[i].Status == DeviceStatusFailed
+		})
+	}
+	wg.Wait(ctx)
+	return nil
+}
+
+// patchDevice snapshots the values touched by the patch and applies it if they did not change since
+func patchDevice(ctx workflow.Context, outcome *DeviceOutcome, params DevicePatchParams) {
+	var snapshot activities.DeviceSnapshot
+	snapshotParams := activities.SnapshotDeviceParams{
+		ThingId:    outcome.ThingId,
+		Path:       params.Path,
+		Patch:      params.Patch,
+		SnapshotID: params.SnapshotID,
+	}
+	if err := workflow.ExecuteActivity(ctx, "SnapshotDevice", snapshotParams).Get(ctx, &snapshot); err != nil {
+		outcome.Status = DeviceStatusSkipped
+		outcome.Reason = "snapshot failed: " + failureReason(err)
+		return
+	}
+
+	outcome.Status = DeviceStatusSent
+	configureParams := activities.ConfigureDeviceParams{
+		ThingId:       outcome.ThingId,
+		Path:          params.Path,
+		Patch:         params.Patch,
+		Condition:     params.Condition,
+		IfMatch:       snapshot.ETag,
+		CorrelationID: workflow.GetInfo(ctx).WorkflowExecution.ID + ":" + outcome.ThingId,
+		SnapshotID:    params.SnapshotID,
+	}
+	if snapshot.ETag == "" {
+		configureParams.IfNoneMatch = "*"
+	}
+	if err := workflow.ExecuteActivity(ctx, "ConfigureDevice", configureParams).Get(ctx, nil); err != nil {
+		outcome.Status = DeviceStatusFailed
+		outcome.Reason = failureReason(err)
+		return
+	}
+	outcome.Status = DeviceStatusAcknowledged
+}
+
+// restoreDevices restores the snapshot of each device with at most MaxConcurrency in flight.
+// Devices changed since they were patched keep their values and are reported.
+func restoreDevices(ctx workflow.Context, thingIDs []string, report *DevicePatchReport, params DevicePatchParams) error {
+	running := 0
+	wg := workflow.NewWaitGroup(ctx)
+	for _, thingID := range thingIDs {
+		if err := workflow.Await(ctx, func() bool { return running < params.MaxConcurrency }); err != nil {
+			return err
+		}
+		running++
+		wg.Add(1)
+		workflow.Go(ctx, func(ctx workflow.Context) {
+			defer func() {
+				running--
+				wg.Done()
+			}()
+			restoreParams := activities.RestoreDeviceParams{
+				SnapshotID:    params.SnapshotID,
+				ThingId:       thingID,
+				Path:          params.Path,
+				CorrelationID: workflow.GetInfo(ctx).WorkflowExecution.ID + ":rollback:" + thingID,
+			}
+			if err := workflow.ExecuteActivity(ctx, "RestoreDevice", restoreParams).Get(ctx, nil); err != nil {
+				report.RollbackFailed++
+				report.list(DeviceOutcome{ThingId: thingID, Status: DeviceStatusAcknowledged, Reason: "rollback failed: " + failureReason(err)})
+				return
+			}
+			report.RolledBack++
+		})
+	}
+	wg.Wait(ctx)
+	return nil
+}
+
+// deleteSnapshot removes the device snapshots once they can no longer be restored.
+// A snapshot left behind only takes space in the store, so failures are logged.
+func deleteSnapshot(ctx workflow.Context, snapshotID string) {
+	if err := workflow.ExecuteActivity(ctx, "DeleteSnapshot", snapshotID).Get(ctx, nil); err != nil {
+		workflow.GetLogger(ctx).Warn("Failed to delete device snapshots", "SnapshotID", snapshotID, "error", err)
+	}
+}
+
+// record adds the final outcomes of a page to the report
+func (r *DevicePatchReport) record(batch []DeviceOutcome) {
+	for _, outcome := range batch {
+		switch outcome.Status {
+		case DeviceStatusAcknowledged:
+			r.Patched++
+			continue
+		case DeviceStatusFailed:
+			r.Failed++
+		case DeviceStatusSkipped:
+			r.Skipped++
+		}
+		r.list(outcome)
+	}
+}
+
+// list adds an outcome to the report unless it already lists maxReportedOutcomes
+func (r *DevicePatchReport) list(outcome DeviceOutcome) {
+	if len(r.Outcomes) < maxReportedOutcomes {
+		r.Outcomes = append(r.Outcomes, outcome)
+	} else {
+		r.OutcomesTruncated = true
+	}
+}
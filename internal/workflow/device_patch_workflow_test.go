@@ -0,0 +1,236 @@
+package workflow_test
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"dm-backend/internal/activities"
+	"dm-backend/internal/workflow"
+
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/testsuite"
+	sdkworkflow "go.temporal.io/sdk/workflow"
+)
+
+// MockDevicePatchActivities snapshots every device as {"mode": "slow"} into an in-memory snapshot store
+// and records restored things
+type MockDevicePatchActivities struct {
+	MockConfigActivities
+
+	mu       sync.Mutex
+	Patched  map[string]bool // thingId -> patch acknowledged, for each snapshotted device
+	Restored []string
+	Deleted  bool
+}
+
+func (m *MockDevicePatchActivities) SnapshotDevice(_ context.Context, params activities.SnapshotDeviceParams) (activities.DeviceSnapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if params.SnapshotID == "" {
+		return activities.DeviceSnapshot{}, errors.New("snapshot not kept in the snapshot store")
+	}
+	if m.Patched == nil {
+		m.Patched = map[string]bool{}
+	}
+	m.Patched[params.ThingId] = false
+	return activities.DeviceSnapshot{ETag: `"rev:1"`}, nil
+}
+
+func (m *MockDevicePatchActivities) ConfigureDevice(_ context.Context, params activities.ConfigureDeviceParams) (activities.ConfigureDeviceResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if params.IfMatch != `"rev:1"` {
+		return activities.ConfigureDeviceResult{}, errors.New("patch not conditioned on the snapshot ETag")
+	}
+	m.Sent = append(m.Sent, params.ThingId)
+	if m.FailThings[params.ThingId] {
+		return activities.ConfigureDeviceResult{}, errors.New("ditto API returned status 412")
+	}
+	m.Patched[params.ThingId] = true
+	return activities.ConfigureDeviceResult{ETag: `"rev:2"`}, nil
+}
+
+func (m *MockDevicePatchActivities) ListPatchedDevices(_ context.Context, params activities.ListPatchedDevicesParams) (activities.PatchedDevicePage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var thingIDs []string
+	for thingID, patched := range m.Patched {
+		if patched && thingID > params.Cursor {
+			thingIDs = append(thingIDs, thingID)
+		}
+	}
+	sort.Strings(thingIDs)
+	page := activities.PatchedDevicePage{ThingIds: thingIDs}
+	if len(thingIDs) > params.PageSize {
+		page.ThingIds = thingIDs[:params.PageSize]
+		page.Cursor = page.ThingIds[params.PageSize-1]
+	}
+	return page, nil
+}
+
+func (m *MockDevicePatchActivities) RestoreDevice(_ context.Context, params activities.RestoreDeviceParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.Patched[params.ThingId] {
+		return errors.New("restoring a device that was not patched")
+	}
+	delete(m.Patched, params.ThingId)
+	m.Restored = append(m.Restored, params.ThingId)
+	return nil
+}
+
+func (m *MockDevicePatchActivities) DeleteSnapshot(_ context.Context, _ string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Deleted = true
+	return nil
+}
+
+func registerPatchActivities(env *testsuite.TestWorkflowEnvironment, mockActs *MockDevicePatchActivities) {
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.SnapshotDevice)
+	env.RegisterActivity(mockActs.ConfigureDevice)
+	env.RegisterActivity(mockActs.ListPatchedDevices)
+	env.RegisterActivity(mockActs.RestoreDevice)
+	env.RegisterActivity(mockActs.DeleteSnapshot)
+}
+
+func TestDevicePatchWorkflow_AutoRollbackOnFailure(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockDevicePatchActivities{MockConfigActivities: MockConfigActivities{
+		Devices:    mockDevices(4),
+		FailThings: map[string]bool{"org.example:device-2": true},
+	}}
+	registerPatchActivities(env, mockActs)
+
+	env.ExecuteWorkflow(workflow.DevicePatchWorkflow, workflow.DevicePatchParams{
+		RQLQuery:       `eq(attributes/type,"gateway")`,
+		Patch:          map[string]interface{}{"mode": "fast"},
+		MaxConcurrency: 1,
+		AutoRollback:   true,
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	var report workflow.DevicePatchReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	// device-3 is not patched after device-2 failed, only the acknowledged devices are restored
+	require.NotContains(t, mockActs.Sent, "org.example:device-3")
+	require.Equal(t, 2, report.RolledBack)
+	require.Equal(t, 1, report.Failed)
+	require.Equal(t, 1, report.Skipped)
+	require.ElementsMatch(t, []string{"org.example:device-0", "org.example:device-1"}, mockActs.Restored)
+	require.True(t, mockActs.Deleted)
+}
+
+func TestDevicePatchWorkflow_RollbackOnSignal(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockDevicePatchActivities{MockConfigActivities: MockConfigActivities{
+		Devices:    mockDevices(4),
+		FailThings: map[string]bool{"org.example:device-2": true},
+	}}
+	registerPatchActivities(env, mockActs)
+
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(workflow.RollbackSignal, nil)
+	}, time.Minute)
+
+	env.ExecuteWorkflow(workflow.DevicePatchWorkflow, workflow.DevicePatchParams{
+		RQLQuery:       `eq(attributes/type,"gateway")`,
+		Patch:          map[string]interface{}{"mode": "fast"},
+		RollbackWindow: time.Hour,
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	var report workflow.DevicePatchReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.Equal(t, 1, report.Failed)
+	require.Equal(t, 3, report.RolledBack)
+	require.NotContains(t, mockActs.Restored, "org.example:device-2")
+	require.Len(t, mockActs.Restored, 3)
+}
+
+func TestDevicePatchWorkflow_FailsRollbackWhenSnapshotsAreMissing(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockDevicePatchActivities{MockConfigActivities: MockConfigActivities{Devices: mockDevices(3)}}
+	registerPatchActivities(env, mockActs)
+
+	env.RegisterDelayedCallback(func() {
+		// The worker holding the snapshots of two devices is gone
+		mockActs.mu.Lock()
+		delete(mockActs.Patched, "org.example:device-0")
+		delete(mockActs.Patched, "org.example:device-1")
+		mockActs.mu.Unlock()
+		env.SignalWorkflow(workflow.RollbackSignal, nil)
+	}, time.Minute)
+
+	env.ExecuteWorkflow(workflow.DevicePatchWorkflow, workflow.DevicePatchParams{
+		RQLQuery:       `eq(attributes/type,"gateway")`,
+		Patch:          map[string]interface{}{"mode": "fast"},
+		RollbackWindow: time.Hour,
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.ErrorContains(t, env.GetWorkflowError(), "rollback found no snapshot for 2 of 3 patched devices")
+	require.Equal(t, []string{"org.example:device-2"}, mockActs.Restored)
+}
+
+func TestDevicePatchWorkflow_ContinuesAsNewWithCursor(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockDevicePatchActivities{MockConfigActivities: MockConfigActivities{Devices: mockDevices(20)}}
+	registerPatchActivities(env, mockActs)
+
+	env.ExecuteWorkflow(workflow.DevicePatchWorkflow, workflow.DevicePatchParams{
+		RQLQuery:         `eq(attributes/type,"gateway")`,
+		Patch:            map[string]interface{}{"mode": "fast"},
+		BatchSize:        5,
+		MaxBatchesPerRun: 2,
+		RollbackWindow:   time.Hour,
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.True(t, sdkworkflow.IsContinueAsNewError(env.GetWorkflowError()))
+	require.Len(t, mockActs.Sent, 10)
+	require.False(t, mockActs.Deleted, "snapshots must survive continue-as-new")
+}
+
+func TestDevicePatchWorkflow_ResumesRollbackFromSnapshotStore(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockDevicePatchActivities{Patched: map[string]bool{
+		"org.example:device-0": true,
+		"org.example:device-1": false, // snapshotted, patch failed
+		"org.example:device-2": true,
+		"org.example:device-3": true,
+	}}
+	registerPatchActivities(env, mockActs)
+
+	env.ExecuteWorkflow(workflow.DevicePatchWorkflow, workflow.DevicePatchParams{
+		RQLQuery:    `eq(attributes/type,"gateway")`,
+		Patch:       map[string]interface{}{"mode": "fast"},
+		BatchSize:   2,
+		SnapshotID:  "device-patch/test",
+		RollingBack: true,
+		Report:      workflow.DevicePatchReport{Patched: 3, Failed: 1},
+	})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+
+	var report workflow.DevicePatchReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.Equal(t, 3, report.RolledBack)
+	require.ElementsMatch(t, []string{"org.example:device-0", "org.example:device-2", "org.example:device-3"}, mockActs.Restored)
+	require.True(t, mockActs.Deleted)
+}
@@ -0,0 +1,320 @@
+package workflow
+
+import (
+	"dm-backend/internal/activities"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// ReconcileStatusQuery is the query type that returns the current ReconcileReport of a ReconcileWorkflow
+const ReconcileStatusQuery = "reconcile-status"
+
+const (
+	defaultPollInterval    = time.Minute
+	defaultMaxRetries      = 3
+	defaultMaxCyclesPerRun = 100
+	defaultMaxPagesPerRun  = 500
+)
+
+// maxTrackedDevices bounds the devices whose attempts are tracked in ReconcileParams.Pending, which is carried
+// across continue-as-new. Further lagging devices are re-sent every cycle and only counted.
+const maxTrackedDevices = 2000
+
+// maxDriftErrorLength bounds the error kept per tracked device
+const maxDriftErrorLength = 200
+
+type ReconcileParams struct {
+	RQLQuery          string
+	FeatureId         string
+	DesiredProperties map[string]interface{} // Set as the feature's desiredProperties, converged once reported in its properties
+	PollInterval      time.Duration          // Time between reconciliation cycles, defaults to 1 minute
+	MaxRetries        int                    // Times the desired properties are sent before a device is reported as drifting, defaults to 3
+	MaxConcurrency    int                    // Max in-flight ConfigureDevice activities, defaults to 10
+	MaxCyclesPerRun   int                    // Cycles before continuing as new, defaults to 100
+	MaxPagesPerRun    int                    // Search pages before continuing as new, also within a cycle, defaults to 500
+	PageSize          int                    // Devices per search page, defaults to the Ditto search default
+	StopWhenConverged bool                   // Complete once every matched device converged instead of watching for drift
+	Target            string                 // Ditto target, empty for the default target
+
+	// Carried across continue-as-new, leave empty when starting
+	Report    ReconcileReport // Report of the last completed cycle
+	Paused    bool
+	Pending   map[string]DeviceDrift // At most maxTrackedDevices
+	Cursor    string                 // Search cursor of the cycle in progress
+	Matched   int                    // Matched devices of the cycle in progress
+	Converged int                    // Converged devices of the cycle in progress
+	Untracked int                    // Lagging devices of the cycle in progress beyond maxTrackedDevices
+}
+
+// DeviceDrift tracks a device whose reported properties do not match the desired ones
+type DeviceDrift struct {
+	ThingId   string `json:"thingId"`
+	Attempts  int    `json:"attempts"` // Times the desired properties were sent
+	LastError string `json:"lastError,omitempty"`
+	Cycle     int    `json:"cycle"` // Last cycle the device matched the query in
+}
+
+// ReconcileReport is the result of the latest reconciliation cycle. Lagging and Drifting list at most
+// maxReportedOutcomes devices each, the counts cover all of them.
+type ReconcileReport struct {
+	Cycles            int           `json:"cycles"`
+	Matched           int           `json:"matched"`
+	Converged         int           `json:"converged"`
+	LaggingCount      int           `json:"laggingCount"`
+	DriftingCount     int           `json:"driftingCount"`
+	Lagging           []DeviceDrift `json:"lagging"`  // Not converged yet, desired properties will be re-sent
+	Drifting          []DeviceDrift `json:"drifting"` // Not converged after MaxRetries attempts
+	OutcomesTruncated bool          `json:"outcomesTruncated,omitempty"`
+	Paused            bool          `json:"paused,omitempty"`
+	Stopped           bool          `json:"stopped,omitempty"`
+}
+
+// ReconcileWorkflow drives the matched devices towards the desired configuration. Each cycle it
+// searches the devices in scope, compares the reported feature properties with the desired ones,
+// and (re-)sends the desired properties to devices that did not converge yet. Devices still not
+// converged after MaxRetries attempts are reported as drifting. The workflow runs until aborted
+// via the AbortSignal (or until all devices converged with StopWhenConverged) and can be paused
+// and resumed like a rollout.
+func ReconcileWorkflow(ctx workflow.Context, params ReconcileParams) (ReconcileReport, error) {
+	ao := workflow.ActivityOptions{
+		StartToCloseTimeout: time.Minute,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			BackoffCoefficient: 2.0,
+			MaximumAttempts:    3,
+		},
+	}
+	ctx = workflow.WithActivityOptions(ctx, ao)
+	ctx = activities.WithDittoTarget(ctx, params.Target)
+	if params.PollInterval <= 0 {
+		params.PollInterval = defaultPollInterval
+	}
+	if params.MaxRetries <= 0 {
+		params.MaxRetries = defaultMaxRetries
+	}
+	if params.MaxConcurrency <= 0 {
+		params.MaxConcurrency = defaultMaxConcurrency
+	}
+	if params.MaxCyclesPerRun <= 0 {
+		params.MaxCyclesPerRun = defaultMaxCyclesPerRun
+	}
+	if params.MaxPagesPerRun <= 0 {
+		params.MaxPagesPerRun = defaultMaxPagesPerRun
+	}
+	if params.Pending == nil {
+		params.Pending = map[string]DeviceDrift{}
+	}
+
+	control := newRolloutControl(ctx, params.Paused)
+	report := params.Report
+	err := workflow.SetQueryHandler(ctx, ReconcileStatusQuery, func() (ReconcileReport, error) {
+		status := report
+		status.Paused, status.Stopped = control.paused, control.aborted
+		return status, nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// Pause, abort and continue-as-new are checked before every page, a cycle interrupted by
+	// continue-as-new resumes at its cursor
+	for cycles, pages := 0, 0; ; pages++ {
+		if !control.wait(ctx) {
+			report.Stopped = true
+			return report, nil
+		}
+		if cycles >= params.MaxCyclesPerRun || pages >= params.MaxPagesPerRun || workflow.GetInfo(ctx).GetContinueAsNewSuggested() {
+			control.drain(ctx)
+			params.Report = report
+			params.Paused = control.paused
+			return report, workflow.NewContinueAsNewError(ctx, ReconcileWorkflow, params)
+		}
+
+		cycle := report.Cycles + 1
+		if err := reconcilePage(ctx, &params, cycle); err != nil {
+			return report, err
+		}
+		if params.Cursor != "" {
+			continue
+		}
+
+		// Forget devices that left the scope
+		for thingId, drift := range params.Pending {
+			if drift.Cycle != cycle {
+				delete(params.Pending, thingId)
+			}
+		}
+		report = params.report(cycle)
+		params.Matched, params.Converged, params.Untracked = 0, 0, 0
+		cycles++
+		if params.StopWhenConverged && len(params.Pending) == 0 {
+			return report, nil
+		}
+
+		workflow.AwaitWithTimeout(ctx, params.PollInterval, func() bool { return control.aborted })
+	}
+}
+
+// reconcilePage fetches the page of the devices in scope at params.Cursor and sends the desired
+// properties to those that did not converge. It updates params.Pending, the counts of the cycle
+// and advances params.Cursor, which is empty once the cycle scanned all pages.
+func reconcilePage(ctx workflow.Context, params *ReconcileParams, cycle int) error {
+	propertiesField := "features/" + params.FeatureId + "/properties"
+	searchParams := activities.SearchThingsParams{
+		Filter:   params.RQLQuery,
+		Fields:   []string{"thingId", propertiesField},
+		PageSize: params.PageSize,
+		Cursor:   params.Cursor,
+	}
+	var page activities.DevicePage
+	if err := workflow.ExecuteActivity(ctx, "FetchDevicePage", searchParams).Get(ctx, &page); err != nil {
+		return err
+	}
+
+	var lagging []string
+	for _, device := range page.Items {
+		params.Matched++
+		if propertiesConverged(params.DesiredProperties, reportedProperties(device.Features, params.FeatureId)) {
+			params.Converged++
+			delete(params.Pending, device.ThingId)
+			continue
+		}
+		drift, ok := params.Pending[device.ThingId]
+		if !ok && len(params.Pending) >= maxTrackedDevices {
+			params.Untracked++
+			lagging = append(lagging, device.ThingId)
+			continue
+		}
+		if !ok {
+			drift = DeviceDrift{ThingId: device.ThingId}
+		}
+		drift.Cycle = cycle
+		if drift.Attempts < params.MaxRetries {
+			lagging = append(lagging, device.ThingId)
+		}
+		params.Pending[device.ThingId] = drift
+	}
+	sendDesiredProperties(ctx, *params, lagging)
+	params.Cursor = page.Cursor
+	return nil
+}
+
+// sendDesiredProperties patches the feature's desiredProperties of each device with at most
+// MaxConcurrency activities in flight, counting the attempt in params.Pending
+func sendDesiredProperties(ctx workflow.Context, params ReconcileParams, thingIds []string) {
+	running := 0
+	wg := workflow.NewWaitGroup(ctx)
+	for _, thingId := range thingIds {
+		workflow.Await(ctx, func() bool { return running < params.MaxConcurrency })
+		running++
+		wg.Add(1)
+		workflow.Go(ctx, func(ctx workflow.Context) {
+			defer func() {
+				running--
+				wg.Done()
+			}()
+			configureParams := activities.ConfigureDeviceParams{
+				ThingId:       thingId,
+				Path:          "/features/" + params.FeatureId + "/desiredProperties",
+				Patch:         params.DesiredProperties,
+				CorrelationID: workflow.GetInfo(ctx).WorkflowExecution.ID + ":" + thingId,
+			}
+			err := workflow.ExecuteActivity(ctx, "ConfigureDevice", configureParams).Get(ctx, nil)
+			drift, ok := params.Pending[thingId]
+			if !ok {
+				return // untracked, see maxTrackedDevices
+			}
+			drift.Attempts++
+			drift.LastError = ""
+			if err != nil {
+				drift.LastError = truncate(failureReason(err), maxDriftErrorLength)
+			}
+			params.Pending[thingId] = drift
+		})
+	}
+	wg.Wait(ctx)
+}
+
+// report builds the report of a completed cycle from the pending devices and the counts of the cycle,
+// listing at most maxReportedOutcomes lagging and drifting devices sorted by thingId
+func (p ReconcileParams) report(cycle int) ReconcileReport {
+	report := ReconcileReport{
+		Cycles:       cycle,
+		Matched:      p.Matched,
+		Converged:    p.Converged,
+		LaggingCount: p.Untracked,
+		Lagging:      []DeviceDrift{},
+		Drifting:     []DeviceDrift{},
+	}
+	for _, drift := range p.Pending {
+		if drift.Attempts >= p.MaxRetries {
+			report.DriftingCount++
+			report.Drifting = append(report.Drifting, drift)
+		} else {
+			report.LaggingCount++
+			report.Lagging = append(report.Lagging, drift)
+		}
+	}
+	byThingId := func(a, b DeviceDrift) int { return strings.Compare(a.ThingId, b.ThingId) }
+	slices.SortFunc(report.Lagging, byThingId)
+	slices.SortFunc(report.Drifting, byThingId)
+	if len(report.Lagging) > maxReportedOutcomes {
+		report.Lagging = report.Lagging[:maxReportedOutcomes]
+		report.OutcomesTruncated = true
+	}
+	if len(report.Drifting) > maxReportedOutcomes {
+		report.Drifting = report.Drifting[:maxReportedOutcomes]
+		report.OutcomesTruncated = true
+	}
+	report.OutcomesTruncated = report.OutcomesTruncated || p.Untracked > 0
+	return report
+}
+
+// truncate shortens s to at most n bytes without splitting a UTF-8 sequence
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
+
+// reportedProperties extracts the properties of a feature from a search result
+func reportedProperties(features map[string]interface{}, featureId string) map[string]interface{} {
+	feature, _ := features[featureId].(map[string]interface{})
+	properties, _ := feature["properties"].(map[string]interface{})
+	return properties
+}
+
+// propertiesConverged reports whether every desired value is present in the reported properties.
+// A null desired value, which removes the key in a merge patch, converges once the key is absent.
+func propertiesConverged(desired, reported map[string]interface{}) bool {
+	for key, desiredValue := range desired {
+		reportedValue, ok := reported[key]
+		if desiredValue == nil {
+			if ok && reportedValue != nil {
+				return false
+			}
+			continue
+		}
+		if !ok {
+			return false
+		}
+		desiredObject, desiredIsObject := desiredValue.(map[string]interface{})
+		reportedObject, reportedIsObject := reportedValue.(map[string]interface{})
+		if desiredIsObject && reportedIsObject {
+			if !propertiesConverged(desiredObject, reportedObject) {
+				return false
+			}
+			continue
+		}
+		if !reflect.DeepEqual(desiredValue, reportedValue) {
+			return false
+		}
+	}
+	return true
+}
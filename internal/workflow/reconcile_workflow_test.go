@@ -0,0 +1,269 @@
+package workflow_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"dm-backend/internal/activities"
+	"dm-backend/internal/models"
+	"dm-backend/internal/workflow"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/converter"
+	"go.temporal.io/sdk/testsuite"
+	sdkworkflow "go.temporal.io/sdk/workflow"
+)
+
+// MockReconcileActivities simulates devices that report their desired "firmware" feature
+// properties after receiving them, except for the Stuck ones
+type MockReconcileActivities struct {
+	Count int
+	Stuck map[string]bool
+	Pages int
+
+	mu       sync.Mutex
+	Reported map[string]map[string]interface{}
+	Patches  map[string]int
+}
+
+func (m *MockReconcileActivities) FetchDevicePage(_ context.Context, params activities.SearchThingsParams) (activities.DevicePage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Pages++
+	page := activities.DevicePage{}
+	start, end := 0, m.Count
+	if params.Cursor != "" {
+		start, _ = strconv.Atoi(params.Cursor)
+	}
+	if params.PageSize > 0 && start+params.PageSize < m.Count {
+		end = start + params.PageSize
+		page.Cursor = strconv.Itoa(end)
+	}
+	for i := start; i < end; i++ {
+		thingId := fmt.Sprintf("org.example:device-%d", i)
+		device := models.Device{ThingId: thingId}
+		if properties, ok := m.Reported[thingId]; ok {
+			device.Features = map[string]interface{}{"firmware": map[string]interface{}{"properties": properties}}
+		}
+		page.Items = append(page.Items, device)
+	}
+	return page, nil
+}
+
+func (m *MockReconcileActivities) ConfigureDevice(_ context.Context, params activities.ConfigureDeviceParams) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if params.Path != "/features/firmware/desiredProperties" {
+		return fmt.Errorf("unexpected path %s", params.Path)
+	}
+	if m.Patches == nil {
+		m.Patches = map[string]int{}
+		m.Reported = map[string]map[string]interface{}{}
+	}
+	m.Patches[params.ThingId]++
+	if !m.Stuck[params.ThingId] {
+		m.Reported[params.ThingId] = params.Patch
+	}
+	return nil
+}
+
+func reconcileParams() workflow.ReconcileParams {
+	return workflow.ReconcileParams{
+		RQLQuery:          `eq(attributes/type,"sensor")`,
+		FeatureId:         "firmware",
+		DesiredProperties: map[string]interface{}{"version": "2.1.0"},
+		PollInterval:      time.Minute,
+		MaxRetries:        2,
+	}
+}
+
+func TestReconcileWorkflow_StopsWhenConverged(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockReconcileActivities{Count: 3}
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.ConfigureDevice)
+
+	params := reconcileParams()
+	params.StopWhenConverged = true
+	env.ExecuteWorkflow(workflow.ReconcileWorkflow, params)
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	var report workflow.ReconcileReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.Equal(t, 2, report.Cycles)
+	require.Equal(t, 3, report.Converged)
+	require.Empty(t, report.Lagging)
+	for _, patches := range mockActs.Patches {
+		require.Equal(t, 1, patches)
+	}
+}
+
+func TestReconcileWorkflow_ReportsDriftingDevices(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockReconcileActivities{Count: 3, Stuck: map[string]bool{"org.example:device-1": true}}
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.ConfigureDevice)
+
+	env.RegisterDelayedCallback(func() {
+		queried, err := env.QueryWorkflow(workflow.ReconcileStatusQuery)
+		require.NoError(t, err)
+		var status workflow.ReconcileReport
+		require.NoError(t, queried.Get(&status))
+		require.Equal(t, 2, status.Converged)
+		require.Len(t, status.Drifting, 1)
+		require.Equal(t, "org.example:device-1", status.Drifting[0].ThingId)
+		env.SignalWorkflow(workflow.AbortSignal, nil)
+	}, 5*time.Minute+time.Second)
+
+	env.ExecuteWorkflow(workflow.ReconcileWorkflow, reconcileParams())
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	var report workflow.ReconcileReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.True(t, report.Stopped)
+	// Stuck device was retried MaxRetries times and then only watched
+	require.Equal(t, 2, mockActs.Patches["org.example:device-1"])
+}
+
+func TestReconcileWorkflow_ContinuesAsNewWithinCycle(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockReconcileActivities{Count: 5}
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.ConfigureDevice)
+
+	params := reconcileParams()
+	params.StopWhenConverged = true
+	params.PageSize = 2
+	params.MaxPagesPerRun = 2
+	env.ExecuteWorkflow(workflow.ReconcileWorkflow, params)
+
+	require.True(t, env.IsWorkflowCompleted())
+	var continued *sdkworkflow.ContinueAsNewError
+	require.True(t, errors.As(env.GetWorkflowError(), &continued))
+	var next workflow.ReconcileParams
+	require.NoError(t, converter.GetDefaultDataConverter().FromPayloads(continued.Input, &next))
+	require.Equal(t, "4", next.Cursor)
+	require.Equal(t, 4, next.Matched)
+	require.Equal(t, 0, next.Report.Cycles)
+	require.Len(t, next.Pending, 4)
+
+	// The next run finishes the first cycle at the cursor instead of starting over
+	env = ts.NewTestWorkflowEnvironment()
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.ConfigureDevice)
+	next.MaxPagesPerRun = 10
+	env.ExecuteWorkflow(workflow.ReconcileWorkflow, next)
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	var report workflow.ReconcileReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.Equal(t, 2, report.Cycles)
+	require.Equal(t, 5, report.Converged)
+	require.Equal(t, 2+1+3, mockActs.Pages)
+	for _, patches := range mockActs.Patches {
+		require.Equal(t, 1, patches)
+	}
+}
+
+func TestReconcileWorkflow_PausesBetweenPages(t *testing.T) {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+
+	mockActs := &MockReconcileActivities{Count: 5}
+	env.OnActivity(mockActs.FetchDevicePage, mock.Anything, mock.Anything).Return(
+		func(ctx context.Context, params activities.SearchThingsParams) (activities.DevicePage, error) {
+			if params.Cursor == "" {
+				env.SignalWorkflow(workflow.PauseSignal, nil)
+			}
+			return mockActs.FetchDevicePage(ctx, params)
+		})
+	env.RegisterActivity(mockActs.ConfigureDevice)
+
+	env.RegisterDelayedCallback(func() {
+		require.Equal(t, 1, mockActs.Pages, "no page may be fetched while paused")
+		queried, err := env.QueryWorkflow(workflow.ReconcileStatusQuery)
+		require.NoError(t, err)
+		var status workflow.ReconcileReport
+		require.NoError(t, queried.Get(&status))
+		require.True(t, status.Paused)
+		env.SignalWorkflow(workflow.AbortSignal, nil)
+	}, time.Hour)
+
+	params := reconcileParams()
+	params.PageSize = 2
+	env.ExecuteWorkflow(workflow.ReconcileWorkflow, params)
+
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	var report workflow.ReconcileReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.True(t, report.Stopped)
+	require.Equal(t, 0, report.Cycles)
+}
+
+func TestReconcileWorkflow_BoundsCarriedStateAndKeepsLastReport(t *testing.T) {
+	const devices = 2005 // more than the tracked devices
+	stuck := map[string]bool{}
+	for i := 0; i < devices; i++ {
+		stuck[fmt.Sprintf("org.example:device-%d", i)] = true
+	}
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+	mockActs := &MockReconcileActivities{Count: devices, Stuck: stuck}
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.ConfigureDevice)
+
+	params := reconcileParams()
+	params.MaxConcurrency = 100
+	params.MaxPagesPerRun = 1
+	env.ExecuteWorkflow(workflow.ReconcileWorkflow, params)
+
+	var continued *sdkworkflow.ContinueAsNewError
+	require.True(t, errors.As(env.GetWorkflowError(), &continued))
+	var next workflow.ReconcileParams
+	require.NoError(t, converter.GetDefaultDataConverter().FromPayloads(continued.Input, &next))
+	require.Len(t, next.Pending, 2000)
+	require.Len(t, mockActs.Patches, devices, "untracked devices are sent the desired properties as well")
+	require.Equal(t, 1, next.Report.Cycles)
+	require.Equal(t, devices, next.Report.LaggingCount)
+	require.Len(t, next.Report.Lagging, 500)
+	require.True(t, next.Report.OutcomesTruncated)
+
+	// The next run reports the last cycle until its own first cycle completes
+	env = ts.NewTestWorkflowEnvironment()
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.ConfigureDevice)
+	next.Paused = true
+	env.RegisterDelayedCallback(func() {
+		queried, err := env.QueryWorkflow(workflow.ReconcileStatusQuery)
+		require.NoError(t, err)
+		var status workflow.ReconcileReport
+		require.NoError(t, queried.Get(&status))
+		require.Equal(t, devices, status.LaggingCount)
+		require.Len(t, status.Lagging, 500)
+		env.SignalWorkflow(workflow.AbortSignal, nil)
+	}, time.Minute)
+	env.ExecuteWorkflow(workflow.ReconcileWorkflow, next)
+
+	require.NoError(t, env.GetWorkflowError())
+	var report workflow.ReconcileReport
+	require.NoError(t, env.GetWorkflowResult(&report))
+	require.True(t, report.Stopped)
+	require.Equal(t, 1, report.Cycles)
+	require.Equal(t, devices, report.LaggingCount)
+}
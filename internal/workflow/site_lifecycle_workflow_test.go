@@ -0,0 +1,221 @@
+package workflow_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"dm-backend/internal/activities"
+	"dm-backend/internal/models"
+	"dm-backend/internal/workflow"
+
+	"github.com/stretchr/testify/require"
+	"go.temporal.io/sdk/testsuite"
+)
+
+// MockSiteActivities serves a site with an open connection and records the executed steps
+type MockSiteActivities struct {
+	Missing bool
+	FailOn  string
+
+	mu               sync.Mutex
+	Calls            []string
+	DeletedSnapshots []string
+}
+
+func (m *MockSiteActivities) record(call string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Calls = append(m.Calls, call)
+	if call == m.FailOn {
+		return errors.New(call + " failed")
+	}
+	return nil
+}
+
+func (m *MockSiteActivities) FetchDevicePage(_ context.Context, _ activities.SearchThingsParams) (activities.DevicePage, error) {
+	if m.Missing {
+		return activities.DevicePage{}, nil
+	}
+	return activities.DevicePage{Items: []models.Device{{ThingId: "gateway:site1", PolicyId: "gateway:site1-policy"}}}, nil
+}
+
+func (m *MockSiteActivities) FindConnection(_ context.Context, _ activities.FindConnectionParams) (string, error) {
+	if m.Missing {
+		return "", nil
+	}
+	return "conn-1", nil
+}
+
+func (m *MockSiteActivities) SnapshotConnection(_ context.Context, params activities.SnapshotConnectionParams) (activities.ConnectionSnapshot, error) {
+	if params.SnapshotID == "" {
+		return activities.ConnectionSnapshot{}, errors.New("snapshot ID required")
+	}
+	return activities.ConnectionSnapshot{ConnectionStatus: "open"}, nil
+}
+
+func (m *MockSiteActivities) DeleteSnapshot(_ context.Context, snapshotID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.DeletedSnapshots = append(m.DeletedSnapshots, snapshotID)
+	return nil
+}
+
+func (m *MockSiteActivities) ModifyConnection(_ context.Context, _ activities.ModifyConnectionParams) error {
+	return m.record("ModifyConnection")
+}
+
+func (m *MockSiteActivities) RestoreConnection(_ context.Context, params activities.RestoreConnectionParams) error {
+	return m.record("RestoreConnection:" + params.ConnectionID)
+}
+
+func (m *MockSiteActivities) GetConnectionTemplateVersion(_ context.Context, _ activities.GetConnectionTemplateParams) (int, error) {
+	return 1, nil
+}
+
+func (m *MockSiteActivities) SendConnectionCommand(_ context.Context, params activities.ConnectionCommandParams) error {
+	return m.record(params.Command)
+}
+
+func (m *MockSiteActivities) DeleteConnection(_ context.Context, _ activities.DeleteConnectionParams) error {
+	return m.record("DeleteConnection")
+}
+
+func (m *MockSiteActivities) ModifyPolicyEntry(_ context.Context, params activities.ModifyPolicyEntryParams) error {
+	return m.record("ModifyPolicyEntry:" + params.PolicyID + "/" + params.Label)
+}
+
+func (m *MockSiteActivities) DeletePolicyEntry(_ context.Context, params activities.DeletePolicyEntryParams) error {
+	return m.record("DeletePolicyEntry:" + params.PolicyID + "/" + params.Label)
+}
+
+func (m *MockSiteActivities) DeletePolicy(_ context.Context, params activities.DeletePolicyParams) error {
+	return m.record("DeletePolicy:" + params.PolicyID)
+}
+
+func (m *MockSiteActivities) SnapshotDevice(_ context.Context, _ activities.SnapshotDeviceParams) (activities.DeviceSnapshot, error) {
+	return activities.DeviceSnapshot{Restore: map[string]interface{}{"siteDescription": "old"}, ETag: `"rev:1"`}, nil
+}
+
+func (m *MockSiteActivities) ConfigureDevice(_ context.Context, _ activities.ConfigureDeviceParams) error {
+	return m.record("ConfigureDevice")
+}
+
+func (m *MockSiteActivities) DeleteThing(_ context.Context, _ activities.DeleteThingParams) error {
+	return m.record("DeleteThing")
+}
+
+func newSiteTestEnv(mockActs *MockSiteActivities) *testsuite.TestWorkflowEnvironment {
+	ts := testsuite.WorkflowTestSuite{}
+	env := ts.NewTestWorkflowEnvironment()
+	env.RegisterActivity(mockActs.FetchDevicePage)
+	env.RegisterActivity(mockActs.FindConnection)
+	env.RegisterActivity(mockActs.SnapshotConnection)
+	env.RegisterActivity(mockActs.ModifyConnection)
+	env.RegisterActivity(mockActs.RestoreConnection)
+	env.RegisterActivity(mockActs.DeleteSnapshot)
+	env.RegisterActivity(mockActs.SendConnectionCommand)
+	env.RegisterActivity(mockActs.GetConnectionTemplateVersion)
+	env.RegisterActivity(mockActs.DeleteConnection)
+	env.RegisterActivity(mockActs.ModifyPolicyEntry)
+	env.RegisterActivity(mockActs.DeletePolicyEntry)
+	env.RegisterActivity(mockActs.DeletePolicy)
+	env.RegisterActivity(mockActs.SnapshotDevice)
+	env.RegisterActivity(mockActs.ConfigureDevice)
+	env.RegisterActivity(mockActs.DeleteThing)
+	return env
+}
+
+var updatedSite = models.Site{SiteName: "site1", Host: "broker", Port: "8883", Username: "user", Password: "pass", Description: "new"}
+
+func TestUpdateSiteWorkflow_Success(t *testing.T) {
+	mockActs := &MockSiteActivities{}
+	env := newSiteTestEnv(mockActs)
+
+	env.ExecuteWorkflow(workflow.UpdateSiteWorkflow, workflow.UpdateSiteParams{Site: updatedSite})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	require.Equal(t, []string{
+		"ModifyConnection",
+		activities.OpenConnectionCommand,
+		"ModifyPolicyEntry:gateway:site1-policy/DEVICE",
+		"ConfigureDevice",
+	}, mockActs.Calls)
+}
+
+func TestUpdateSiteWorkflow_RestoresConnectionOnFailure(t *testing.T) {
+	mockActs := &MockSiteActivities{FailOn: "ConfigureDevice"}
+	env := newSiteTestEnv(mockActs)
+
+	env.ExecuteWorkflow(workflow.UpdateSiteWorkflow, workflow.UpdateSiteParams{Site: updatedSite})
+	require.True(t, env.IsWorkflowCompleted())
+	require.Error(t, env.GetWorkflowError())
+	require.Contains(t, env.GetWorkflowError().Error(), "updateGatewayAttributes failed after retries")
+	require.Equal(t, "RestoreConnection:conn-1", mockActs.Calls[len(mockActs.Calls)-1])
+	require.Len(t, mockActs.DeletedSnapshots, 1, "the connection snapshot is removed once compensated")
+}
+
+func TestDeleteSiteWorkflow_Success(t *testing.T) {
+	mockActs := &MockSiteActivities{}
+	env := newSiteTestEnv(mockActs)
+
+	env.ExecuteWorkflow(workflow.DeleteSiteWorkflow, workflow.DeleteSiteParams{SiteName: "site1"})
+	require.True(t, env.IsWorkflowCompleted())
+	require.NoError(t, env.GetWorkflowError())
+	require.Equal(t, []string{
+		activities.CloseConnectionCommand,
+		"DeleteConnection",
+		"DeletePolicyEntry:gateway:site1-policy/DEVICE",
+		"DeleteThing",
+		"DeletePolicy:gateway:site1-policy",
+	}, mockActs.Calls)
+}
+
+func TestDeleteSiteWorkflow_CompensatesInReverseOrder(t *testing.T) {
+	mockActs := &MockSiteActivities{FailOn: "DeleteThing"}
+	env := newSiteTestEnv(mockActs)
+
+	env.ExecuteWorkflow(workflow.DeleteSiteWorkflow, workflow.DeleteSiteParams{SiteName: "site1"})
+	require.True(t, env.IsWorkflowCompleted())
+	require.Error(t, env.GetWorkflowError())
+	require.Contains(t, env.GetWorkflowError().Error(), "deleteGatewayThing failed after retries")
+	// DeleteThing is retried before compensating
+	require.Equal(t, []string{
+		"ModifyPolicyEntry:gateway:site1-policy/DEVICE",
+		"RestoreConnection:conn-1",
+		activities.OpenConnectionCommand,
+	}, mockActs.Calls[len(mockActs.Calls)-3:])
+}
+
+func TestDeleteSiteWorkflow_FailsWhenSitePolicyIsLeft(t *testing.T) {
+	mockActs := &MockSiteActivities{FailOn: "DeletePolicy:gateway:site1-policy"}
+	env := newSiteTestEnv(mockActs)
+
+	env.ExecuteWorkflow(workflow.DeleteSiteWorkflow, workflow.DeleteSiteParams{SiteName: "site1"})
+	require.True(t, env.IsWorkflowCompleted())
+	require.Error(t, env.GetWorkflowError())
+	require.Contains(t, env.GetWorkflowError().Error(), "deleteSitePolicy failed after retries")
+	// The thing is gone, nothing is restored; the policy deletion is retried beyond the usual 5 attempts
+	require.Equal(t, []string{
+		activities.CloseConnectionCommand,
+		"DeleteConnection",
+		"DeletePolicyEntry:gateway:site1-policy/DEVICE",
+		"DeleteThing",
+	}, mockActs.Calls[:4])
+	for _, call := range mockActs.Calls[4:] {
+		require.Equal(t, "DeletePolicy:gateway:site1-policy", call)
+	}
+	require.Greater(t, len(mockActs.Calls[4:]), 5)
+}
+
+func TestDeleteSiteWorkflow_NotFound(t *testing.T) {
+	mockActs := &MockSiteActivities{Missing: true}
+	env := newSiteTestEnv(mockActs)
+
+	env.ExecuteWorkflow(workflow.DeleteSiteWorkflow, workflow.DeleteSiteParams{SiteName: "site1"})
+	require.True(t, env.IsWorkflowCompleted())
+	require.Error(t, env.GetWorkflowError())
+	require.Contains(t, env.GetWorkflowError().Error(), "site site1 not found")
+	require.Empty(t, mockActs.Calls)
+}
@@ -0,0 +1,113 @@
+package workflow
+
+import (
+	"dm-backend/internal/activities"
+	"dm-backend/internal/models"
+	"fmt"
+	"time"
+
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// UpdateSiteParams defines the input for the updateSite workflow
+type UpdateSiteParams struct {
+	Site   models.Site
+	Target string // Ditto target, empty for the default target
+}
+
+// UpdateSiteWorkflow modifies the connection of an existing site with the latest version of its template,
+// re-applies its gateway policy entry and updates the gateway thing attributes. The previous connection is restored when a later step fails.
+func UpdateSiteWorkflow(ctx workflow.Context, params UpdateSiteParams) error {
+	ao := workflow.ActivityOptions{
+		StartToCloseTimeout: time.Minute,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			BackoffCoefficient: 2.0,
+			MaximumAttempts:    5,
+		},
+	}
+	ctx = workflow.WithActivityOptions(ctx, ao)
+	ctx = activities.WithDittoTarget(ctx, params.Target)
+	if err := params.Site.Validate(); err != nil {
+		return temporal.NewNonRetryableApplicationError(err.Error(), "InvalidSite", nil)
+	}
+	siteName := params.Site.SiteName
+
+	thing, found, err := findSiteThing(ctx, siteName)
+	if err != nil {
+		return err
+	}
+	connectionID, err := findSiteConnection(ctx, siteName)
+	if err != nil {
+		return err
+	}
+	if !found || connectionID == "" {
+		return siteNotFoundError(siteName)
+	}
+
+	templateVersion, err := connectionTemplateVersion(ctx, params.Site.TemplateName())
+	if err != nil {
+		return err
+	}
+
+	// 1. Modify the connection, keeping the previous definition in the snapshot store for compensation
+	snapshotParams := activities.SnapshotConnectionParams{SnapshotID: connectionSnapshotID(ctx), ConnectionID: connectionID}
+	defer deleteSnapshot(disconnected(ctx), snapshotParams.SnapshotID)
+	var previous activities.ConnectionSnapshot
+	if err := workflow.ExecuteActivity(ctx, "SnapshotConnection", snapshotParams).Get(ctx, &previous); err != nil {
+		return err
+	}
+	modifyConnParams := activities.ModifyConnectionParams{
+		ConnectionID:    connectionID,
+		TemplateName:    params.Site.TemplateName(),
+		TemplateVersion: templateVersion,
+		Placeholders:    params.Site.ConnectionPlaceholders(thing.ThingId),
+		Secrets:         params.Site.ConnectionSecrets(),
+	}
+	if err := workflow.ExecuteActivity(ctx, "ModifyConnection", modifyConnParams).Get(ctx, nil); err != nil {
+		return fmt.Errorf("modifyGatewayConnection failed after retries: %w", err)
+	}
+	var undo compensations
+	undo.addActivity("RestoreConnection", activities.RestoreConnectionParams{SnapshotID: snapshotParams.SnapshotID, ConnectionID: connectionID})
+
+	// The template creates connections closed, reopen a connection that was open before
+	if previous.ConnectionStatus == "open" {
+		openParams := activities.ConnectionCommandParams{ConnectionID: connectionID, Command: activities.OpenConnectionCommand}
+		if err := workflow.ExecuteActivity(ctx, "SendConnectionCommand", openParams).Get(ctx, nil); err != nil {
+			return undo.compensate(ctx, "openGatewayConnection", err)
+		}
+	}
+
+	// 2. Re-apply the gateway policy entry
+	updatePolicyParams := gatewayPolicyEntryParams(thing.PolicyId, thing.ThingId)
+	if err := workflow.ExecuteActivity(ctx, "ModifyPolicyEntry", updatePolicyParams).Get(ctx, nil); err != nil {
+		return undo.compensate(ctx, "updateGatewayPolicy", err)
+	}
+
+	// 3. Update the gateway thing attributes, conditional on the snapshot to not overwrite concurrent changes
+	patch := map[string]interface{}{
+		"siteDescription":           params.Site.Description,
+		"connectionTemplate":        params.Site.TemplateName(),
+		"connectionTemplateVersion": templateVersion,
+	}
+	var snapshot activities.DeviceSnapshot
+	err = workflow.ExecuteActivity(ctx, "SnapshotDevice", activities.SnapshotDeviceParams{
+		ThingId: thing.ThingId,
+		Path:    activities.DefaultDevicePatchPath,
+		Patch:   patch,
+	}).Get(ctx, &snapshot)
+	if err != nil {
+		return undo.compensate(ctx, "snapshotGatewayAttributes", err)
+	}
+	configureParams := activities.ConfigureDeviceParams{
+		ThingId: thing.ThingId,
+		Path:    activities.DefaultDevicePatchPath,
+		Patch:   patch,
+		IfMatch: snapshot.ETag,
+	}
+	if err := workflow.ExecuteActivity(ctx, "ConfigureDevice", configureParams).Get(ctx, nil); err != nil {
+		return undo.compensate(ctx, "updateGatewayAttributes", err)
+	}
+	return nil
+}